@@ -0,0 +1,39 @@
+package http
+
+import (
+	"encoding/json"
+	"github.com/awakari/int-email/service/health"
+	"net/http"
+)
+
+// NewHandler returns the handler serving the health endpoints:
+// /healthz for the liveness, /readyz for the readiness and /status for the detailed status.
+func NewHandler(svc health.Service) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		writeCheck(w, svc.Live(r.Context()))
+	})
+	mux.HandleFunc("GET /readyz", func(w http.ResponseWriter, r *http.Request) {
+		writeCheck(w, svc.Ready(r.Context()))
+	})
+	mux.HandleFunc("GET /status", func(w http.ResponseWriter, r *http.Request) {
+		s := svc.Status(r.Context())
+		w.Header().Set("Content-Type", "application/json")
+		if !s.Ready {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		_ = json.NewEncoder(w).Encode(s)
+	})
+	return mux
+}
+
+func writeCheck(w http.ResponseWriter, err error) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	switch err {
+	case nil:
+		_, _ = w.Write([]byte("ok\n"))
+	default:
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = w.Write([]byte(err.Error() + "\n"))
+	}
+}
@@ -0,0 +1,86 @@
+package replay
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/awakari/int-email/service"
+	"github.com/awakari/int-email/service/deadletter"
+	"github.com/awakari/int-email/util"
+	"io"
+	"time"
+)
+
+const usage = `Usage: int-email replay [-list] [-all] [id ...]
+
+Re-submits the dead letters: the messages failed to be converted or written.
+A successfully replayed entry is deleted. A failed one is kept with the new error.
+`
+
+var ErrReplay = errors.New("failed to replay")
+
+// Run handles the "replay" subcommand arguments.
+func Run(ctx context.Context, args []string, svc service.Service, dl deadletter.Service, out io.Writer) (err error) {
+	fs := flag.NewFlagSet("replay", flag.ContinueOnError)
+	fs.SetOutput(out)
+	fs.Usage = func() {
+		_, _ = fmt.Fprint(out, usage)
+		fs.PrintDefaults()
+	}
+	list := fs.Bool("list", false, "list the dead letters")
+	all := fs.Bool("all", false, "replay all dead letters")
+	err = fs.Parse(args)
+	var ids []string
+	if err == nil {
+		ids = fs.Args()
+		if *list || *all {
+			ids, err = dl.List(ctx)
+		}
+	}
+	switch {
+	case err != nil:
+	case *list:
+		err = printList(ctx, dl, ids, out)
+	case len(ids) == 0 && !*all:
+		fs.Usage()
+	default:
+		for _, id := range ids {
+			err = errors.Join(err, replayEntry(ctx, svc, dl, id, out))
+		}
+	}
+	return
+}
+
+func printList(ctx context.Context, dl deadletter.Service, ids []string, out io.Writer) (err error) {
+	for _, id := range ids {
+		var e deadletter.Entry
+		e, err = dl.Get(ctx, id)
+		if err != nil {
+			break
+		}
+		_, _ = fmt.Fprintf(out, "%s\t%s\t%s\t%d bytes\t%s\n", e.Id, e.Time.Format(time.RFC3339), e.Envelope.From, len(e.Raw), e.Error)
+	}
+	return
+}
+
+func replayEntry(ctx context.Context, svc service.Service, dl deadletter.Service, id string, out io.Writer) (err error) {
+	var e deadletter.Entry
+	e, err = dl.Get(ctx, id)
+	if err == nil {
+		// keep the correlation id of the original session
+		err = svc.Submit(util.WithCorrelationId(ctx, e.Envelope.CorrelationId), e.Envelope, bytes.NewReader(e.Raw))
+	}
+	if err == nil {
+		err = dl.Delete(ctx, id)
+	}
+	switch err {
+	case nil:
+		_, _ = fmt.Fprintf(out, "%s\treplayed\n", id)
+	default:
+		_, _ = fmt.Fprintf(out, "%s\tfailed\t%s\n", id, err)
+		err = fmt.Errorf("%w %s: %s", ErrReplay, id, err)
+	}
+	return
+}
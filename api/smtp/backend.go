@@ -1,27 +1,41 @@
 package smtp
 
 import (
+	"context"
 	"github.com/awakari/int-email/service"
+	"github.com/awakari/int-email/service/spf"
+	"github.com/awakari/int-email/service/writer"
 	"github.com/emersion/go-smtp"
+	"net"
 )
 
 type backend struct {
 	rcptsPublish  map[string]bool
 	rcptsInternal map[string]bool
-	dataLimit     int64
+	dataLimits    DataLimits
 	svc           service.Service
+	svcSpf        spf.Service
+	spfPolicy     spf.Policy
+	breaker       writer.Breaker
 }
 
-func NewBackend(rcptsPublish, rcptsInternal map[string]bool, dataLimit int64, svc service.Service) smtp.Backend {
+func NewBackend(rcptsPublish, rcptsInternal map[string]bool, dataLimits DataLimits, svc service.Service, svcSpf spf.Service, spfPolicy spf.Policy, brk writer.Breaker) smtp.Backend {
 	return backend{
 		rcptsPublish:  rcptsPublish,
 		rcptsInternal: rcptsInternal,
-		dataLimit:     dataLimit,
+		dataLimits:    dataLimits,
 		svc:           svc,
+		svcSpf:        svcSpf,
+		spfPolicy:     spfPolicy,
+		breaker:       brk,
 	}
 }
 
 func (b backend) NewSession(c *smtp.Conn) (s smtp.Session, err error) {
-	s = newSession(b.rcptsPublish, b.rcptsInternal, b.dataLimit, b.svc)
+	var remoteIp net.IP
+	if addr, ok := c.Conn().RemoteAddr().(*net.TCPAddr); ok {
+		remoteIp = addr.IP
+	}
+	s = newSession(context.Background(), b.rcptsPublish, b.rcptsInternal, b.dataLimits, b.svc, b.svcSpf, b.spfPolicy, b.breaker, remoteIp, c.Hostname())
 	return
 }
@@ -1,7 +1,6 @@
 package smtp
 
 import (
-	"fmt"
 	"github.com/emersion/go-smtp"
 	"log/slog"
 )
@@ -21,12 +20,18 @@ func NewBackendLogging(b smtp.Backend, log *slog.Logger) smtp.Backend {
 func (bl backendLogging) NewSession(c *smtp.Conn) (s smtp.Session, err error) {
 	tls, tlsOk := c.TLSConnectionState()
 	s, err = bl.b.NewSession(c)
+	attrs := []any{
+		"helo", c.Hostname(),
+		"remote", c.Conn().RemoteAddr().String(),
+		"tls", tlsOk,
+		"tlsVersion", tls.Version,
+	}
 	switch err {
 	case nil:
-		bl.log.Debug(fmt.Sprintf("backend.NewSession(%s, %+v, %t)", c.Hostname(), tls, tlsOk))
 		s = NewSessionLogging(s, bl.log)
+		bl.log.DebugContext(s.(sessionLogging).ctx, "backend.NewSession", attrs...)
 	default:
-		bl.log.Error(fmt.Sprintf("backend.NewSession(%s, %+v, %t): err=%s", c.Hostname(), tls, tlsOk, err))
+		bl.log.Error("backend.NewSession", append(attrs, "err", err)...)
 	}
 	return
 }
@@ -0,0 +1,41 @@
+package smtp
+
+import (
+	"github.com/emersion/go-smtp"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var sessionsOpened = promauto.NewCounter(prometheus.CounterOpts{
+	Namespace: "int_email",
+	Subsystem: "smtp",
+	Name:      "sessions_opened_total",
+	Help:      "SMTP sessions opened",
+})
+
+var sessionsActive = promauto.NewGauge(prometheus.GaugeOpts{
+	Namespace: "int_email",
+	Subsystem: "smtp",
+	Name:      "sessions_active",
+	Help:      "SMTP sessions in progress",
+})
+
+type backendMetrics struct {
+	b smtp.Backend
+}
+
+func NewBackendMetrics(b smtp.Backend) smtp.Backend {
+	return backendMetrics{
+		b: b,
+	}
+}
+
+func (bm backendMetrics) NewSession(c *smtp.Conn) (s smtp.Session, err error) {
+	s, err = bm.b.NewSession(c)
+	if err == nil {
+		sessionsOpened.Inc()
+		sessionsActive.Inc()
+		s = NewSessionMetrics(s)
+	}
+	return
+}
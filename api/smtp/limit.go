@@ -0,0 +1,59 @@
+package smtp
+
+import (
+	"errors"
+	"fmt"
+	"github.com/awakari/int-email/model"
+	"github.com/emersion/go-smtp"
+	"io"
+)
+
+// DataLimits are the message size limits in bytes per recipient type.
+type DataLimits struct {
+	Publish  int64
+	Internal int64
+}
+
+// Max returns the limit to advertise in the SIZE extension, see https://www.rfc-editor.org/rfc/rfc1870
+func (l DataLimits) Max() int64 {
+	return max(l.Publish, l.Internal)
+}
+
+// limitReader fails with model.ErrTooLarge instead of the silent truncation done by io.LimitReader.
+type limitReader struct {
+	r     io.Reader
+	limit int64
+	n     int64
+}
+
+func newLimitReader(r io.Reader, limit int64) io.Reader {
+	return &limitReader{
+		r:     r,
+		limit: limit,
+		n:     limit,
+	}
+}
+
+func (lr *limitReader) Read(p []byte) (n int, err error) {
+	if lr.n < 0 {
+		return 0, lr.errTooLarge()
+	}
+	// read the byte beyond the limit to detect the oversize message
+	if int64(len(p)) > lr.n+1 {
+		p = p[:lr.n+1]
+	}
+	n, err = lr.r.Read(p)
+	lr.n -= int64(n)
+	switch {
+	case lr.n < 0:
+		n += int(lr.n)
+		err = lr.errTooLarge()
+	case errors.Is(err, smtp.ErrDataTooLarge):
+		err = lr.errTooLarge()
+	}
+	return
+}
+
+func (lr *limitReader) errTooLarge() error {
+	return fmt.Errorf("%w: exceeds %d bytes", model.ErrTooLarge, lr.limit)
+}
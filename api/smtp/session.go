@@ -2,29 +2,69 @@ package smtp
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"github.com/awakari/int-email/model"
 	"github.com/awakari/int-email/service"
+	"github.com/awakari/int-email/service/converter"
+	"github.com/awakari/int-email/service/spf"
+	"github.com/awakari/int-email/service/spool"
+	"github.com/awakari/int-email/service/writer"
+	"github.com/awakari/int-email/util"
 	"github.com/emersion/go-smtp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"io"
+	"net"
 	"strings"
 )
 
 type session struct {
+	ctx           context.Context
+	span          trace.Span
 	rcptsPublish  map[string]bool
 	rcptsInternal map[string]bool
-	dataLimit     int64
+	dataLimits    DataLimits
 	svc           service.Service
+	svcSpf        spf.Service
+	spfPolicy     spf.Policy
+	breaker       writer.Breaker
+	remoteIp      net.IP
+	helo          string
 	//
 	publish  bool
 	internal bool
 	from, to string
+	spf      spf.Result
+	spfTag   bool
+	size     int64
 }
 
-func newSession(rcptsPublish, rcptsInternal map[string]bool, dataLimit int64, svc service.Service) smtp.Session {
+func newSession(ctx context.Context, rcptsPublish, rcptsInternal map[string]bool, dataLimits DataLimits, svc service.Service, svcSpf spf.Service, spfPolicy spf.Policy, brk writer.Breaker, remoteIp net.IP, helo string) smtp.Session {
+	// the session span is the root of the spans of the messages received in the session
+	ctx, span := util.Tracer().Start(ctx, "smtp.session", trace.WithAttributes(
+		attribute.String("remote.ip", remoteIp.String()),
+		attribute.String("helo", helo),
+	))
+	// reuse the trace id when traced, so the logs and the trace are found by the same id
+	cid := util.NewCorrelationId()
+	if span.SpanContext().HasTraceID() {
+		cid = span.SpanContext().TraceID().String()
+	}
+	span.SetAttributes(attribute.String("correlation.id", cid))
+	ctx = util.WithCorrelationId(ctx, cid)
 	s := &session{
+		ctx:           ctx,
+		span:          span,
 		rcptsPublish:  make(map[string]bool),
 		rcptsInternal: make(map[string]bool),
-		dataLimit:     dataLimit,
+		dataLimits:    dataLimits,
 		svc:           svc,
+		svcSpf:        svcSpf,
+		spfPolicy:     spfPolicy,
+		breaker:       brk,
+		remoteIp:      remoteIp,
+		helo:          helo,
 	}
 	for r := range rcptsPublish {
 		s.rcptsPublish[strings.ToLower(r)] = true
@@ -35,19 +75,48 @@ func newSession(rcptsPublish, rcptsInternal map[string]bool, dataLimit int64, sv
 	return s
 }
 
+// Context returns the session context carrying the correlation id and the session span.
+func (s *session) Context() context.Context {
+	return s.ctx
+}
+
 func (s *session) Reset() {
 	s.publish = false
 	s.internal = false
 	s.from, s.to = "", ""
+	s.spf = ""
+	s.spfTag = false
+	s.size = 0
 	return
 }
 
 func (s *session) Logout() (err error) {
+	s.span.End()
 	return
 }
 
 func (s *session) Mail(from string, opts *smtp.MailOptions) (err error) {
 	s.from = from
+	if opts != nil {
+		s.size = opts.Size
+	}
+	if s.size > s.dataLimits.Max() {
+		err = s.stamped(sizeRejection(s.dataLimits.Max()))
+		return
+	}
+	if s.breaker.Open("", "") {
+		// don't let the sender transfer the message while nothing can be written
+		err = s.stamped(dataRejection(writer.ErrUnavailable))
+		return
+	}
+	// the result is kept regardless of the action, the DMARC evaluation needs it
+	s.spf, _ = s.svcSpf.Check(s.ctx, s.remoteIp, s.helo, from)
+	switch s.spfPolicy[s.spf] {
+	case spf.ActionReject:
+		err = s.stamped(spfRejection(s.spf))
+	case spf.ActionTag:
+		s.spfTag = true
+	}
 	return
 }
 
@@ -55,6 +124,16 @@ func (s *session) Rcpt(to string, opts *smtp.RcptOptions) (err error) {
 	sepIdx := strings.LastIndex(to, "@")
 	if sepIdx > 0 {
 		name := strings.ToLower(to[:sepIdx])
+		// the declared size is checked against the limit of the particular recipient
+		switch {
+		case s.rcptsInternal[name] && s.size > s.dataLimits.Internal:
+			err = s.stamped(sizeRejection(s.dataLimits.Internal))
+		case !s.rcptsInternal[name] && s.rcptsPublish[name] && s.size > s.dataLimits.Publish:
+			err = s.stamped(sizeRejection(s.dataLimits.Publish))
+		}
+		if err != nil {
+			return
+		}
 		if s.rcptsPublish[name] {
 			s.publish = true
 			s.to = to
@@ -70,24 +149,117 @@ func (s *session) Rcpt(to string, opts *smtp.RcptOptions) (err error) {
 func (s *session) Data(r io.Reader) (err error) {
 	switch {
 	case s.publish, s.internal:
-		r = io.LimitReader(r, s.dataLimit)
-		err = s.svc.Submit(context.TODO(), s.from, s.internal, r)
+		limit := s.dataLimits.Publish
+		if s.internal {
+			limit = s.dataLimits.Internal
+		}
+		r = newLimitReader(r, limit)
+		env := model.Envelope{
+			From:          s.from,
+			Internal:      s.internal,
+			Helo:          s.helo,
+			RemoteIp:      s.remoteIp.String(),
+			SpfResult:     string(s.spf),
+			SpfTag:        s.spfTag,
+			CorrelationId: util.CorrelationId(s.ctx),
+		}
+		ctx, span := util.Tracer().Start(s.ctx, "smtp.data", trace.WithAttributes(
+			attribute.String("from", s.from),
+			attribute.Bool("internal", s.internal),
+		))
+		err = s.svc.Submit(ctx, env, r)
+		util.SpanEnd(span, err)
 		if err != nil {
-			err = &smtp.SMTPError{
-				Code: 554,
-				EnhancedCode: smtp.EnhancedCode{
-					5, 3, 0,
-				},
-				Message: err.Error(),
-			}
+			err = s.stamped(dataRejection(err))
 		}
 	default:
-		err = &smtp.SMTPError{
+		err = s.stamped(&smtp.SMTPError{
 			Code: 550,
 			EnhancedCode: smtp.EnhancedCode{
 				5, 1, 1,
 			},
 			Message: "recipient rejected",
+		})
+	}
+	return
+}
+
+// stamped appends the correlation id to the reply, so the sender may refer to the particular session.
+// Note the successful DATA reply is fixed by the SMTP server and can not be stamped.
+func (s *session) stamped(src *smtp.SMTPError) (err error) {
+	src.Message = fmt.Sprintf("%s (session %s)", src.Message, util.CorrelationId(s.ctx))
+	err = src
+	return
+}
+
+// dataRejection maps the error class to the reply code, so the sender retries the temporary failures only.
+func dataRejection(src error) (err *smtp.SMTPError) {
+	err = &smtp.SMTPError{
+		Message: src.Error(),
+	}
+	switch {
+	case errors.Is(src, converter.ErrDkim):
+		// https://www.rfc-editor.org/rfc/rfc7372#section-3.1
+		err.Code, err.EnhancedCode = 550, smtp.EnhancedCode{5, 7, 20}
+	case errors.Is(src, converter.ErrDkimUnavailable):
+		err.Code, err.EnhancedCode = 451, smtp.EnhancedCode{4, 4, 3}
+	case errors.Is(src, spool.ErrPut):
+		// insufficient system storage, see https://www.rfc-editor.org/rfc/rfc3463#section-3.4
+		err.Code, err.EnhancedCode = 452, smtp.EnhancedCode{4, 3, 1}
+	case errors.Is(src, model.ErrTooLarge):
+		err.Code, err.EnhancedCode = 552, smtp.EnhancedCode{5, 3, 4}
+	case errors.Is(src, model.ErrContent):
+		err.Code, err.EnhancedCode = 550, smtp.EnhancedCode{5, 6, 0}
+	case errors.Is(src, model.ErrPolicy):
+		err.Code, err.EnhancedCode = 550, smtp.EnhancedCode{5, 7, 1}
+	case errors.Is(src, model.ErrLimitReached):
+		err.Code, err.EnhancedCode = 452, smtp.EnhancedCode{4, 2, 2}
+	case errors.Is(src, model.ErrTemporary):
+		err.Code, err.EnhancedCode = 451, smtp.EnhancedCode{4, 3, 0}
+	default:
+		err.Code, err.EnhancedCode = 554, smtp.EnhancedCode{5, 3, 0}
+	}
+	return
+}
+
+// sizeRejection returns the reply code as defined in https://www.rfc-editor.org/rfc/rfc1870#section-6
+func sizeRejection(limit int64) (err *smtp.SMTPError) {
+	err = &smtp.SMTPError{
+		Code: 552,
+		EnhancedCode: smtp.EnhancedCode{
+			5, 3, 4,
+		},
+		Message: fmt.Sprintf("message size exceeds fixed maximum message size of %d bytes", limit),
+	}
+	return
+}
+
+// spfRejection returns the reply code as defined in https://www.rfc-editor.org/rfc/rfc7372#section-3.2
+func spfRejection(r spf.Result) (err *smtp.SMTPError) {
+	switch r {
+	case spf.ResultTempError:
+		err = &smtp.SMTPError{
+			Code: 451,
+			EnhancedCode: smtp.EnhancedCode{
+				4, 7, 24,
+			},
+			Message: fmt.Sprintf("SPF validation error: %s", r),
+		}
+	case spf.ResultPermError:
+		err = &smtp.SMTPError{
+			Code: 550,
+			EnhancedCode: smtp.EnhancedCode{
+				5, 7, 24,
+			},
+			Message: fmt.Sprintf("SPF validation error: %s", r),
+		}
+	default:
+		err = &smtp.SMTPError{
+			Code: 550,
+			EnhancedCode: smtp.EnhancedCode{
+				5, 7, 23,
+			},
+			Message: fmt.Sprintf("SPF validation failed: %s", r),
 		}
 	}
 	return
@@ -2,7 +2,6 @@ package smtp
 
 import (
     "context"
-    "fmt"
     "github.com/emersion/go-smtp"
     "io"
     "log/slog"
@@ -10,43 +9,58 @@ import (
 
 type sessionLogging struct {
     s   smtp.Session
+    ctx context.Context
     log *slog.Logger
 }
 
+// contextual is the session carrying own context, e.g. the correlation id.
+type contextual interface {
+    Context() context.Context
+}
+
 func NewSessionLogging(s smtp.Session, log *slog.Logger) smtp.Session {
+    ctx := context.Background()
+    if c, ok := s.(contextual); ok {
+        ctx = c.Context()
+    }
     return sessionLogging{
         s:   s,
+        ctx: ctx,
         log: log,
     }
 }
 
 func (sl sessionLogging) Reset() {
     sl.s.Reset()
-    sl.log.Debug("session.Reset()")
+    sl.log.DebugContext(sl.ctx, "session.Reset")
     return
 }
 
 func (sl sessionLogging) Logout() (err error) {
     err = sl.s.Logout()
-    sl.log.Log(context.TODO(), logLevel(err), fmt.Sprintf("session.Logout(): err=%s", err))
+    sl.log.Log(sl.ctx, logLevel(err), "session.Logout", "err", err)
     return
 }
 
 func (sl sessionLogging) Mail(from string, opts *smtp.MailOptions) (err error) {
     err = sl.s.Mail(from, opts)
-    sl.log.Log(context.TODO(), logLevel(err), fmt.Sprintf("session.Mail(from=%s, opts=%+v): err=%s", from, opts, err))
+    var size int64
+    if opts != nil {
+        size = opts.Size
+    }
+    sl.log.Log(sl.ctx, logLevel(err), "session.Mail", "from", from, "size", size, "err", err)
     return
 }
 
 func (sl sessionLogging) Rcpt(to string, opts *smtp.RcptOptions) (err error) {
     err = sl.s.Rcpt(to, opts)
-    sl.log.Log(context.TODO(), logLevel(err), fmt.Sprintf("session.Rcpt(to=%s, opts=%+v): err=%s", to, opts, err))
+    sl.log.Log(sl.ctx, logLevel(err), "session.Rcpt", "to", to, "err", err)
     return
 }
 
 func (sl sessionLogging) Data(r io.Reader) (err error) {
     err = sl.s.Data(r)
-    sl.log.Log(context.TODO(), logLevel(err), fmt.Sprintf("session.Data(): err=%s", err))
+    sl.log.Log(sl.ctx, logLevel(err), "session.Data", "err", err)
     return
 }
 
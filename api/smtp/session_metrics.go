@@ -0,0 +1,110 @@
+package smtp
+
+import (
+	"errors"
+	"fmt"
+	"github.com/emersion/go-smtp"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"io"
+)
+
+var rcpts = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "int_email",
+		Subsystem: "smtp",
+		Name:      "rcpt_total",
+		Help:      "SMTP RCPT commands by the result: accepted or the enhanced status code of the rejection",
+	},
+	[]string{
+		"result",
+	},
+)
+
+var dataSize = promauto.NewHistogram(prometheus.HistogramOpts{
+	Namespace: "int_email",
+	Subsystem: "smtp",
+	Name:      "data_size_bytes",
+	Help:      "SMTP DATA size",
+	Buckets:   prometheus.ExponentialBuckets(1024, 4, 9), // 1 KiB .. 64 MiB
+})
+
+var datas = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "int_email",
+		Subsystem: "smtp",
+		Name:      "data_total",
+		Help:      "SMTP DATA commands by the result: accepted or the enhanced status code of the rejection",
+	},
+	[]string{
+		"result",
+	},
+)
+
+type sessionMetrics struct {
+	s smtp.Session
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func NewSessionMetrics(s smtp.Session) smtp.Session {
+	return sessionMetrics{
+		s: s,
+	}
+}
+
+func (sm sessionMetrics) Reset() {
+	sm.s.Reset()
+}
+
+func (sm sessionMetrics) Logout() (err error) {
+	err = sm.s.Logout()
+	sessionsActive.Dec()
+	return
+}
+
+func (sm sessionMetrics) Mail(from string, opts *smtp.MailOptions) (err error) {
+	return sm.s.Mail(from, opts)
+}
+
+func (sm sessionMetrics) Rcpt(to string, opts *smtp.RcptOptions) (err error) {
+	err = sm.s.Rcpt(to, opts)
+	rcpts.WithLabelValues(metricResult(err)).Inc()
+	return
+}
+
+func (sm sessionMetrics) Data(r io.Reader) (err error) {
+	cr := &countingReader{
+		r: r,
+	}
+	err = sm.s.Data(cr)
+	dataSize.Observe(float64(cr.n))
+	datas.WithLabelValues(metricResult(err)).Inc()
+	return
+}
+
+func (cr *countingReader) Read(p []byte) (n int, err error) {
+	n, err = cr.r.Read(p)
+	cr.n += int64(n)
+	return
+}
+
+// metricResult returns the low cardinality label value for the command result.
+func metricResult(err error) (result string) {
+	var smtpErr *smtp.SMTPError
+	switch {
+	case err == nil:
+		result = "accepted"
+	case errors.As(err, &smtpErr) && smtpErr.EnhancedCode[0] < 0:
+		result = fmt.Sprintf("%d", smtpErr.Code)
+	case errors.As(err, &smtpErr):
+		ec := smtpErr.EnhancedCode
+		result = fmt.Sprintf("%d.%d.%d", ec[0], ec[1], ec[2])
+	default:
+		result = "error"
+	}
+	return
+}
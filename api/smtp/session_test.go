@@ -0,0 +1,349 @@
+package smtp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/awakari/client-sdk-go/api/grpc/resolver"
+	"github.com/awakari/int-email/config"
+	"github.com/awakari/int-email/model"
+	"github.com/awakari/int-email/service"
+	"github.com/awakari/int-email/service/converter"
+	"github.com/awakari/int-email/service/dns"
+	"github.com/awakari/int-email/service/spf"
+	"github.com/awakari/int-email/service/spool"
+	"github.com/awakari/int-email/service/writer"
+	"github.com/awakari/int-email/util"
+	"github.com/emersion/go-smtp"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDataRejection(t *testing.T) {
+	cases := map[string]struct {
+		src          error
+		code         int
+		enhancedCode smtp.EnhancedCode
+	}{
+		"parse": {
+			src:          fmt.Errorf("%w: no text data", converter.ErrParse),
+			code:         550,
+			enhancedCode: smtp.EnhancedCode{5, 6, 0},
+		},
+		"dkim": {
+			src:          fmt.Errorf("%w: fail", converter.ErrDkim),
+			code:         550,
+			enhancedCode: smtp.EnhancedCode{5, 7, 20},
+		},
+		"dkim unavailable": {
+			src:          converter.ErrDkimUnavailable,
+			code:         451,
+			enhancedCode: smtp.EnhancedCode{4, 4, 3},
+		},
+		"dmarc": {
+			src:          fmt.Errorf("%w: example.com", service.ErrDmarc),
+			code:         550,
+			enhancedCode: smtp.EnhancedCode{5, 7, 1},
+		},
+		"spool": {
+			src:          fmt.Errorf("%w: no space left on device", spool.ErrPut),
+			code:         452,
+			enhancedCode: smtp.EnhancedCode{4, 3, 1},
+		},
+		"too large": {
+			src:          model.ErrTooLarge,
+			code:         552,
+			enhancedCode: smtp.EnhancedCode{5, 3, 4},
+		},
+		"limit reached": {
+			src:          fmt.Errorf("%w: %w", model.ErrLimitReached, errors.New("usage limit reached")),
+			code:         452,
+			enhancedCode: smtp.EnhancedCode{4, 2, 2},
+		},
+		"upstream unavailable": {
+			src:          fmt.Errorf("%w: %w", model.ErrTemporary, resolver.ErrUnavailable),
+			code:         451,
+			enhancedCode: smtp.EnhancedCode{4, 3, 0},
+		},
+		"writer unavailable": {
+			src:          writer.ErrUnavailable,
+			code:         451,
+			enhancedCode: smtp.EnhancedCode{4, 3, 0},
+		},
+		"unknown": {
+			src:          errors.New("unknown"),
+			code:         554,
+			enhancedCode: smtp.EnhancedCode{5, 3, 0},
+		},
+	}
+	for k, c := range cases {
+		t.Run(k, func(t *testing.T) {
+			err := dataRejection(c.src)
+			assert.Equal(t, c.code, err.Code)
+			assert.Equal(t, c.enhancedCode, err.EnhancedCode)
+			assert.Equal(t, c.src.Error(), err.Message)
+		})
+	}
+}
+
+type svcStub struct {
+	data []byte
+	env  model.Envelope
+	span trace.SpanContext
+	cid  string
+}
+
+func (s *svcStub) Submit(ctx context.Context, env model.Envelope, r io.Reader) (err error) {
+	s.data, err = io.ReadAll(r)
+	s.env = env
+	s.span = trace.SpanContextFromContext(ctx)
+	s.cid = util.CorrelationId(ctx)
+	return
+}
+
+func TestSession_Size(t *testing.T) {
+	limits := DataLimits{
+		Publish:  16,
+		Internal: 32,
+	}
+	cases := map[string]struct {
+		size    int64
+		rcpt    string
+		data    string
+		errMail int
+		errRcpt int
+		errData int
+	}{
+		"fits": {
+			size: 16,
+			rcpt: "publish@example.com",
+			data: "0123456789abcdef",
+		},
+		"size unknown, data too large": {
+			rcpt:    "publish@example.com",
+			data:    "0123456789abcdef0",
+			errData: 552,
+		},
+		"declared size exceeds recipient limit": {
+			size:    17,
+			rcpt:    "publish@example.com",
+			errRcpt: 552,
+		},
+		"declared size exceeds any limit": {
+			size:    33,
+			errMail: 552,
+		},
+		"larger limit for internal recipient": {
+			size: 32,
+			rcpt: "internal@example.com",
+			data: "0123456789abcdef0123456789abcdef",
+		},
+		"internal data too large": {
+			rcpt:    "internal@example.com",
+			data:    "0123456789abcdef0123456789abcdef0",
+			errData: 552,
+		},
+	}
+	for k, c := range cases {
+		t.Run(k, func(t *testing.T) {
+			svc := &svcStub{}
+			s := newSession(
+				context.TODO(),
+				map[string]bool{
+					"publish": true,
+				},
+				map[string]bool{
+					"internal": true,
+				},
+				limits,
+				svc,
+				spf.NewService(dns.Zone{}),
+				spf.Policy{},
+				writer.NewBreaker(config.WriterBreakerConfig{}),
+				net.IPv4(192, 0, 2, 1),
+				"mail.example.com",
+			)
+			err := s.Mail("john@example.com", &smtp.MailOptions{Size: c.size})
+			assertCode(t, c.errMail, err)
+			if err != nil {
+				return
+			}
+			err = s.Rcpt(c.rcpt, &smtp.RcptOptions{})
+			assertCode(t, c.errRcpt, err)
+			if err != nil {
+				return
+			}
+			err = s.Data(strings.NewReader(c.data))
+			assertCode(t, c.errData, err)
+			if err == nil {
+				assert.Equal(t, c.data, string(svc.data))
+			}
+		})
+	}
+}
+
+func assertCode(t *testing.T, code int, err error) {
+	if code == 0 {
+		assert.Nil(t, err)
+	} else {
+		var smtpErr *smtp.SMTPError
+		assert.ErrorAs(t, err, &smtpErr)
+		assert.Equal(t, code, smtpErr.Code)
+		assert.Equal(t, smtp.EnhancedCode{5, 3, 4}, smtpErr.EnhancedCode)
+	}
+}
+
+func TestSession_Breaker(t *testing.T) {
+	brk := writer.NewBreaker(config.WriterBreakerConfig{
+		FailuresGlobal: 1,
+		Timeout:        time.Minute,
+	})
+	s := newSession(
+		context.TODO(),
+		map[string]bool{
+			"publish": true,
+		},
+		map[string]bool{},
+		DataLimits{
+			Publish:  16,
+			Internal: 16,
+		},
+		&svcStub{},
+		spf.NewService(dns.Zone{}),
+		spf.Policy{},
+		brk,
+		net.IPv4(192, 0, 2, 1),
+		"mail.example.com",
+	)
+	require.Nil(t, s.Mail("john@example.com", &smtp.MailOptions{}))
+	s.Reset()
+	// the resolver is down
+	brk.Done("default", "john@example.com", resolver.ErrUnavailable)
+	err := s.Mail("john@example.com", &smtp.MailOptions{})
+	var smtpErr *smtp.SMTPError
+	require.ErrorAs(t, err, &smtpErr)
+	assert.Equal(t, 451, smtpErr.Code)
+	assert.Equal(t, smtp.EnhancedCode{4, 3, 0}, smtpErr.EnhancedCode)
+}
+
+func TestSessionMetrics(t *testing.T) {
+	s := NewSessionMetrics(newSession(
+		context.TODO(),
+		map[string]bool{
+			"publish": true,
+		},
+		map[string]bool{},
+		DataLimits{
+			Publish:  16,
+			Internal: 16,
+		},
+		&svcStub{},
+		spf.NewService(dns.Zone{}),
+		spf.Policy{},
+		writer.NewBreaker(config.WriterBreakerConfig{}),
+		net.IPv4(192, 0, 2, 1),
+		"mail.example.com",
+	))
+	acceptedBefore := testutil.ToFloat64(rcpts.WithLabelValues("accepted"))
+	rejectedBefore := testutil.ToFloat64(rcpts.WithLabelValues("5.3.4"))
+	tooLargeBefore := testutil.ToFloat64(datas.WithLabelValues("5.3.4"))
+	assert.Nil(t, s.Mail("john@example.com", &smtp.MailOptions{Size: 10}))
+	assert.Nil(t, s.Rcpt("publish@example.com", &smtp.RcptOptions{}))
+	s.Reset()
+	assert.Nil(t, s.Mail("john@example.com", &smtp.MailOptions{Size: 16}))
+	assert.Nil(t, s.Rcpt("publish@example.com", &smtp.RcptOptions{}))
+	assert.NotNil(t, s.Data(strings.NewReader("0123456789abcdef0")))
+	s.Reset()
+	assert.Nil(t, s.Mail("john@example.com", &smtp.MailOptions{Size: 16}))
+	s.(sessionMetrics).s.(*session).size = 17
+	assert.NotNil(t, s.Rcpt("publish@example.com", &smtp.RcptOptions{}))
+	assert.Equal(t, acceptedBefore+2, testutil.ToFloat64(rcpts.WithLabelValues("accepted")))
+	assert.Equal(t, rejectedBefore+1, testutil.ToFloat64(rcpts.WithLabelValues("5.3.4")))
+	assert.Equal(t, tooLargeBefore+1, testutil.ToFloat64(datas.WithLabelValues("5.3.4")))
+}
+
+func TestSession_Tracing(t *testing.T) {
+	exp := tracetest.NewInMemoryExporter()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exp)))
+	svc := &svcStub{}
+	s := newSession(
+		context.TODO(),
+		map[string]bool{
+			"publish": true,
+		},
+		map[string]bool{},
+		DataLimits{
+			Publish:  16,
+			Internal: 16,
+		},
+		svc,
+		spf.NewService(dns.Zone{}),
+		spf.Policy{},
+		writer.NewBreaker(config.WriterBreakerConfig{}),
+		net.IPv4(192, 0, 2, 1),
+		"mail.example.com",
+	)
+	for _, data := range []string{"message 1", "message 2"} {
+		require.Nil(t, s.Mail("john@example.com", &smtp.MailOptions{}))
+		require.Nil(t, s.Rcpt("publish@example.com", &smtp.RcptOptions{}))
+		require.Nil(t, s.Data(strings.NewReader(data)))
+		s.Reset()
+	}
+	require.Nil(t, s.Logout())
+	spans := exp.GetSpans()
+	require.Equal(t, 3, len(spans))
+	sess := spans[2]
+	assert.Equal(t, "smtp.session", sess.Name)
+	assert.False(t, sess.Parent.IsValid())
+	for _, data := range spans[:2] {
+		assert.Equal(t, "smtp.data", data.Name)
+		assert.Equal(t, sess.SpanContext.SpanID(), data.Parent.SpanID())
+	}
+	// the service continues the data span
+	assert.Equal(t, spans[1].SpanContext.SpanID(), svc.span.SpanID())
+}
+
+func TestSession_CorrelationId(t *testing.T) {
+	svc := &svcStub{}
+	s := newSession(
+		context.TODO(),
+		map[string]bool{
+			"publish": true,
+		},
+		map[string]bool{},
+		DataLimits{
+			Publish:  16,
+			Internal: 16,
+		},
+		svc,
+		spf.NewService(dns.Zone{}),
+		spf.Policy{},
+		writer.NewBreaker(config.WriterBreakerConfig{}),
+		net.IPv4(192, 0, 2, 1),
+		"mail.example.com",
+	)
+	cid := util.CorrelationId(s.(contextual).Context())
+	require.NotEmpty(t, cid)
+	require.Nil(t, s.Mail("john@example.com", &smtp.MailOptions{}))
+	require.Nil(t, s.Rcpt("publish@example.com", &smtp.RcptOptions{}))
+	require.Nil(t, s.Data(strings.NewReader("message 1")))
+	assert.Equal(t, cid, svc.cid)
+	assert.Equal(t, cid, svc.env.CorrelationId)
+	// the replies carry the id too
+	s.Reset()
+	require.Nil(t, s.Mail("john@example.com", &smtp.MailOptions{}))
+	err := s.Data(strings.NewReader("message 2"))
+	var smtpErr *smtp.SMTPError
+	require.ErrorAs(t, err, &smtpErr)
+	assert.Equal(t, "recipient rejected (session "+cid+")", smtpErr.Message)
+}
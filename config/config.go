@@ -9,7 +9,8 @@ import (
 type Config struct {
 	Api ApiConfig
 	Log struct {
-		Level int `envconfig:"LOG_LEVEL" default:"-4" required:"true"`
+		Level  int    `envconfig:"LOG_LEVEL" default:"-4" required:"true"`
+		Format string `envconfig:"LOG_FORMAT" default:"text" required:"true"`
 	}
 }
 
@@ -19,12 +20,15 @@ type ApiConfig struct {
 		Port uint16 `envconfig:"API_SMTP_PORT" default:"465" required:"true"`
 		Data struct {
 			Limit           uint32 `envconfig:"API_SMTP_DATA_LIMIT" default:"1048576" required:"true"`
+			LimitInternal   uint32 `envconfig:"API_SMTP_DATA_LIMIT_INTERNAL" default:"0"`
 			TruncUrlQueries bool   `envconfig:"API_SMTP_DATA_TRUNC_URL_QUERIES" default:"false"`
 		}
 		Recipients struct {
 			Publish  []string `envconfig:"API_SMTP_RECIPIENTS_PUBLISH" required:"true"`
 			Internal []string `envconfig:"API_SMTP_RECIPIENTS_INTERNAL" required:"true"`
 			Limit    uint16   `envconfig:"API_SMTP_RECIPIENTS_LIMIT" default:"100" required:"true"`
+			// Domains of the recipient addresses to redact from the published messages, API_SMTP_HOST when empty.
+			Domains []string `envconfig:"API_SMTP_RECIPIENTS_DOMAINS" default:""`
 		}
 		Timeout struct {
 			Read  time.Duration `envconfig:"API_SMTP_TIMEOUT_READ" default:"1m" required:"true"`
@@ -37,17 +41,58 @@ type ApiConfig struct {
 			ClientAuthType tls.ClientAuthType `envconfig:"API_SMTP_TLS_CLIENT_AUTH_TYPE" default:"4" required:"true"`
 		}
 	}
-	Group     string `envconfig:"API_GROUP" default:"default" required:"true"`
-	EventType EventTypeConfig
-	Writer    struct {
+	Group      string `envconfig:"API_GROUP" default:"default" required:"true"`
+	EventType  EventTypeConfig
+	Spf        SpfConfig
+	Dkim       DkimConfig
+	Dmarc      DmarcConfig
+	Arc        ArcConfig
+	Spool      SpoolConfig
+	Tracing    TracingConfig
+	Extractor  ExtractorConfig
+	Unwrap     UnwrapConfig
+	Time       TimeConfig
+	Dedup      DedupConfig
+	NearDup    NearDupConfig
+	RateLimit  RateLimitConfig
+	DeadLetter struct {
+		Dir string `envconfig:"API_DEADLETTER_DIR" default:"/var/spool/int-email/deadletter" required:"true"`
+	}
+	Http struct {
+		Port uint16 `envconfig:"API_HTTP_PORT" default:"8080" required:"true"`
+	}
+	Health struct {
+		Writer struct {
+			Ttl  time.Duration `envconfig:"API_HEALTH_WRITER_TTL" default:"30s" required:"true"`
+			User string        `envconfig:"API_HEALTH_WRITER_USER" default:"int-email-health" required:"true"`
+		}
+	}
+	Shutdown struct {
+		Timeout time.Duration `envconfig:"API_SHUTDOWN_TIMEOUT" default:"25s" required:"true"`
+	}
+	Writer struct {
 		Backoff   time.Duration `envconfig:"API_WRITER_BACKOFF" default:"10s" required:"true"`
 		BatchSize uint32        `envconfig:"API_WRITER_BATCH_SIZE" default:"16" required:"true"`
+		Breaker   WriterBreakerConfig
 		Cache     WriterCacheConfig
 		Internal  WriterInternalConfig
 		Uri       string `envconfig:"API_WRITER_URI" default:"resolver:50051" required:"true"`
 	}
 }
 
+type WriterBreakerConfig struct {
+	// Failures is the count of the consecutive unavailability failures of the same user to stop writing for the user,
+	// disabled when zero.
+	Failures uint32 `envconfig:"API_WRITER_BREAKER_FAILURES" default:"3" required:"true"`
+	// FailuresGlobal is the count of the consecutive unavailability failures of any user to stop writing at all,
+	// disabled when zero.
+	FailuresGlobal uint32 `envconfig:"API_WRITER_BREAKER_FAILURES_GLOBAL" default:"10" required:"true"`
+	// Timeout is the time to stop writing for, the single probe write is allowed after.
+	Timeout time.Duration `envconfig:"API_WRITER_BREAKER_TIMEOUT" default:"30s" required:"true"`
+	// Size is the max count of the failing users tracked.
+	Size uint32 `envconfig:"API_WRITER_BREAKER_SIZE" default:"1000" required:"true"`
+}
+
 type WriterCacheConfig struct {
 	Size uint32        `envconfig:"API_WRITER_CACHE_SIZE" default:"100" required:"true"`
 	Ttl  time.Duration `envconfig:"API_WRITER_CACHE_TTL" default:"24h" required:"true"`
@@ -63,6 +108,108 @@ type ReaderConfig struct {
 	UriEventBase string `envconfig:"API_READER_URI_EVT_BASE" default:"https://awakari.com/pub-msg.html?id=" required:"true"`
 }
 
+type SpoolConfig struct {
+	Dir         string `envconfig:"API_SPOOL_DIR" default:"/var/spool/int-email" required:"true"`
+	AttemptsMax uint32 `envconfig:"API_SPOOL_ATTEMPTS_MAX" default:"100" required:"true"`
+	// Concurrency is the max count of the entries of the same group and user written at once in the order, so the
+	// writer can batch them. The entries are written one by one when it is not more than 1.
+	Concurrency uint32 `envconfig:"API_SPOOL_CONCURRENCY" default:"16" required:"true"`
+	Retry       struct {
+		Delay    time.Duration `envconfig:"API_SPOOL_RETRY_DELAY" default:"1s" required:"true"`
+		DelayMax time.Duration `envconfig:"API_SPOOL_RETRY_DELAY_MAX" default:"10m" required:"true"`
+	}
+}
+
+type ExtractorConfig struct {
+	Rules struct {
+		// Path is the declarative extraction rules file, no rules when empty.
+		Path           string        `envconfig:"API_EXTRACTOR_RULES_PATH" default:""`
+		ReloadInterval time.Duration `envconfig:"API_EXTRACTOR_RULES_RELOAD_INTERVAL" default:"10s" required:"true"`
+	}
+}
+
+type UnwrapConfig struct {
+	// Follow is to request the opaque tracking links and take the redirect location.
+	Follow struct {
+		Enabled bool          `envconfig:"API_UNWRAP_FOLLOW_ENABLED" default:"false"`
+		Timeout time.Duration `envconfig:"API_UNWRAP_FOLLOW_TIMEOUT" default:"5s" required:"true"`
+		HopsMax uint32        `envconfig:"API_UNWRAP_FOLLOW_HOPS_MAX" default:"3" required:"true"`
+		// Deadline is the overall time to follow the links of the single message.
+		Deadline    time.Duration `envconfig:"API_UNWRAP_FOLLOW_DEADLINE" default:"10s" required:"true"`
+		Concurrency uint32        `envconfig:"API_UNWRAP_FOLLOW_CONCURRENCY" default:"8" required:"true"`
+		Cache       struct {
+			Size uint32        `envconfig:"API_UNWRAP_FOLLOW_CACHE_SIZE" default:"10000" required:"true"`
+			Ttl  time.Duration `envconfig:"API_UNWRAP_FOLLOW_CACHE_TTL" default:"24h" required:"true"`
+		}
+	}
+}
+
+type DedupConfig struct {
+	// Size is the max count of the message keys kept by the in-memory store.
+	Size uint32        `envconfig:"API_DEDUP_SIZE" default:"100000" required:"true"`
+	Ttl  time.Duration `envconfig:"API_DEDUP_TTL" default:"24h" required:"true"`
+}
+
+type RateLimitConfig struct {
+	// PublishPerMinute is the rate of the publishing messages per sender, disabled when not positive.
+	// The rate of the internal messages is API_WRITER_INTERNAL_RATE_LIMIT_PER_MINUTE.
+	PublishPerMinute int `envconfig:"API_RATE_LIMIT_PUBLISH_PER_MINUTE" default:"10" required:"true"`
+	// Size is the max count of the senders tracked per policy.
+	Size uint32 `envconfig:"API_RATE_LIMIT_SIZE" default:"10000" required:"true"`
+}
+
+type NearDupConfig struct {
+	Window struct {
+		// Size is the count of the recent events to compare with, disabled when zero.
+		Size uint32        `envconfig:"API_NEARDUP_WINDOW_SIZE" default:"1000"`
+		Ttl  time.Duration `envconfig:"API_NEARDUP_WINDOW_TTL" default:"72h" required:"true"`
+	}
+	// SimilarityMin is the share of the fingerprint bits matching to consider the events similar.
+	SimilarityMin float64 `envconfig:"API_NEARDUP_SIMILARITY_MIN" default:"0.9" required:"true"`
+	// Action is what to do with the near-duplicate: "mark" it with the original event id or "drop" it.
+	Action string `envconfig:"API_NEARDUP_ACTION" default:"mark" required:"true"`
+}
+
+type TimeConfig struct {
+	// FutureMax is how much the message time may be ahead of the receiving time, unlimited when zero.
+	FutureMax time.Duration `envconfig:"API_TIME_FUTURE_MAX" default:"1h"`
+	// PastMax is how old the message time may be, unlimited when zero.
+	PastMax time.Duration `envconfig:"API_TIME_PAST_MAX" default:"8760h"`
+}
+
+type TracingConfig struct {
+	// Endpoint is the OTLP gRPC collector address, the tracing is disabled when empty.
+	Endpoint    string  `envconfig:"API_TRACING_ENDPOINT" default:""`
+	SampleRatio float64 `envconfig:"API_TRACING_SAMPLE_RATIO" default:"1" required:"true"`
+}
+
+type ArcConfig struct {
+	SealersTrusted []string `envconfig:"API_ARC_SEALERS_TRUSTED" default:""`
+}
+
+type SpfConfig struct {
+	Action struct {
+		None      string `envconfig:"API_SPF_ACTION_NONE" default:"tag" required:"true"`
+		Neutral   string `envconfig:"API_SPF_ACTION_NEUTRAL" default:"tag" required:"true"`
+		Pass      string `envconfig:"API_SPF_ACTION_PASS" default:"tag" required:"true"`
+		Fail      string `envconfig:"API_SPF_ACTION_FAIL" default:"tag" required:"true"`
+		SoftFail  string `envconfig:"API_SPF_ACTION_SOFTFAIL" default:"tag" required:"true"`
+		TempError string `envconfig:"API_SPF_ACTION_TEMPERROR" default:"tag" required:"true"`
+		PermError string `envconfig:"API_SPF_ACTION_PERMERROR" default:"tag" required:"true"`
+	}
+}
+
+type DkimConfig struct {
+	RejectUnsigned   bool `envconfig:"API_DKIM_REJECT_UNSIGNED" default:"false"`
+	RejectInvalid    bool `envconfig:"API_DKIM_REJECT_INVALID" default:"false"`
+	VerificationsMax int  `envconfig:"API_DKIM_VERIFICATIONS_MAX" default:"5" required:"true"`
+}
+
+type DmarcConfig struct {
+	Enforce         bool   `envconfig:"API_DMARC_ENFORCE" default:"true"`
+	QuarantineGroup string `envconfig:"API_DMARC_QUARANTINE_GROUP" default:"quarantine"`
+}
+
 type EventTypeConfig struct {
 	Self string `envconfig:"API_EVENT_TYPE_SELF" required:"true" default:"com_awakari_email_v1"`
 }
@@ -1,18 +1,51 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"github.com/awakari/client-sdk-go/api"
+	apiHttp "github.com/awakari/int-email/api/http"
+	"github.com/awakari/int-email/api/replay"
 	apiSmtp "github.com/awakari/int-email/api/smtp"
 	"github.com/awakari/int-email/config"
 	"github.com/awakari/int-email/service"
+	"github.com/awakari/int-email/service/arc"
+	"github.com/awakari/int-email/service/cleaner"
 	"github.com/awakari/int-email/service/converter"
+	"github.com/awakari/int-email/service/deadletter"
+	"github.com/awakari/int-email/service/dedup"
+	"github.com/awakari/int-email/service/dkim"
+	"github.com/awakari/int-email/service/dmarc"
+	"github.com/awakari/int-email/service/extractor"
+	"github.com/awakari/int-email/service/health"
+	"github.com/awakari/int-email/service/neardup"
+	"github.com/awakari/int-email/service/ratelimit"
+	"github.com/awakari/int-email/service/redact"
+	"github.com/awakari/int-email/service/spf"
+	"github.com/awakari/int-email/service/spool"
+	"github.com/awakari/int-email/service/unwrap"
 	"github.com/awakari/int-email/service/writer"
 	"github.com/awakari/int-email/util"
 	"github.com/emersion/go-smtp"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 	"log/slog"
+	"net"
+	"net/http"
 	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
 )
 
 func main() {
@@ -27,9 +60,31 @@ func main() {
 	opts := slog.HandlerOptions{
 		Level: slog.Level(cfg.Log.Level),
 	}
-	log := slog.New(slog.NewTextHandler(os.Stdout, &opts))
+	log := slog.New(util.NewLogHandler(os.Stdout, cfg.Log.Format, &opts))
 	log.Info("starting the update for the feeds")
 
+	// tracing
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	var tp *sdktrace.TracerProvider
+	if cfg.Api.Tracing.Endpoint != "" {
+		var exp *otlptrace.Exporter
+		exp, err = otlptracegrpc.New(
+			context.Background(),
+			otlptracegrpc.WithEndpoint(cfg.Api.Tracing.Endpoint),
+			otlptracegrpc.WithInsecure(),
+		)
+		if err != nil {
+			panic(fmt.Sprintf("failed to initialize the trace exporter: %s", err))
+		}
+		tp = sdktrace.NewTracerProvider(
+			sdktrace.WithBatcher(exp),
+			sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", "int-email"))),
+			sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.Api.Tracing.SampleRatio))),
+		)
+		otel.SetTracerProvider(tp)
+		log.Info("exporting the traces", "endpoint", cfg.Api.Tracing.Endpoint)
+	}
+
 	// awakari API client
 	var clientAwk api.Client
 	clientAwk, err = api.
@@ -42,29 +97,120 @@ func main() {
 	defer clientAwk.Close()
 	log.Info("initialized the Awakari API client")
 
-	svcWriter := writer.NewService(clientAwk, cfg.Api.Writer.Backoff, cfg.Api.Writer.Cache, log)
+	brk := writer.NewBreaker(cfg.Api.Writer.Breaker)
+	svcWriter := writer.NewService(clientAwk, cfg.Api.Writer.Backoff, cfg.Api.Writer.BatchSize, cfg.Api.Writer.Cache, brk, log)
 	svcWriter = writer.NewLogging(svcWriter, log)
+	svcWriter = writer.NewMetrics(svcWriter)
+	svcWriter = writer.NewTracing(svcWriter)
+	defer svcWriter.Close() // close the cached writers before the client
 
 	rcptsPublish := map[string]bool{}
 	for _, name := range cfg.Api.Smtp.Recipients.Publish {
 		rcptsPublish[name] = true
 	}
-	svcConv := converter.NewConverter(cfg.Api.EventType.Self, util.HtmlPolicy(), cfg.Api.Writer.Internal, rcptsPublish, cfg.Api.Smtp.Data.TruncUrlQueries)
+	rcptsDomains := cfg.Api.Smtp.Recipients.Domains
+	if len(rcptsDomains) == 0 {
+		rcptsDomains = []string{cfg.Api.Smtp.Host}
+	}
+	redactor := redact.NewRedactor(cfg.Api.Smtp.Recipients.Publish, rcptsDomains)
+	svcDkim := dkim.NewService(dkim.NewKeyLookup(net.DefaultResolver), cfg.Api.Dkim.VerificationsMax)
+	svcDkim = dkim.NewLogging(svcDkim, log)
+	svcArc := arc.NewService(dkim.NewKeyLookup(net.DefaultResolver), cfg.Api.Arc.SealersTrusted)
+	svcArc = arc.NewLogging(svcArc, log)
+	extractors := extractor.NewRegistry(extractor.Builtin()...)
+	ctxRules, stopRules := context.WithCancel(context.Background())
+	defer stopRules()
+	if cfg.Api.Extractor.Rules.Path != "" {
+		rules := extractor.NewRuleSet(cfg.Api.Extractor.Rules.Path, []string{cfg.Api.Writer.Internal.Name}, log)
+		err = rules.Load()
+		if err != nil {
+			panic(fmt.Sprintf("failed to load the extraction rules: %s", err))
+		}
+		extractors.Register(rules)
+		go rules.Watch(ctxRules, cfg.Api.Extractor.Rules.ReloadInterval)
+	}
+	var clientUnwrap unwrap.HttpClient
+	if cfg.Api.Unwrap.Follow.Enabled {
+		clientUnwrap = unwrap.NewHttpClient()
+	}
+	svcUnwrap := unwrap.NewService(clientUnwrap, cfg.Api.Unwrap)
+	svcUnwrap = unwrap.NewLogging(svcUnwrap, log)
+	svcCleaner := cleaner.NewService()
+	svcCleaner = cleaner.NewLogging(svcCleaner, log)
+	svcConv := converter.NewConverter(cfg.Api.EventType.Self, util.HtmlPolicy(), cfg.Api.Writer.Internal, redactor, cfg.Api.Smtp.Data.TruncUrlQueries, cfg.Api.Time, svcDkim, cfg.Api.Dkim, svcArc, extractors, svcUnwrap, svcCleaner, log)
 	svcConv = converter.NewLogging(svcConv, log)
-	svc := service.NewService(svcConv, svcWriter, cfg.Api.Group)
+	svcConv = converter.NewMetrics(svcConv)
+	svcConv = converter.NewTracing(svcConv)
+	svcDmarc := dmarc.NewService(net.DefaultResolver)
+	svcDmarc = dmarc.NewLogging(svcDmarc, log)
+	svcDeadLetter, err := deadletter.NewService(cfg.Api.DeadLetter.Dir)
+	if err != nil {
+		panic(fmt.Sprintf("failed to initialize the dead letters: %s", err))
+	}
+	svcDeadLetter = deadletter.NewLogging(svcDeadLetter, log)
+	svcSpool, err := spool.NewService(cfg.Api.Spool, svcWriter, svcDeadLetter, log)
+	if err != nil {
+		panic(fmt.Sprintf("failed to initialize the spool: %s", err))
+	}
+	svcSpool = spool.NewLogging(svcSpool, log)
+	svc := service.NewService(svcConv, svcSpool, svcDeadLetter, cfg.Api.Group, svcDmarc, cfg.Api.Dmarc, neardup.NewWindow(cfg.Api.NearDup), cfg.Api.NearDup, brk)
+	svc = service.NewDedup(svc, dedup.NewMemStore(cfg.Api.Dedup.Size, cfg.Api.Dedup.Ttl), log)
 	svc = service.NewLogging(svc, log)
 
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		// the replayed messages are spooled and written by the running server
+		err = replay.Run(context.Background(), os.Args[2:], svc, svcDeadLetter, os.Stdout)
+		if tp != nil {
+			_ = tp.Shutdown(context.Background())
+		}
+		if err != nil {
+			log.Error("replay failed", "err", err)
+			os.Exit(1)
+		}
+		return
+	}
+	// the senders are limited, the replayed messages are not
+	svc = service.NewRateLimit(
+		svc,
+		svcDkim,
+		ratelimit.NewLimiter(ratelimit.PolicyInternal, cfg.Api.Writer.Internal.RateLimitPerMinute, cfg.Api.RateLimit.Size),
+		ratelimit.NewLimiter(ratelimit.PolicyPublish, cfg.Api.RateLimit.PublishPerMinute, cfg.Api.RateLimit.Size),
+		log,
+	)
+
+	ctxSpool, stopSpool := context.WithCancel(context.Background())
+	spoolDone := make(chan struct{})
+	go func() {
+		defer close(spoolDone)
+		svcSpool.Run(ctxSpool)
+	}()
+
 	rcptsInternal := map[string]bool{}
 	for _, name := range cfg.Api.Smtp.Recipients.Internal {
 		rcptsInternal[name] = true
 	}
-	b := apiSmtp.NewBackend(rcptsPublish, rcptsInternal, int64(cfg.Api.Smtp.Data.Limit), svc)
+	svcSpf := spf.NewService(net.DefaultResolver)
+	svcSpf = spf.NewLogging(svcSpf, log)
+
+	dataLimits := apiSmtp.DataLimits{
+		Publish:  int64(cfg.Api.Smtp.Data.Limit),
+		Internal: int64(cfg.Api.Smtp.Data.LimitInternal),
+	}
+	if dataLimits.Internal == 0 {
+		dataLimits.Internal = dataLimits.Publish
+	}
+	spfPolicy, err := spf.NewPolicy(cfg.Api.Spf)
+	if err != nil {
+		panic(fmt.Sprintf("failed to load the SPF policy: %s", err))
+	}
+	b := apiSmtp.NewBackend(rcptsPublish, rcptsInternal, dataLimits, svc, svcSpf, spfPolicy, brk)
 	b = apiSmtp.NewBackendLogging(b, log)
+	b = apiSmtp.NewBackendMetrics(b)
 
 	srv := smtp.NewServer(b)
 	srv.Addr = fmt.Sprintf(":%d", cfg.Api.Smtp.Port)
 	srv.Domain = cfg.Api.Smtp.Host
-	srv.MaxMessageBytes = int64(cfg.Api.Smtp.Data.Limit)
+	srv.MaxMessageBytes = dataLimits.Max()
 	srv.MaxRecipients = int(cfg.Api.Smtp.Recipients.Limit)
 	srv.ReadTimeout = cfg.Api.Smtp.Timeout.Read
 	srv.WriteTimeout = cfg.Api.Smtp.Timeout.Write
@@ -84,8 +230,109 @@ func main() {
 		MinVersion: cfg.Api.Smtp.Tls.VersionMin,
 	}
 
-	log.Info("starting to listen for emails...")
-	if err = srv.ListenAndServe(); err != nil {
+	ctxSig, stopSig := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stopSig()
+	var smtpListening atomic.Bool
+	svcHealth := health.NewService(
+		map[string]health.Check{
+			"smtp": func(ctx context.Context) (err error) {
+				if !smtpListening.Load() {
+					err = errors.New("not listening")
+				}
+				return
+			},
+		},
+		map[string]health.Check{
+			"shutdown": func(ctx context.Context) (err error) {
+				if ctxSig.Err() != nil {
+					err = errors.New("shutting down")
+				}
+				return
+			},
+			"tls": func(ctx context.Context) (err error) {
+				if cert.Leaf != nil && time.Now().After(cert.Leaf.NotAfter) {
+					err = fmt.Errorf("certificate expired at %s", cert.Leaf.NotAfter)
+				}
+				return
+			},
+			"writer": health.Cached(
+				writer.NewReachabilityCheck(clientAwk, cfg.Api.Group, cfg.Api.Health.Writer.User),
+				cfg.Api.Health.Writer.Ttl,
+			),
+		},
+		svcSpool.Depth,
+		prometheus.DefaultGatherer,
+		map[string]health.Counter{
+			"smtp": {
+				Name:    "int_email_smtp_data_total",
+				Success: []string{"accepted"},
+			},
+			"converter": {
+				Name:    "int_email_converter_convert_total",
+				Success: []string{"ok"},
+			},
+			"writer": {
+				Name:    "int_email_writer_write_total",
+				Success: []string{"ok"},
+			},
+		},
+	)
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.Handle("/", apiHttp.NewHandler(svcHealth))
+	srvHttp := &http.Server{
+		Addr:              fmt.Sprintf(":%d", cfg.Api.Http.Port),
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		log.Info("starting to serve http...", "addr", srvHttp.Addr)
+		if errHttp := srvHttp.ListenAndServe(); !errors.Is(errHttp, http.ErrServerClosed) {
+			panic(errHttp)
+		}
+	}()
+
+	var l net.Listener
+	l, err = net.Listen("tcp", srv.Addr)
+	if err != nil {
 		panic(err)
 	}
+	smtpListening.Store(true)
+	srvErr := make(chan error, 1)
+	go func() {
+		log.Info("starting to listen for emails...")
+		srvErr <- srv.Serve(l)
+		smtpListening.Store(false)
+	}()
+	select {
+	case err = <-srvErr:
+		panic(err)
+	case <-ctxSig.Done():
+	}
+
+	// graceful shutdown
+	log.Info("shutting down", "timeout", cfg.Api.Shutdown.Timeout)
+	ctxShutdown, cancel := context.WithTimeout(context.Background(), cfg.Api.Shutdown.Timeout)
+	defer cancel()
+	// stop accepting the connections and let the sessions in progress finish
+	err = srv.Shutdown(ctxShutdown)
+	if err != nil {
+		log.Warn("failed to finish the SMTP sessions gracefully, closing", "err", err)
+		_ = srv.Close()
+	}
+	// the spool entries not written in time remain on the disk until the next start
+	stopSpool()
+	select {
+	case <-spoolDone:
+		svcSpool.Flush(ctxShutdown)
+	case <-ctxShutdown.Done():
+		log.Warn("spool write in progress is not finished in time")
+	}
+	_ = srvHttp.Shutdown(ctxShutdown)
+	if tp != nil {
+		// export the spans ended during the shutdown
+		_ = tp.Shutdown(ctxShutdown)
+	}
+	log.Info("shutdown complete")
 }
@@ -0,0 +1,34 @@
+package model
+
+// The event attributes of the sender authentication results and of the tracing. These are set by the service only, so
+// the consumers can trust them.
+const (
+	AttrKeySpf           = "spf"
+	AttrKeyDkim          = "dkim"
+	AttrKeyDkimDomains   = "dkimdomains"
+	AttrKeyDkimSelectors = "dkimselectors"
+	AttrKeyDkimResults   = "dkimresults"
+	AttrKeyArc           = "arc"
+	AttrKeyArcSealer     = "arcsealer"
+	AttrKeyArcTrusted    = "arctrusted"
+	AttrKeyDmarc         = "dmarc"
+	AttrKeyDmarcPolicy   = "dmarcpolicy"
+	AttrKeyDmarcOverride = "dmarcoverride"
+	AttrKeyCorrelationId = "correlationid"
+)
+
+// AttrKeysReserved are the authentication and the tracing attributes, not to be set from the message content.
+var AttrKeysReserved = []string{
+	AttrKeySpf,
+	AttrKeyDkim,
+	AttrKeyDkimDomains,
+	AttrKeyDkimSelectors,
+	AttrKeyDkimResults,
+	AttrKeyArc,
+	AttrKeyArcSealer,
+	AttrKeyArcTrusted,
+	AttrKeyDmarc,
+	AttrKeyDmarcPolicy,
+	AttrKeyDmarcOverride,
+	AttrKeyCorrelationId,
+}
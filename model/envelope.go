@@ -0,0 +1,15 @@
+package model
+
+// Envelope describes the SMTP transaction the message has been received within.
+type Envelope struct {
+	From     string
+	Internal bool
+	Helo     string
+	RemoteIp string
+	// SpfResult is the SPF check result of the sender, empty when not checked.
+	SpfResult string
+	// SpfTag is true when the message should be tagged with the SPF check result.
+	SpfTag bool
+	// CorrelationId identifies the SMTP session in the logs, the event and the replies.
+	CorrelationId string
+}
@@ -0,0 +1,38 @@
+package model
+
+import "errors"
+
+// The error classes shared by the services. The API maps them to the protocol replies, e.g. the SMTP reply codes.
+var (
+	// ErrTemporary is the failure expected to disappear later, e.g. an upstream outage. The sender should retry.
+	ErrTemporary = errors.New("temporary failure")
+	// ErrLimitReached means the sender has exhausted its quota for now. The sender should retry later.
+	ErrLimitReached = errors.New("limit reached")
+	// ErrContent means the message can not be processed, regardless of the attempts count.
+	ErrContent = errors.New("invalid content")
+	// ErrTooLarge means the message exceeds the size limit.
+	ErrTooLarge = errors.New("message too large")
+	// ErrPolicy means the message is rejected by the sender authentication or another policy.
+	ErrPolicy = errors.New("rejected by policy")
+)
+
+type classError struct {
+	text  string
+	class error
+}
+
+// NewError returns the error with the own text which also matches the class, so both are checked using errors.Is.
+func NewError(text string, class error) error {
+	return classError{
+		text:  text,
+		class: class,
+	}
+}
+
+func (e classError) Error() string {
+	return e.text
+}
+
+func (e classError) Unwrap() error {
+	return e.class
+}
@@ -0,0 +1,24 @@
+package arc
+
+import (
+	"context"
+	"log/slog"
+)
+
+type logging struct {
+	svc Service
+	log *slog.Logger
+}
+
+func NewLogging(svc Service, log *slog.Logger) Service {
+	return logging{
+		svc: svc,
+		log: log,
+	}
+}
+
+func (l logging) Validate(ctx context.Context, msg []byte) (r Result) {
+	r = l.svc.Validate(ctx, msg)
+	l.log.DebugContext(ctx, "arc.Validate", "len", len(msg), "result", r)
+	return
+}
@@ -0,0 +1,221 @@
+package arc
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// field is a raw header field including the folded continuation lines, without the trailing CRLF.
+type field struct {
+	name string
+	raw  string
+}
+
+const crlf = "\r\n"
+
+var errNoKey = errors.New("no valid key")
+
+// splitMessage returns the header fields in the order of appearance and the body with CRLF line endings.
+func splitMessage(msg []byte) (fields []field, body []byte) {
+	lines := strings.Split(string(msg), "\n")
+	var i int
+	for ; i < len(lines); i++ {
+		line := strings.TrimSuffix(lines[i], "\r")
+		if line == "" {
+			i++
+			break
+		}
+		switch {
+		case (line[0] == ' ' || line[0] == '\t') && len(fields) > 0:
+			fields[len(fields)-1].raw += crlf + line
+		default:
+			name, _, _ := strings.Cut(line, ":")
+			fields = append(fields, field{
+				name: strings.TrimSpace(name),
+				raw:  line,
+			})
+		}
+	}
+	var buf bytes.Buffer
+	for j := i; j < len(lines); j++ {
+		line := strings.TrimSuffix(lines[j], "\r")
+		if j == len(lines)-1 && line == "" {
+			break // the message ends with the line break
+		}
+		buf.WriteString(line)
+		buf.WriteString(crlf)
+	}
+	body = buf.Bytes()
+	return
+}
+
+func (f field) value() (v string) {
+	_, v, _ = strings.Cut(f.raw, ":")
+	return
+}
+
+// canonicalHeaderRelaxed implements https://www.rfc-editor.org/rfc/rfc6376#section-3.4.2
+func canonicalHeaderRelaxed(raw string) (dst string) {
+	name, v, _ := strings.Cut(raw, ":")
+	v = strings.ReplaceAll(v, crlf, "")
+	v = strings.Join(strings.Fields(v), " ")
+	dst = strings.ToLower(strings.TrimSpace(name)) + ":" + v
+	return
+}
+
+func canonicalHeader(raw, alg string) (dst string) {
+	switch alg {
+	case "simple":
+		dst = raw
+	default:
+		dst = canonicalHeaderRelaxed(raw)
+	}
+	return
+}
+
+// canonicalBody implements https://www.rfc-editor.org/rfc/rfc6376#section-3.4.3 and section-3.4.4
+func canonicalBody(body []byte, alg string) (dst []byte) {
+	lines := strings.Split(string(body), crlf)
+	if len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if alg == "relaxed" {
+		for i, line := range lines {
+			lines[i] = strings.Join(strings.FieldsFunc(line, isWsp), " ")
+			if lines[i] != "" && (line[0] == ' ' || line[0] == '\t') {
+				lines[i] = " " + lines[i]
+			}
+		}
+	}
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	switch {
+	case len(lines) > 0:
+		dst = []byte(strings.Join(lines, crlf) + crlf)
+	case alg == "relaxed":
+		dst = []byte{}
+	default:
+		dst = []byte(crlf)
+	}
+	return
+}
+
+func isWsp(r rune) bool {
+	return r == ' ' || r == '\t'
+}
+
+// parseTags parses the tag=value list, see https://www.rfc-editor.org/rfc/rfc6376#section-3.2
+func parseTags(v string) (tags map[string]string, err error) {
+	tags = make(map[string]string)
+	for _, spec := range strings.Split(v, ";") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		k, tagVal, ok := strings.Cut(spec, "=")
+		if !ok {
+			err = fmt.Errorf("malformed tag: %s", spec)
+			return
+		}
+		k = strings.TrimSpace(k)
+		if _, dup := tags[k]; dup {
+			err = fmt.Errorf("duplicate tag: %s", k)
+			return
+		}
+		tags[k] = strings.TrimSpace(tagVal)
+	}
+	return
+}
+
+func parseInstance(tags map[string]string) (i int, err error) {
+	i, err = strconv.Atoi(tags["i"])
+	if err == nil && (i < 1 || i > instancesMax) {
+		err = fmt.Errorf("instance out of range: %d", i)
+	}
+	return
+}
+
+// stripSignature removes the "b=" tag value leaving the rest of the header field intact.
+func stripSignature(raw string) (dst string) {
+	name, v, _ := strings.Cut(raw, ":")
+	specs := strings.Split(v, ";")
+	for i, spec := range specs {
+		k, _, ok := strings.Cut(spec, "=")
+		if ok && strings.TrimSpace(k) == "b" {
+			specs[i] = spec[:strings.Index(spec, "=")+1]
+		}
+	}
+	dst = name + ":" + strings.Join(specs, ";")
+	return
+}
+
+func decodeBase64(v string) (b []byte, err error) {
+	b, err = base64.StdEncoding.DecodeString(strings.Join(strings.Fields(v), ""))
+	return
+}
+
+// parseKey parses the public key record, see https://www.rfc-editor.org/rfc/rfc6376#section-3.6.1
+func parseKey(txts []string) (k crypto.PublicKey, err error) {
+	if len(txts) != 1 {
+		err = fmt.Errorf("%w: %d records", errNoKey, len(txts))
+		return
+	}
+	var tags map[string]string
+	tags, err = parseTags(txts[0])
+	if err == nil && tags["p"] == "" {
+		err = fmt.Errorf("%w: key revoked", errNoKey)
+	}
+	var b []byte
+	if err == nil {
+		b, err = decodeBase64(tags["p"])
+	}
+	if err == nil {
+		switch tags["k"] {
+		case "rsa", "":
+			k, err = x509.ParsePKIXPublicKey(b)
+			if err != nil {
+				k, err = x509.ParsePKCS1PublicKey(b)
+			}
+		case "ed25519":
+			if len(b) == ed25519.PublicKeySize {
+				k = ed25519.PublicKey(b)
+			} else {
+				err = fmt.Errorf("%w: invalid ed25519 key size %d", errNoKey, len(b))
+			}
+		default:
+			err = fmt.Errorf("%w: unsupported key type %s", errNoKey, tags["k"])
+		}
+	}
+	return
+}
+
+func verifySignature(k crypto.PublicKey, alg string, data, sig []byte) (err error) {
+	hashed := sha256.Sum256(data)
+	switch pub := k.(type) {
+	case *rsa.PublicKey:
+		if alg != "rsa-sha256" {
+			err = fmt.Errorf("algorithm %s doesn't match the RSA key", alg)
+		} else {
+			err = rsa.VerifyPKCS1v15(pub, crypto.SHA256, hashed[:], sig)
+		}
+	case ed25519.PublicKey:
+		if alg != "ed25519-sha256" {
+			err = fmt.Errorf("algorithm %s doesn't match the ed25519 key", alg)
+		} else if !ed25519.Verify(pub, hashed[:], sig) {
+			err = errors.New("ed25519 signature mismatch")
+		}
+	default:
+		err = fmt.Errorf("unsupported key %T", k)
+	}
+	return
+}
@@ -0,0 +1,24 @@
+package arc
+
+import (
+	"bytes"
+	"context"
+)
+
+type mock struct {
+}
+
+func NewMock() Service {
+	return mock{}
+}
+
+func (m mock) Validate(ctx context.Context, msg []byte) (r Result) {
+	r.Status = StatusNone
+	if bytes.HasPrefix(msg, []byte(headerSeal+":")) {
+		r.Status = StatusPass
+		r.Instances = 1
+		r.Sealer = "lists.example.org"
+		r.Trusted = true
+	}
+	return
+}
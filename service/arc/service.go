@@ -0,0 +1,269 @@
+package arc
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"github.com/awakari/int-email/service/dkim"
+	"strconv"
+	"strings"
+)
+
+// Status is the ARC chain validation status, see https://www.rfc-editor.org/rfc/rfc8617#section-4.4
+type Status string
+
+const (
+	StatusNone Status = "none"
+	StatusPass Status = "pass"
+	StatusFail Status = "fail"
+)
+
+type Result struct {
+	Status Status
+	// Instances is the count of the ARC sets found in the message.
+	Instances int
+	// Sealer is the signing domain of the latest ARC-Seal.
+	Sealer string
+	// Trusted is true when the chain passed and the latest sealer is trusted.
+	Trusted bool
+	// Reason describes why the chain failed.
+	Reason string
+}
+
+type Service interface {
+	// Validate checks the ARC chain of the raw message, see https://www.rfc-editor.org/rfc/rfc8617#section-5.2
+	Validate(ctx context.Context, msg []byte) (r Result)
+}
+
+type service struct {
+	keys           dkim.KeyLookup
+	sealersTrusted map[string]bool
+}
+
+type arcField struct {
+	field
+	tags map[string]string
+}
+
+type arcSet struct {
+	authResults *arcField
+	msgSig      *arcField
+	seal        *arcField
+}
+
+const headerAuthResults = "ARC-Authentication-Results"
+const headerMsgSig = "ARC-Message-Signature"
+const headerSeal = "ARC-Seal"
+
+// instancesMax is the maximum allowed ARC set instance, see https://www.rfc-editor.org/rfc/rfc8617#section-4.2.1
+const instancesMax = 50
+
+func NewService(keys dkim.KeyLookup, sealersTrusted []string) Service {
+	svc := service{
+		keys:           keys,
+		sealersTrusted: make(map[string]bool),
+	}
+	for _, d := range sealersTrusted {
+		svc.sealersTrusted[strings.ToLower(d)] = true
+	}
+	return svc
+}
+
+func (svc service) Validate(ctx context.Context, msg []byte) (r Result) {
+	r.Status = StatusNone
+	fields, body := splitMessage(msg)
+	sets, err := collectSets(fields)
+	if err == nil && len(sets) > 0 {
+		r.Instances = len(sets)
+		r.Sealer = strings.ToLower(sets[len(sets)-1].seal.tags["d"])
+		err = svc.validate(ctx, fields, body, sets)
+	}
+	switch {
+	case err != nil:
+		r.Status = StatusFail
+		r.Reason = err.Error()
+	case len(sets) > 0:
+		r.Status = StatusPass
+		r.Trusted = svc.sealersTrusted[r.Sealer]
+	}
+	return
+}
+
+// collectSets groups the ARC header fields by instance and checks the chain structure.
+func collectSets(fields []field) (sets []arcSet, err error) {
+	setByInstance := make(map[int]*arcSet)
+	for _, f := range fields {
+		var dst func(s *arcSet) **arcField
+		switch {
+		case strings.EqualFold(f.name, headerAuthResults):
+			dst = func(s *arcSet) **arcField { return &s.authResults }
+		case strings.EqualFold(f.name, headerMsgSig):
+			dst = func(s *arcSet) **arcField { return &s.msgSig }
+		case strings.EqualFold(f.name, headerSeal):
+			dst = func(s *arcSet) **arcField { return &s.seal }
+		default:
+			continue
+		}
+		var af *arcField
+		af, err = parseArcField(f)
+		var i int
+		if err == nil {
+			i, err = parseInstance(af.tags)
+		}
+		if err != nil {
+			err = fmt.Errorf("%s: %w", f.name, err)
+			return
+		}
+		s, found := setByInstance[i]
+		if !found {
+			s = &arcSet{}
+			setByInstance[i] = s
+		}
+		if *dst(s) != nil {
+			err = fmt.Errorf("duplicate %s instance %d", f.name, i)
+			return
+		}
+		*dst(s) = af
+	}
+	for i := 1; i <= len(setByInstance); i++ {
+		s, found := setByInstance[i]
+		switch {
+		case !found:
+			err = fmt.Errorf("missing ARC set instance %d", i)
+		case s.authResults == nil, s.msgSig == nil, s.seal == nil:
+			err = fmt.Errorf("incomplete ARC set instance %d", i)
+		}
+		if err != nil {
+			return
+		}
+		sets = append(sets, *s)
+	}
+	return
+}
+
+func parseArcField(f field) (af *arcField, err error) {
+	af = &arcField{
+		field: f,
+	}
+	switch {
+	case strings.EqualFold(f.name, headerAuthResults):
+		// only the instance tag is structured, the rest is the Authentication-Results payload
+		instance, _, _ := strings.Cut(f.value(), ";")
+		af.tags, err = parseTags(instance)
+	default:
+		af.tags, err = parseTags(f.value())
+	}
+	return
+}
+
+func (svc service) validate(ctx context.Context, fields []field, body []byte, sets []arcSet) (err error) {
+	if sets[len(sets)-1].seal.tags["cv"] == string(StatusFail) {
+		err = errors.New("chain is marked as failed")
+	}
+	for i := 0; err == nil && i < len(sets); i++ {
+		cv := sets[i].seal.tags["cv"]
+		switch {
+		case i == 0 && cv != string(StatusNone):
+			err = fmt.Errorf("unexpected cv=%s for instance 1", cv)
+		case i > 0 && cv != string(StatusPass):
+			err = fmt.Errorf("unexpected cv=%s for instance %d", cv, i+1)
+		}
+	}
+	if err == nil {
+		err = svc.verifyMsgSig(ctx, fields, body, sets[len(sets)-1].msgSig)
+	}
+	for i := len(sets); err == nil && i > 0; i-- {
+		err = svc.verifySeal(ctx, sets[:i])
+	}
+	return
+}
+
+// verifyMsgSig verifies the ARC-Message-Signature the same way as the DKIM-Signature,
+// see https://www.rfc-editor.org/rfc/rfc8617#section-4.1.2
+func (svc service) verifyMsgSig(ctx context.Context, fields []field, body []byte, sig *arcField) (err error) {
+	for _, tag := range []string{"a", "b", "bh", "d", "h", "s"} {
+		if sig.tags[tag] == "" {
+			err = fmt.Errorf("%s: missing required tag %s", headerMsgSig, tag)
+			return
+		}
+	}
+	canonHeader, canonBody, _ := strings.Cut(sig.tags["c"], "/")
+	body = canonicalBody(body, canonBody)
+	if l, lOk := sig.tags["l"]; lOk {
+		var n int
+		n, err = strconv.Atoi(l)
+		if err == nil && n < len(body) {
+			body = body[:n]
+		}
+	}
+	var bh []byte
+	if err == nil {
+		bh, err = decodeBase64(sig.tags["bh"])
+	}
+	if err == nil {
+		bhActual := sha256.Sum256(body)
+		if !bytes.Equal(bh, bhActual[:]) {
+			err = fmt.Errorf("%s: body hash mismatch", headerMsgSig)
+		}
+	}
+	if err == nil {
+		var data strings.Builder
+		used := make(map[int]bool)
+		for _, name := range strings.Split(sig.tags["h"], ":") {
+			name = strings.TrimSpace(name)
+			for i := len(fields) - 1; i >= 0; i-- {
+				if !used[i] && strings.EqualFold(fields[i].name, name) {
+					used[i] = true
+					data.WriteString(canonicalHeader(fields[i].raw, canonHeader))
+					data.WriteString(crlf)
+					break
+				}
+			}
+		}
+		data.WriteString(canonicalHeader(stripSignature(sig.raw), canonHeader))
+		err = svc.verify(ctx, sig, []byte(data.String()))
+	}
+	return
+}
+
+// verifySeal verifies the latest ARC-Seal of the specified sets, see https://www.rfc-editor.org/rfc/rfc8617#section-5.1.1
+func (svc service) verifySeal(ctx context.Context, sets []arcSet) (err error) {
+	var data strings.Builder
+	for i, s := range sets {
+		data.WriteString(canonicalHeaderRelaxed(s.authResults.raw))
+		data.WriteString(crlf)
+		data.WriteString(canonicalHeaderRelaxed(s.msgSig.raw))
+		data.WriteString(crlf)
+		if i < len(sets)-1 {
+			data.WriteString(canonicalHeaderRelaxed(s.seal.raw))
+			data.WriteString(crlf)
+		} else {
+			data.WriteString(canonicalHeaderRelaxed(stripSignature(s.seal.raw)))
+		}
+	}
+	err = svc.verify(ctx, sets[len(sets)-1].seal, []byte(data.String()))
+	return
+}
+
+func (svc service) verify(ctx context.Context, sig *arcField, data []byte) (err error) {
+	var txts []string
+	txts, err = svc.keys.LookupKey(ctx, sig.tags["s"], sig.tags["d"])
+	if err == nil {
+		var b []byte
+		b, err = decodeBase64(sig.tags["b"])
+		if err == nil {
+			var k crypto.PublicKey
+			k, err = parseKey(txts)
+			if err == nil {
+				err = verifySignature(k, sig.tags["a"], data, b)
+			}
+		}
+	}
+	if err != nil {
+		err = fmt.Errorf("%s i=%s d=%s: %w", sig.name, sig.tags["i"], sig.tags["d"], err)
+	}
+	return
+}
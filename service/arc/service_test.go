@@ -0,0 +1,219 @@
+package arc
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"github.com/awakari/int-email/service/dkim"
+	"github.com/awakari/int-email/service/dns"
+	msgauth "github.com/emersion/go-msgauth/dkim"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+const msg = "From: John Doe <john@example.com>\r\n" +
+	"To: group@lists.example.org\r\n" +
+	"Subject:   Weekly   digest\r\n" +
+	"Message-ID: <unique-message-id@example.com>\r\n" +
+	"\r\n" +
+	"Hi all,  \r\n" +
+	"\r\n" +
+	"\tPlease find the digest below.\r\n" +
+	"\r\n" +
+	"\r\n"
+
+// seal adds the new ARC set to the message the same way a forwarder does, see https://www.rfc-editor.org/rfc/rfc8617#section-5.1
+func seal(t *testing.T, src string, cv Status, domain string, key ed25519.PrivateKey) string {
+	fields, body := splitMessage([]byte(src))
+	sets, err := collectSets(fields)
+	require.Nil(t, err)
+	i := len(sets) + 1
+	authResults := fmt.Sprintf("%s: i=%d; mx.%s; dkim=pass header.d=example.com", headerAuthResults, i, domain)
+	bh := sha256.Sum256(canonicalBody(body, "relaxed"))
+	msgSig := fmt.Sprintf(
+		"%s: i=%d; a=ed25519-sha256; c=relaxed/relaxed; d=%s; s=arc;\r\n\th=from:to:subject:message-id; bh=%s; b=",
+		headerMsgSig, i, domain, base64.StdEncoding.EncodeToString(bh[:]),
+	)
+	var data strings.Builder
+	for _, name := range []string{"from", "to", "subject", "message-id"} {
+		for j := len(fields) - 1; j >= 0; j-- {
+			if strings.EqualFold(fields[j].name, name) {
+				data.WriteString(canonicalHeaderRelaxed(fields[j].raw) + crlf)
+				break
+			}
+		}
+	}
+	data.WriteString(canonicalHeaderRelaxed(msgSig))
+	msgSig += sign(key, data.String())
+	data.Reset()
+	for _, s := range sets {
+		data.WriteString(canonicalHeaderRelaxed(s.authResults.raw) + crlf)
+		data.WriteString(canonicalHeaderRelaxed(s.msgSig.raw) + crlf)
+		data.WriteString(canonicalHeaderRelaxed(s.seal.raw) + crlf)
+	}
+	arcSeal := fmt.Sprintf("%s: i=%d; a=ed25519-sha256; cv=%s; d=%s; s=arc; b=", headerSeal, i, cv, domain)
+	data.WriteString(canonicalHeaderRelaxed(authResults) + crlf)
+	data.WriteString(canonicalHeaderRelaxed(msgSig) + crlf)
+	data.WriteString(canonicalHeaderRelaxed(arcSeal))
+	arcSeal += sign(key, data.String())
+	return arcSeal + crlf + msgSig + crlf + authResults + crlf + src
+}
+
+func sign(key ed25519.PrivateKey, data string) string {
+	hashed := sha256.Sum256([]byte(data))
+	return base64.StdEncoding.EncodeToString(ed25519.Sign(key, hashed[:]))
+}
+
+func TestService_Validate(t *testing.T) {
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	require.Nil(t, err)
+	zone := dns.Zone{
+		Txt: map[string][]string{
+			"arc._domainkey.lists.example.org": {
+				"v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(pub),
+			},
+			"arc._domainkey.forwarder.example.net": {
+				"v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(pub),
+			},
+		},
+	}
+	sealed := seal(t, msg, StatusNone, "lists.example.org", key)
+	cases := map[string]struct {
+		msg string
+		out Result
+	}{
+		"none": {
+			msg: msg,
+			out: Result{
+				Status: StatusNone,
+			},
+		},
+		"pass trusted": {
+			msg: sealed,
+			out: Result{
+				Status:    StatusPass,
+				Instances: 1,
+				Sealer:    "lists.example.org",
+				Trusted:   true,
+			},
+		},
+		"pass untrusted": {
+			msg: seal(t, sealed, StatusPass, "forwarder.example.net", key),
+			out: Result{
+				Status:    StatusPass,
+				Instances: 2,
+				Sealer:    "forwarder.example.net",
+			},
+		},
+		"body modified": {
+			msg: strings.Replace(sealed, "digest below", "ad below", 1),
+			out: Result{
+				Status:    StatusFail,
+				Instances: 1,
+				Sealer:    "lists.example.org",
+				Reason:    "ARC-Message-Signature: body hash mismatch",
+			},
+		},
+		"header modified": {
+			msg: strings.Replace(seal(t, sealed, StatusPass, "forwarder.example.net", key), "Weekly", "Daily", 1),
+			out: Result{
+				Status:    StatusFail,
+				Instances: 2,
+				Sealer:    "forwarder.example.net",
+				Reason:    "ARC-Message-Signature i=2 d=forwarder.example.net: ed25519 signature mismatch",
+			},
+		},
+		"previous seal modified": {
+			msg: seal(t, strings.Replace(sealed, "dkim=pass", "dkim=fail", 1), StatusPass, "forwarder.example.net", key),
+			out: Result{
+				Status:    StatusFail,
+				Instances: 2,
+				Sealer:    "forwarder.example.net",
+				Reason:    "ARC-Seal i=1 d=lists.example.org: ed25519 signature mismatch",
+			},
+		},
+		"marked as failed": {
+			msg: seal(t, sealed, StatusFail, "forwarder.example.net", key),
+			out: Result{
+				Status:    StatusFail,
+				Instances: 2,
+				Sealer:    "forwarder.example.net",
+				Reason:    "chain is marked as failed",
+			},
+		},
+		"unexpected cv": {
+			msg: seal(t, sealed, StatusNone, "forwarder.example.net", key),
+			out: Result{
+				Status:    StatusFail,
+				Instances: 2,
+				Sealer:    "forwarder.example.net",
+				Reason:    "unexpected cv=none for instance 2",
+			},
+		},
+		"incomplete set": {
+			msg: "ARC-Authentication-Results: i=2; mx.example.net; spf=pass\r\n" + sealed,
+			out: Result{
+				Status: StatusFail,
+				Reason: "incomplete ARC set instance 2",
+			},
+		},
+		"no key": {
+			msg: seal(t, msg, StatusNone, "unknown.example.org", key),
+			out: Result{
+				Status:    StatusFail,
+				Instances: 1,
+				Sealer:    "unknown.example.org",
+				Reason:    "ARC-Message-Signature i=1 d=unknown.example.org: lookup arc._domainkey.unknown.example.org: no such host",
+			},
+		},
+	}
+	svc := NewService(dkim.NewKeyLookup(zone), []string{"Lists.Example.org"})
+	svc = NewLogging(svc, slog.Default())
+	for k, c := range cases {
+		t.Run(k, func(t *testing.T) {
+			r := svc.Validate(context.TODO(), []byte(c.msg))
+			assert.Equal(t, c.out, r)
+		})
+	}
+}
+
+// TestService_verifyMsgSig checks the canonicalization against the DKIM signatures produced by the reference library.
+func TestService_verifyMsgSig(t *testing.T) {
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	require.Nil(t, err)
+	zone := dns.Zone{
+		Txt: map[string][]string{
+			"sel1._domainkey.example.com": {
+				"v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(pub),
+			},
+		},
+	}
+	svc := service{
+		keys: dkim.NewKeyLookup(zone),
+	}
+	for _, canon := range []msgauth.Canonicalization{msgauth.CanonicalizationSimple, msgauth.CanonicalizationRelaxed} {
+		t.Run(string(canon), func(t *testing.T) {
+			var dst bytes.Buffer
+			err = msgauth.Sign(&dst, strings.NewReader(msg), &msgauth.SignOptions{
+				Domain:                 "example.com",
+				Selector:               "sel1",
+				Signer:                 key,
+				HeaderCanonicalization: canon,
+				BodyCanonicalization:   canon,
+			})
+			require.Nil(t, err)
+			fields, body := splitMessage(dst.Bytes())
+			require.Equal(t, "DKIM-Signature", fields[0].name)
+			sig, err := parseArcField(fields[0])
+			require.Nil(t, err)
+			assert.Nil(t, svc.verifyMsgSig(context.TODO(), fields, body, sig))
+		})
+	}
+}
@@ -0,0 +1,31 @@
+package cleaner
+
+import (
+	"context"
+	"log/slog"
+)
+
+type logging struct {
+	svc Service
+	log *slog.Logger
+}
+
+func NewLogging(svc Service, log *slog.Logger) Service {
+	return logging{
+		svc: svc,
+		log: log,
+	}
+}
+
+func (l logging) Clean(ctx context.Context, src string) (r Result, err error) {
+	r, err = l.svc.Clean(ctx, src)
+	switch err {
+	case nil:
+		if r.Beacons+r.Hidden+r.Footers > 0 {
+			l.log.DebugContext(ctx, "cleaner.Clean", "beacons", r.Beacons, "hidden", r.Hidden, "footers", r.Footers, "preheader", r.Preheader)
+		}
+	default:
+		l.log.ErrorContext(ctx, "cleaner.Clean", "err", err)
+	}
+	return
+}
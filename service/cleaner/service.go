@@ -0,0 +1,198 @@
+package cleaner
+
+import (
+	"context"
+	"github.com/PuerkitoBio/goquery"
+	"golang.org/x/net/html"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Service removes the content not meant to be published from the newsletter HTML.
+type Service interface {
+
+	// Clean removes the tracking beacons, the hidden elements and the footer boilerplate.
+	// The source HTML is returned as is when nothing is removed.
+	Clean(ctx context.Context, src string) (r Result, err error)
+}
+
+// Result is the cleaned HTML with the details of what's removed.
+type Result struct {
+	Html string
+
+	// Preheader is the text of the first hidden element, the preview text shown by the mail clients.
+	Preheader string
+
+	Beacons int
+	Hidden  int
+	Footers int
+}
+
+type service struct {
+}
+
+// footerTextMax is the max text length of the block removed with the footer link, also the max text length following
+// the footer link till the end of the document.
+const footerTextMax = 300
+
+var reStyleHidden = regexp.MustCompile(`(?i)(^|;)(display:none|visibility:hidden|opacity:0(;|$)|max-height:0(px)?(;|$).*overflow:hidden|overflow:hidden.*max-height:0(px)?(;|$))`)
+var reClassHidden = regexp.MustCompile(`(?i)(^|\s)(preheader|preview-?text)(\s|$)`)
+var reBeaconUrl = regexp.MustCompile(`(?i)(list-manage\.com/track/open|/wf/open|/track/open|/open\.(gif|png|php|aspx?)|__ptq\.gif|/e2t/to/|/(pixel|beacon|spacer|blank|o)\.(gif|png)|/(pixel|beacon)(/|\?|$)|[?&](open|pixel|beacon)=)`)
+var reBeaconHost = regexp.MustCompile(`(?i)^(open|opens|pixel|beacon|track|tracking)\.`)
+var reFooterText = regexp.MustCompile(`(?i)(unsubscribe|opt[\s-]?out|(manage|update)\s+(your\s+)?(email\s+|subscription\s+|notification\s+)?(preferences|subscriptions?|settings)|email\s+preferences|view\s+(this\s+|it\s+|the\s+)?(email|message|newsletter|post)?\s*(online|in\s+(your|a|the)\s+(web\s+)?browser))`)
+var reFooterHref = regexp.MustCompile(`(?i)(unsubscribe|opt-?out|preferences|manage-subscription)`)
+var invisibles = strings.NewReplacer("\u034f", "", "\u200b", "", "\u200c", "", "\u200d", "", "\u00ad", "", "\ufeff", "")
+var elementsInline = map[string]bool{
+	"a":      true,
+	"b":      true,
+	"em":     true,
+	"font":   true,
+	"i":      true,
+	"small":  true,
+	"span":   true,
+	"strong": true,
+	"u":      true,
+}
+
+func NewService() Service {
+	return service{}
+}
+
+func (svc service) Clean(ctx context.Context, src string) (r Result, err error) {
+	r.Html = src
+	var doc *goquery.Document
+	doc, err = goquery.NewDocumentFromReader(strings.NewReader(src))
+	if err == nil {
+		doc.Find("img").Each(func(_ int, img *goquery.Selection) {
+			if isBeacon(img) {
+				img.Remove()
+				r.Beacons++
+			}
+		})
+		doc.Find("body [style], body [hidden], body [class]").Each(func(_ int, s *goquery.Selection) {
+			if !attached(s) || !isHidden(s) {
+				return
+			}
+			if r.Preheader == "" {
+				r.Preheader = text(s)
+			}
+			s.Remove()
+			r.Hidden++
+		})
+		doc.Find("a").Each(func(_ int, a *goquery.Selection) {
+			// the same words in the article links are not the boilerplate
+			if attached(a) && isFooterLink(a) && textAfter(a.Get(0), footerTextMax) <= footerTextMax {
+				footerBlock(a).Remove()
+				r.Footers++
+			}
+		})
+		if r.Beacons+r.Hidden+r.Footers > 0 {
+			r.Html, err = doc.Html()
+		}
+	}
+	return
+}
+
+func isBeacon(img *goquery.Selection) (beacon bool) {
+	w, wOk := size(img, "width")
+	h, hOk := size(img, "height")
+	switch {
+	case wOk && hOk && w <= 1 && h <= 1:
+		beacon = true
+	case (wOk && w == 0) || (hOk && h == 0):
+		beacon = true
+	default:
+		src, _ := img.Attr("src")
+		u, err := url.Parse(strings.TrimSpace(src))
+		if err == nil {
+			beacon = reBeaconUrl.MatchString(u.Path+"?"+u.RawQuery) ||
+				reBeaconHost.MatchString(u.Hostname()) ||
+				(strings.HasPrefix(u.Hostname(), "email.") && strings.HasPrefix(u.Path, "/o/"))
+		}
+	}
+	return
+}
+
+// size returns the image dimension from the attribute or the inline style, if set.
+func size(img *goquery.Selection, name string) (px int, ok bool) {
+	v, found := img.Attr(name)
+	if !found {
+		style, _ := img.Attr("style")
+		for _, decl := range strings.Split(style, ";") {
+			k, vDecl, _ := strings.Cut(decl, ":")
+			if strings.EqualFold(strings.TrimSpace(k), name) {
+				v, found = vDecl, true
+			}
+		}
+	}
+	if found {
+		var err error
+		px, err = strconv.Atoi(strings.TrimSuffix(strings.TrimSpace(v), "px"))
+		ok = err == nil
+	}
+	return
+}
+
+func isHidden(s *goquery.Selection) (hidden bool) {
+	if _, found := s.Attr("hidden"); found {
+		return true
+	}
+	style, _ := s.Attr("style")
+	style = strings.Join(strings.Fields(style), "")
+	class, _ := s.Attr("class")
+	hidden = reStyleHidden.MatchString(style) || reClassHidden.MatchString(class)
+	return
+}
+
+func isFooterLink(a *goquery.Selection) bool {
+	href, _ := a.Attr("href")
+	return reFooterText.MatchString(a.Text()) || reFooterHref.MatchString(href)
+}
+
+// footerBlock returns the nearest block containing the footer link, or the link itself when the block is too long to be
+// the boilerplate only or contains other links.
+func footerBlock(a *goquery.Selection) (block *goquery.Selection) {
+	block = a
+	for p := a.Parent(); p.Length() > 0; p = p.Parent() {
+		name := goquery.NodeName(p)
+		if name == "body" || name == "html" || utf8.RuneCountInString(strings.TrimSpace(p.Text())) > footerTextMax {
+			break
+		}
+		if p.Find("a").FilterFunction(func(_ int, other *goquery.Selection) bool {
+			return !isFooterLink(other)
+		}).Length() > 0 {
+			break
+		}
+		block = p
+		if !elementsInline[name] {
+			break
+		}
+	}
+	return
+}
+
+// textAfter returns the text length following the node till the end of the document, counting up to the limit.
+func textAfter(n *html.Node, limit int) (count int) {
+	for ; n != nil && count <= limit; n = n.Parent {
+		for sib := n.NextSibling; sib != nil && count <= limit; sib = sib.NextSibling {
+			count += utf8.RuneCountInString(strings.TrimSpace(goquery.NewDocumentFromNode(sib).Text()))
+		}
+	}
+	return
+}
+
+// attached is false when the element is removed together with any of its parents.
+func attached(s *goquery.Selection) bool {
+	n := s.Get(0)
+	for n.Parent != nil {
+		n = n.Parent
+	}
+	return n.Type == html.DocumentNode
+}
+
+func text(s *goquery.Selection) string {
+	return strings.Join(strings.Fields(invisibles.Replace(s.Text())), " ")
+}
@@ -0,0 +1,159 @@
+package cleaner
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"log/slog"
+	"testing"
+)
+
+func TestService_Clean(t *testing.T) {
+	svc := NewLogging(NewService(), slog.Default())
+	cases := map[string]struct {
+		src       string
+		preheader string
+		beacons   int
+		hidden    int
+		footers   int
+		contains  []string
+		missing   []string
+	}{
+		"nothing to clean": {
+			src: `<p>Hello <a href="https://example.com/post">world</a><img src="https://example.com/cover.png" width="600" height="300"></p>`,
+			contains: []string{
+				`<p>Hello <a href="https://example.com/post">world</a><img src="https://example.com/cover.png" width="600" height="300"></p>`,
+			},
+		},
+		"1x1 pixel": {
+			src:     `<p>Hello</p><img src="https://example.com/i.gif" width="1" height="1" alt="">`,
+			beacons: 1,
+			contains: []string{
+				"<p>Hello</p>",
+			},
+			missing: []string{
+				"i.gif",
+			},
+		},
+		"zero size in style": {
+			src:     `<p>Hello</p><img src="https://example.com/i.gif" style="width: 0px; border: 0">`,
+			beacons: 1,
+			missing: []string{
+				"i.gif",
+			},
+		},
+		"tracker hosts and paths": {
+			src: `<p>Hello</p>` +
+				`<img src="https://example.us1.list-manage.com/track/open.php?u=1&id=2">` +
+				`<img src="https://u123.ct.sendgrid.net/wf/open?upn=abc">` +
+				`<img src="https://email.mg.example.com/o/eyJwIjoiMSJ9">` +
+				`<img src="https://open.convertkit-mail2.com/abc123">` +
+				`<img src="https://track.hubspot.com/__ptq.gif?a=1">` +
+				`<img src="https://example.com/newsletter?open=1">` +
+				`<img src="https://cdn.example.com/logo.png">`,
+			beacons: 6,
+			contains: []string{
+				"logo.png",
+			},
+			missing: []string{
+				"list-manage",
+				"sendgrid",
+				"email.mg",
+				"convertkit",
+				"hubspot",
+				"open=1",
+			},
+		},
+		"hidden preheader": {
+			src: `<div style="display: none; max-height: 0px; overflow: hidden;">The week in review &zwnj;&nbsp;&#847;&zwnj;&nbsp;&#847;</div>` +
+				`<span class="preheader">Second hidden</span>` +
+				`<p>Hello</p>`,
+			preheader: "The week in review",
+			hidden:    2,
+			contains: []string{
+				"<p>Hello</p>",
+			},
+			missing: []string{
+				"week in review",
+				"Second hidden",
+			},
+		},
+		"collapsed preheader": {
+			src:       `<span style="color:#fff;max-height:0;font-size:1px;overflow:hidden;mso-hide:all">Preview text</span><p>Hello</p>`,
+			preheader: "Preview text",
+			hidden:    1,
+		},
+		"footer": {
+			src: `<p>Hello</p>` +
+				`<table><tr><td>You receive this email because you subscribed to Example. ` +
+				`<a href="https://example.com/u?id=1">Unsubscribe</a> | <span><a href="https://example.com/p">Manage your email preferences</a></span></td></tr></table>` +
+				`<p><a href="https://example.com/online">View this email in your browser</a></p>`,
+			footers: 2,
+			contains: []string{
+				"<p>Hello</p>",
+				"<table><tbody><tr></tr></tbody></table>",
+			},
+			missing: []string{
+				"subscribed",
+				"preferences",
+				"browser",
+			},
+		},
+		"footer link in the long block": {
+			src:     `<p>` + longText + ` <a href="https://example.com/unsubscribe">Leave</a></p>`,
+			footers: 1,
+			contains: []string{
+				longText,
+			},
+			missing: []string{
+				"Leave",
+			},
+		},
+		"footer block with the article link": {
+			src: `<p>Hello</p>` +
+				`<p>Read <a href="https://example.com/post">the post</a> online. <a href="https://example.com/unsubscribe">Unsubscribe</a></p>`,
+			footers: 1,
+			contains: []string{
+				`<a href="https://example.com/post">the post</a>`,
+			},
+			missing: []string{
+				"Unsubscribe",
+			},
+		},
+		"article link about opting out": {
+			src: `<p><a href="https://example.com/blog/how-to-opt-out">How to opt out of the data brokers</a></p>` +
+				`<p>` + longText + `</p>`,
+		},
+		"article link having preferences in the url": {
+			src: `<p>` + longText + ` See <a href="https://example.com/docs/user-preferences">the guide</a>.</p>` +
+				`<p>` + longText + `</p>`,
+		},
+		"view online link before the content": {
+			src: `<p><a href="https://example.com/online">View this email in your browser</a></p>` +
+				`<p>` + longText + `</p>`,
+		},
+	}
+	for k, c := range cases {
+		t.Run(k, func(t *testing.T) {
+			r, err := svc.Clean(context.TODO(), c.src)
+			require.Nil(t, err)
+			assert.Equal(t, c.preheader, r.Preheader)
+			assert.Equal(t, c.beacons, r.Beacons)
+			assert.Equal(t, c.hidden, r.Hidden)
+			assert.Equal(t, c.footers, r.Footers)
+			for _, s := range c.contains {
+				assert.Contains(t, r.Html, s)
+			}
+			for _, s := range c.missing {
+				assert.NotContains(t, r.Html, s)
+			}
+			if c.beacons+c.hidden+c.footers == 0 {
+				assert.Equal(t, c.src, r.Html)
+			}
+		})
+	}
+}
+
+const longText = "The city council has published the agenda of the next meeting. The meeting is open to the public " +
+	"and takes place in the town hall. The residents are welcome to comment on the budget proposal, the new bike lanes " +
+	"and the renovation of the central library. The comments may be also sent by email before the end of the month."
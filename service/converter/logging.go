@@ -2,7 +2,7 @@ package converter
 
 import (
 	"context"
-	"fmt"
+	"github.com/awakari/int-email/model"
 	"github.com/awakari/int-email/util"
 	"github.com/cloudevents/sdk-go/binding/format/protobuf/v2/pb"
 	"io"
@@ -21,8 +21,21 @@ func NewLogging(svc Service, log *slog.Logger) Service {
 	}
 }
 
-func (l logging) Convert(src io.Reader, dst *pb.CloudEvent, from string, internal bool) (err error) {
-	err = l.svc.Convert(src, dst, from, internal)
-	l.log.Log(context.TODO(), util.LogLevel(err), fmt.Sprintf("converter.Convert(source=%s, objectUrl=%s, evtId=%s, from=%s, internal=%t): %s", dst.Source, dst.Attributes[ceKeyObjectUrl], dst.Id, from, internal, err))
+func (l logging) Convert(ctx context.Context, src io.Reader, dst *pb.CloudEvent, env model.Envelope) (auth Auth, err error) {
+	auth, err = l.svc.Convert(ctx, src, dst, env)
+	// the object url is the uri, unless it's the message id
+	objectUrl := dst.Attributes[ceKeyObjectUrl].GetCeUri()
+	if objectUrl == "" {
+		objectUrl = dst.Attributes[ceKeyObjectUrl].GetCeString()
+	}
+	l.log.Log(
+		ctx, util.LogLevel(err), "converter.Convert",
+		"source", dst.Source,
+		"objectUrl", objectUrl,
+		"evtId", dst.Id,
+		"from", env.From,
+		"internal", env.Internal,
+		"err", err,
+	)
 	return
 }
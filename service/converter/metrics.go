@@ -0,0 +1,63 @@
+package converter
+
+import (
+	"context"
+	"errors"
+	"github.com/awakari/int-email/model"
+	"github.com/cloudevents/sdk-go/binding/format/protobuf/v2/pb"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"io"
+	"time"
+)
+
+var convertDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+	Namespace: "int_email",
+	Subsystem: "converter",
+	Name:      "convert_duration_seconds",
+	Help:      "Message conversion duration",
+	Buckets:   prometheus.ExponentialBuckets(0.001, 2, 14), // 1 ms .. 8 s
+})
+
+var converts = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "int_email",
+		Subsystem: "converter",
+		Name:      "convert_total",
+		Help:      "Message conversions by the result",
+	},
+	[]string{
+		"result",
+	},
+)
+
+type metrics struct {
+	svc Service
+}
+
+func NewMetrics(svc Service) Service {
+	return metrics{
+		svc: svc,
+	}
+}
+
+func (m metrics) Convert(ctx context.Context, src io.Reader, dst *pb.CloudEvent, env model.Envelope) (auth Auth, err error) {
+	t := time.Now()
+	auth, err = m.svc.Convert(ctx, src, dst, env)
+	convertDuration.Observe(time.Since(t).Seconds())
+	var result string
+	switch {
+	case err == nil:
+		result = "ok"
+	case errors.Is(err, ErrParse):
+		result = "parse"
+	case errors.Is(err, ErrDkim):
+		result = "dkim"
+	case errors.Is(err, ErrDkimUnavailable):
+		result = "dkim_unavailable"
+	default:
+		result = "error"
+	}
+	converts.WithLabelValues(result).Inc()
+	return
+}
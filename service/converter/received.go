@@ -0,0 +1,62 @@
+package converter
+
+import (
+	"github.com/awakari/int-email/service/received"
+	"github.com/cloudevents/sdk-go/binding/format/protobuf/v2/pb"
+	"math"
+	"time"
+)
+
+const ceKeyHops = "hops"
+const ceKeyOriginHost = "originhost"
+const ceKeyOriginIp = "originip"
+const ceKeyDeliveryLatency = "deliverylatency"
+
+// convertHops sets the Received chain attributes: the count of the hops, the originating host of the trusted chain and
+// the delivery latency in seconds from the message time to the receive time.
+func (c svc) convertHops(hops, trusted []received.Hop, t time.Time, tSrc string, now time.Time, dst *pb.CloudEvent) {
+	if len(hops) > 0 {
+		dst.Attributes[ceKeyHops] = &pb.CloudEventAttributeValue{
+			Attr: &pb.CloudEventAttributeValue_CeInteger{
+				CeInteger: int32(len(hops)),
+			},
+		}
+	}
+	// the lowest trusted hop from the public address
+	for i := len(trusted) - 1; i >= 0; i-- {
+		h := trusted[i]
+		if h.FromIp == nil || !h.FromIp.IsGlobalUnicast() || h.FromIp.IsPrivate() {
+			continue
+		}
+		dst.Attributes[ceKeyOriginIp] = &pb.CloudEventAttributeValue{
+			Attr: &pb.CloudEventAttributeValue_CeString{
+				CeString: h.FromIp.String(),
+			},
+		}
+		host := h.FromHost
+		if host == "" {
+			host = h.From
+		}
+		if host != "" {
+			dst.Attributes[ceKeyOriginHost] = &pb.CloudEventAttributeValue{
+				Attr: &pb.CloudEventAttributeValue_CeString{
+					CeString: host,
+				},
+			}
+		}
+		break
+	}
+	if tSrc != timeSourceNow {
+		latency := now.Sub(t)
+		if latency < 0 {
+			// the clocks skew
+			latency = 0
+		}
+		latency = min(latency, math.MaxInt32*time.Second)
+		dst.Attributes[ceKeyDeliveryLatency] = &pb.CloudEventAttributeValue{
+			Attr: &pb.CloudEventAttributeValue_CeInteger{
+				CeInteger: int32(latency / time.Second),
+			},
+		}
+	}
+}
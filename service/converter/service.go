@@ -1,37 +1,68 @@
 package converter
 
 import (
-	"errors"
+	"bytes"
+	"context"
+	"encoding/hex"
 	"fmt"
-	"github.com/PuerkitoBio/goquery"
 	"github.com/awakari/int-email/config"
+	"github.com/awakari/int-email/model"
+	"github.com/awakari/int-email/service/arc"
+	"github.com/awakari/int-email/service/cleaner"
+	"github.com/awakari/int-email/service/dedup"
+	"github.com/awakari/int-email/service/dkim"
+	"github.com/awakari/int-email/service/extractor"
+	"github.com/awakari/int-email/service/received"
+	"github.com/awakari/int-email/service/redact"
+	"github.com/awakari/int-email/service/unwrap"
 	"github.com/cloudevents/sdk-go/binding/format/protobuf/v2/pb"
 	"github.com/jhillyerd/enmime"
 	"github.com/microcosm-cc/bluemonday"
 	"github.com/segmentio/ksuid"
-	"golang.org/x/net/html"
 	"google.golang.org/protobuf/types/known/timestamppb"
+	"html"
 	"io"
-	"net/url"
+	"log/slog"
+	"net"
 	"regexp"
 	"strings"
 	"time"
 )
 
 type Service interface {
-	Convert(src io.Reader, dst *pb.CloudEvent, from string, internal bool) (err error)
+	// Convert fills the destination event from the source message and returns the sender authentication outcome.
+	Convert(ctx context.Context, src io.Reader, dst *pb.CloudEvent, env model.Envelope) (auth Auth, err error)
+}
+
+// Auth is the sender authentication outcome of the conversion.
+type Auth struct {
+	// DkimDomains are the domains of the successfully verified DKIM signatures.
+	DkimDomains []string
+	// ArcTrusted is true when the message has passed the ARC chain validation and the latest sealer is trusted.
+	ArcTrusted bool
 }
 
 type svc struct {
 	evtType           string
 	htmlPolicy        *bluemonday.Policy
 	writerInternalCfg config.WriterInternalConfig
-	rcptsPublish      map[string]bool
+	redactor          redact.Redactor
 	truncUrlQuery     bool
+	cfgTime           config.TimeConfig
+	svcDkim           dkim.Service
+	cfgDkim           config.DkimConfig
+	svcArc            arc.Service
+	extractors        extractor.Registry
+	svcUnwrap         unwrap.Service
+	svcCleaner        cleaner.Service
+	log               *slog.Logger
+	// now is the receive time of the message
+	now func() time.Time
 }
 
 const ceKeyLenMax = 20
 const ceKeyObjectUrl = "objecturl"
+const ceKeyPreheader = "preheader"
 const ceKeySummary = "summary"
 const ceKeyTime = "time"
 
@@ -39,9 +70,23 @@ const ceKeyAttContentIds = "attachmentcids"
 const ceKeyAttContentTypes = "attachmentctypes"
 const ceKeyAttFileNames = "attachmentfilenames"
 
+const ceKeyDkim = model.AttrKeyDkim
+const ceKeyDkimDomains = model.AttrKeyDkimDomains
+const ceKeyDkimSelectors = model.AttrKeyDkimSelectors
+const ceKeyDkimResults = model.AttrKeyDkimResults
+const ceKeyArc = model.AttrKeyArc
+const ceKeyArcSealer = model.AttrKeyArcSealer
+const ceKeyArcTrusted = model.AttrKeyArcTrusted
+
 const ceSpecVersion = "1.0"
 
-var ErrParse = errors.New("failed to parse message")
+// evtIdLen is the length of the KSUID, evtIdPayloadLen is the length of its payload.
+const evtIdLen = 20
+const evtIdPayloadLen = 16
+
+var ErrParse = model.NewError("failed to parse message", model.ErrContent)
+var ErrDkim = model.NewError("no valid DKIM signature", model.ErrPolicy)
+var ErrDkimUnavailable = model.NewError("DKIM verification is temporarily unavailable", model.ErrTemporary)
 var headerWhiteList = map[string]bool{
 	"contenttransferencod": true,
 	"contenttype":          true,
@@ -69,38 +114,192 @@ var headerWhiteList = map[string]bool{
 	"xreportabuse":         true,
 	"xvirusscanned":        true,
 }
+var reHref = regexp.MustCompile(`(?i)(href\s*=\s*)(?:"(https?://[^"]*)"|'(https?://[^']*)')`)
 var reUrlQuery = regexp.MustCompile(`\?[a-zA-Z0-9_\-]+=[a-zA-Z0-9_\-~.%&/#+]*`)
 
-func NewConverter(evtType string, htmlPolicy *bluemonday.Policy, writerInternalCfg config.WriterInternalConfig, rcptsPublish map[string]bool, truncUrlQuery bool) Service {
+func NewConverter(evtType string, htmlPolicy *bluemonday.Policy, writerInternalCfg config.WriterInternalConfig, redactor redact.Redactor, truncUrlQuery bool, cfgTime config.TimeConfig, svcDkim dkim.Service, cfgDkim config.DkimConfig, svcArc arc.Service, extractors extractor.Registry, svcUnwrap unwrap.Service, svcCleaner cleaner.Service, log *slog.Logger) Service {
 	return svc{
 		evtType:           evtType,
 		htmlPolicy:        htmlPolicy,
 		writerInternalCfg: writerInternalCfg,
-		rcptsPublish:      rcptsPublish,
+		redactor:          redactor,
 		truncUrlQuery:     truncUrlQuery,
+		cfgTime:           cfgTime,
+		svcDkim:           svcDkim,
+		cfgDkim:           cfgDkim,
+		svcArc:            svcArc,
+		extractors:        extractors,
+		svcUnwrap:         svcUnwrap,
+		svcCleaner:        svcCleaner,
+		log:               log,
+		now:               time.Now,
 	}
 }
 
-func (c svc) Convert(src io.Reader, dst *pb.CloudEvent, from string, internal bool) (err error) {
+func (c svc) Convert(ctx context.Context, src io.Reader, dst *pb.CloudEvent, env model.Envelope) (auth Auth, err error) {
+	var raw []byte
+	raw, err = io.ReadAll(src)
 	var e *enmime.Envelope
-	e, err = enmime.ReadEnvelope(src)
-	switch err {
-	case nil:
-		err = c.convert(e, dst, from, internal)
+	if err == nil {
+		e, err = enmime.ReadEnvelope(bytes.NewReader(raw))
+	}
+	if err != nil {
+		err = fmt.Errorf("%w: %s", ErrParse, err)
+	}
+	var vs []dkim.Verification
+	var ar arc.Result
+	if err == nil {
+		// a trusted forwarder vouches for the original authentication results broken by the forwarding
+		ar = c.svcArc.Validate(ctx, raw)
+		vs, err = c.verifyDkim(ctx, raw, env.Internal, ar.Trusted)
+	}
+	if err == nil {
+		err = c.convert(ctx, e, dst, env)
+	}
+	if err == nil {
+		c.convertDkim(vs, dst)
+		c.convertArc(ar, dst)
+		auth = Auth{
+			DkimDomains: dkimDomainsPassed(vs),
+			ArcTrusted:  ar.Trusted,
+		}
+		var date time.Time
+		if dst.Attributes[ceKeyTimeSource].GetCeString() == timeSourceDate {
+			date = dst.Attributes[ceKeyTime].GetCeTimestamp().AsTime()
+		}
+		dst.Id = eventId(raw, date)
+	}
+	return
+}
+
+// eventId derives the id from the deduplication key, so the same message gets the same id on every replica and retry.
+// The id time is the Date header time, so the ids still sort by the time. The message time resolved otherwise depends on
+// the receiving, so the whole id is derived from the key when the date is zero. The random id is returned when the
+// message has no key.
+func eventId(raw []byte, date time.Time) (id string) {
+	id = ksuid.New().String()
+	key, err := hex.DecodeString(dedup.Key(raw))
+	var kid ksuid.KSUID
+	switch {
+	case err != nil || len(key) < evtIdLen:
+		return
+	case date.IsZero():
+		kid, err = ksuid.FromBytes(key[:evtIdLen])
 	default:
+		kid, err = ksuid.FromParts(date, key[:evtIdPayloadLen])
+	}
+	if err == nil {
+		id = kid.String()
+	}
+	return
+}
+
+func (c svc) verifyDkim(ctx context.Context, raw []byte, internal, arcTrusted bool) (vs []dkim.Verification, err error) {
+	var verified bool
+	vs, verified, err = dkim.Verified(ctx)
+	if !verified {
+		vs, err = c.svcDkim.Verify(ctx, raw)
+	}
+	switch {
+	case err != nil:
 		err = fmt.Errorf("%w: %s", ErrParse, err)
+	case internal:
+		// internal messages are trusted by the recipient
+	case arcTrusted:
+	default:
+		switch r := dkim.Aggregate(vs); r {
+		case dkim.ResultPass:
+		case dkim.ResultNone:
+			if c.cfgDkim.RejectUnsigned {
+				err = fmt.Errorf("%w: message is not signed", ErrDkim)
+			}
+		case dkim.ResultTempError:
+			if c.cfgDkim.RejectInvalid {
+				err = fmt.Errorf("%w: %s", ErrDkimUnavailable, r)
+			}
+		default:
+			if c.cfgDkim.RejectInvalid {
+				err = fmt.Errorf("%w: %s", ErrDkim, r)
+			}
+		}
+	}
+	return
+}
+
+func (c svc) convertDkim(vs []dkim.Verification, dst *pb.CloudEvent) {
+	dst.Attributes[ceKeyDkim] = &pb.CloudEventAttributeValue{
+		Attr: &pb.CloudEventAttributeValue_CeString{
+			CeString: string(dkim.Aggregate(vs)),
+		},
+	}
+	if len(vs) > 0 {
+		var domains []string
+		var selectors []string
+		var results []string
+		for _, v := range vs {
+			domains = append(domains, v.Domain)
+			selectors = append(selectors, v.Selector)
+			results = append(results, string(v.Result))
+		}
+		dst.Attributes[ceKeyDkimDomains] = &pb.CloudEventAttributeValue{
+			Attr: &pb.CloudEventAttributeValue_CeString{
+				CeString: strings.Join(domains, ", "),
+			},
+		}
+		dst.Attributes[ceKeyDkimSelectors] = &pb.CloudEventAttributeValue{
+			Attr: &pb.CloudEventAttributeValue_CeString{
+				CeString: strings.Join(selectors, ", "),
+			},
+		}
+		dst.Attributes[ceKeyDkimResults] = &pb.CloudEventAttributeValue{
+			Attr: &pb.CloudEventAttributeValue_CeString{
+				CeString: strings.Join(results, ", "),
+			},
+		}
 	}
 	return
 }
 
-func (c svc) convert(src *enmime.Envelope, dst *pb.CloudEvent, from string, internal bool) (err error) {
-	err = c.convertHeaders(src, dst, from, internal)
+func (c svc) convertArc(r arc.Result, dst *pb.CloudEvent) {
+	dst.Attributes[ceKeyArc] = &pb.CloudEventAttributeValue{
+		Attr: &pb.CloudEventAttributeValue_CeString{
+			CeString: string(r.Status),
+		},
+	}
+	if r.Sealer != "" {
+		dst.Attributes[ceKeyArcSealer] = &pb.CloudEventAttributeValue{
+			Attr: &pb.CloudEventAttributeValue_CeString{
+				CeString: r.Sealer,
+			},
+		}
+	}
+	if r.Trusted {
+		dst.Attributes[ceKeyArcTrusted] = &pb.CloudEventAttributeValue{
+			Attr: &pb.CloudEventAttributeValue_CeBoolean{
+				CeBoolean: true,
+			},
+		}
+	}
+	return
+}
+
+func dkimDomainsPassed(vs []dkim.Verification) (domains []string) {
+	for _, v := range vs {
+		if v.Result == dkim.ResultPass {
+			domains = append(domains, v.Domain)
+		}
+	}
+	return
+}
+
+func (c svc) convert(ctx context.Context, src *enmime.Envelope, dst *pb.CloudEvent, env model.Envelope) (err error) {
+	err = c.convertHeaders(ctx, src, dst, env)
 	if err == nil {
-		err = c.convertBody(src, dst, internal)
+		err = c.convertBody(ctx, src, dst, env.Internal)
 	}
 	if err == nil {
-		c.convertAttachments(src, dst, from)
-		if internal {
+		c.convertAttachments(src, dst, env.From)
+		if env.Internal {
 			dst.Attributes[c.writerInternalCfg.Name] = &pb.CloudEventAttributeValue{
 				Attr: &pb.CloudEventAttributeValue_CeInteger{
 					CeInteger: c.writerInternalCfg.Value,
@@ -111,72 +310,74 @@ func (c svc) convert(src *enmime.Envelope, dst *pb.CloudEvent, from string, inte
 	return
 }
 
-func (c svc) convertHeaders(src *enmime.Envelope, dst *pb.CloudEvent, from string, internal bool) (err error) {
+func (c svc) convertHeaders(ctx context.Context, src *enmime.Envelope, dst *pb.CloudEvent, env model.Envelope) (err error) {
+	var date string
 	for _, k := range src.GetHeaderKeys() {
 		v := src.GetHeader(k)
 		ceKey := c.convertHeaderKey(k)
 		switch ceKey {
 		case "date":
-			t, tErr := time.Parse(time.RFC1123Z, v)
-			if tErr == nil {
-				dst.Attributes[ceKeyTime] = &pb.CloudEventAttributeValue{
-					Attr: &pb.CloudEventAttributeValue_CeTimestamp{
-						CeTimestamp: timestamppb.New(t),
-					},
-				}
-			}
+			date = v
 		case "from":
 			fromActual := v
 			addrPos := strings.Index(v, "<")
 			if addrPos > 0 {
 				fromActual = fromActual[addrPos:]
 			}
-			dst.Source = c.cleanRecipients(c.convertAddr(fromActual))
+			dst.Source = c.redactor.Redact(c.convertAddr(fromActual))
 		case "listpost":
 			dst.Attributes[ceKeyObjectUrl] = &pb.CloudEventAttributeValue{
 				Attr: &pb.CloudEventAttributeValue_CeUri{
-					CeUri: c.cleanRecipients(c.convertAddr(v)),
+					CeUri: c.redactor.Redact(c.convertAddr(v)),
 				},
 			}
 		case "listurl":
-			dst.Source = c.cleanRecipients(c.convertAddr(v))
+			dst.Source = c.redactor.Redact(c.convertAddr(v))
 		case "messageid":
 			if dst.Attributes[ceKeyObjectUrl] == nil {
 				dst.Attributes[ceKeyObjectUrl] = &pb.CloudEventAttributeValue{
 					Attr: &pb.CloudEventAttributeValue_CeString{
-						CeString: c.cleanRecipients(c.convertAddr(v)),
+						CeString: c.redactor.Redact(c.convertAddr(v)),
 					},
 				}
 			}
 		case "subject":
 			dst.Attributes[ceKeySummary] = &pb.CloudEventAttributeValue{
 				Attr: &pb.CloudEventAttributeValue_CeString{
-					CeString: c.cleanRecipients(v),
+					CeString: c.redactor.Redact(v),
 				},
 			}
 		default:
 			switch {
-			case internal, headerWhiteList[ceKey]:
+			case env.Internal, headerWhiteList[ceKey]:
 				v = c.convertAddr(v)
 				if v != "" {
 					dst.Attributes[ceKey] = &pb.CloudEventAttributeValue{
 						Attr: &pb.CloudEventAttributeValue_CeString{
-							CeString: c.cleanRecipients(v),
+							CeString: c.redactor.Redact(v),
 						},
 					}
 				}
 			default:
-				fmt.Printf("forbidden header from %s: %s=%s\n", from, k, v)
+				c.log.DebugContext(ctx, "converter: skipping the forbidden header", "from", env.From, "header", k)
 			}
 		}
 	}
-	if dst.Attributes[ceKeyTime] == nil {
-		dst.Attributes[ceKeyTime] = &pb.CloudEventAttributeValue{
-			Attr: &pb.CloudEventAttributeValue_CeTimestamp{
-				CeTimestamp: timestamppb.New(time.Now().UTC()),
-			},
-		}
+	now := c.now().UTC()
+	hops := received.ParseAll(src.GetHeaderValues("Received"))
+	trusted := c.trustedHops(hops, env.Helo, net.ParseIP(env.RemoteIp), now)
+	t, tSrc := c.resolveTime(date, trusted, now)
+	dst.Attributes[ceKeyTime] = &pb.CloudEventAttributeValue{
+		Attr: &pb.CloudEventAttributeValue_CeTimestamp{
+			CeTimestamp: timestamppb.New(t),
+		},
+	}
+	dst.Attributes[ceKeyTimeSource] = &pb.CloudEventAttributeValue{
+		Attr: &pb.CloudEventAttributeValue_CeString{
+			CeString: tSrc,
+		},
 	}
+	c.convertHops(hops, trusted, t, tSrc, now, dst)
 	if dst.Attributes[ceKeyObjectUrl] == nil {
 		err = fmt.Errorf("%w: %s", ErrParse, "no message id in the source data")
 	}
@@ -206,16 +407,20 @@ func (c svc) convertAddr(src string) (dst string) {
 	return
 }
 
-func (c svc) convertBody(src *enmime.Envelope, dst *pb.CloudEvent, internal bool) (err error) {
+func (c svc) convertBody(ctx context.Context, src *enmime.Envelope, dst *pb.CloudEvent, internal bool) (err error) {
 	var txt string
 	if src.Text != "" {
 		txt = src.Text
 	}
 	if src.HTML != "" {
-		err = c.handleHtml(src.HTML, dst)
+		err = c.extract(ctx, src, dst)
 		if err == nil {
 			txt = src.HTML
 			if !internal {
+				txt, err = c.clean(ctx, txt, dst)
+			}
+			if err == nil && !internal {
+				txt = c.unwrapLinks(ctx, txt)
 				if c.truncUrlQuery {
 					txt = reUrlQuery.ReplaceAllString(txt, "\"")
 				}
@@ -229,114 +434,96 @@ func (c svc) convertBody(src *enmime.Envelope, dst *pb.CloudEvent, internal bool
 			err = fmt.Errorf("%w: %s", ErrParse, "no text data")
 		default:
 			dst.Data = &pb.CloudEvent_TextData{
-				TextData: strings.TrimSpace(c.cleanRecipients(txt)),
+				TextData: strings.TrimSpace(c.redactor.Redact(txt)),
 			}
 		}
 	}
 	return
 }
 
-func (c svc) handleHtml(src string, evt *pb.CloudEvent) (err error) {
-	var doc *goquery.Document
-	doc, err = goquery.NewDocumentFromReader(strings.NewReader(src))
+// extract sets the publisher specific attributes found by the extractors.
+func (c svc) extract(ctx context.Context, src *enmime.Envelope, evt *pb.CloudEvent) (err error) {
+	var in extractor.Input
+	in, err = extractor.NewInput(src.Root.Header, src.HTML)
 	if err != nil {
 		err = fmt.Errorf("%w: %s", ErrParse, err)
 	}
 	if err == nil {
-		// ghost
-		doc.
-			Find("a.post-title-link").
-			First().
-			Each(func(i int, s *goquery.Selection) {
-				c.handleUrlOriginalFirst(s, evt, true)
-			})
-		// govdelivery.com
-		doc.
-			Find("a").
-			FilterFunction(func(i int, s *goquery.Selection) bool {
-				if href, hrefPresent := s.Attr("href"); hrefPresent && strings.Contains(href, "govdelivery.com") {
-					return true
+		in.Unwrap = func(u string) string {
+			return c.svcUnwrap.Unwrap(ctx, u)
+		}
+		attrs := map[string]string{}
+		// the object url from the message id is not an url, let the extractors replace it
+		if u := evt.Attributes[ceKeyObjectUrl].GetCeUri(); u != "" {
+			attrs[extractor.KeyObjectUrl] = u
+		}
+		c.extractors.Extract(in, attrs)
+		if u := attrs[extractor.KeyObjectUrl]; u != "" {
+			attrs[extractor.KeyObjectUrl] = c.svcUnwrap.Unwrap(ctx, u)
+		}
+		for k, v := range attrs {
+			switch k {
+			case extractor.KeyObjectUrl, extractor.KeyImage:
+				evt.Attributes[k] = &pb.CloudEventAttributeValue{
+					Attr: &pb.CloudEventAttributeValue_CeUri{
+						CeUri: v,
+					},
 				}
-				return false
-			}).
-			First().
-			Each(func(i int, s *goquery.Selection) {
-				c.handleUrlOriginalFirst(s, evt, false)
-			})
-		// quora
-		doc.
-			Find("td.answer_details").
-			Find("a").
-			First().
-			Each(func(i int, s *goquery.Selection) {
-				c.handleUrlOriginalFirst(s, evt, false)
-			})
-		// substack
-		if u, uOk := evt.Attributes[ceKeyObjectUrl]; !uOk || u.GetCeUri() == "" {
-			doc.
-				Find("a.email-button-outline").
-				First().
-				Each(func(i int, s *goquery.Selection) {
-					c.handleUrlOriginalFirst(s, evt, true)
-				})
+			default:
+				evt.Attributes[k] = &pb.CloudEventAttributeValue{
+					Attr: &pb.CloudEventAttributeValue_CeString{
+						CeString: v,
+					},
+				}
+			}
 		}
-		// "view in browser"
-		doc.
-			Find("a").
-			FilterFunction(func(i int, s *goquery.Selection) bool {
-				return strings.TrimSpace(strings.ToLower(s.Text())) == "view in browser"
-			}).
-			First().
-			Each(func(i int, s *goquery.Selection) {
-				c.handleUrlOriginalFirst(s, evt, true)
-			})
 	}
 	return
 }
 
-func (c svc) handleUrlOriginalFirst(s *goquery.Selection, evt *pb.CloudEvent, trunc bool) {
-	for _, n := range s.Nodes {
-		if c.handleUrlOriginal(n, evt, trunc) {
-			break
+// clean removes the tracking beacons, the footer boilerplate and the hidden preheader from the HTML.
+// The preheader is kept as the attribute.
+func (c svc) clean(ctx context.Context, src string, evt *pb.CloudEvent) (dst string, err error) {
+	var r cleaner.Result
+	r, err = c.svcCleaner.Clean(ctx, src)
+	switch err {
+	case nil:
+		dst = r.Html
+		if r.Preheader != "" {
+			evt.Attributes[ceKeyPreheader] = &pb.CloudEventAttributeValue{
+				Attr: &pb.CloudEventAttributeValue_CeString{
+					CeString: strings.TrimSpace(c.redactor.Redact(r.Preheader)),
+				},
+			}
 		}
+	default:
+		err = fmt.Errorf("%w: %s", ErrParse, err)
 	}
 	return
 }
 
-func (c svc) handleUrlOriginal(n *html.Node, evt *pb.CloudEvent, trunc bool) (set bool) {
-	var urlOrig string
-	for _, a := range n.Attr {
-		if a.Key == "href" {
-			urlOrig = a.Val
-			break
-		}
+// unwrapLinks replaces the click tracking links in the HTML with the target ones.
+func (c svc) unwrapLinks(ctx context.Context, src string) (dst string) {
+	var links []string
+	for _, m := range reHref.FindAllStringSubmatch(src, -1) {
+		links = append(links, html.UnescapeString(m[2]+m[3]))
 	}
-	if urlOrig != "" {
-		if strings.HasSuffix(urlOrig, "https://links-") && strings.Contains(urlOrig, ".govdelivery.com/CL0/") {
-			urlOrig = urlOrig[len("https://links-")+1+len(".govdelivery.com/CL0/"):]
-			urlOrig = urlOrig[:strings.Index(urlOrig, "/")]
-			urlOrig, _ = url.QueryUnescape(urlOrig)
-		}
-		if trunc {
-			urlEnd := strings.Index(urlOrig, "?")
-			if urlEnd > 0 {
-				urlOrig = urlOrig[:urlEnd]
-			}
-		}
-		evt.Attributes[ceKeyObjectUrl] = &pb.CloudEventAttributeValue{
-			Attr: &pb.CloudEventAttributeValue_CeUri{
-				CeUri: urlOrig,
-			},
+	unwrapped := c.svcUnwrap.UnwrapAll(ctx, links)
+	dst = reHref.ReplaceAllStringFunc(src, func(attr string) string {
+		m := reHref.FindStringSubmatch(attr)
+		u := html.UnescapeString(m[2] + m[3])
+		uUnwrapped, found := unwrapped[u]
+		if !found || uUnwrapped == u {
+			return attr
 		}
-		set = true
-	}
+		return m[1] + `"` + html.EscapeString(uUnwrapped) + `"`
+	})
 	return
 }
 
 func (c svc) convertAttachments(src *enmime.Envelope, dst *pb.CloudEvent, from string) {
-	dst.Id = ksuid.New().String()
 	if dst.Source == "" {
-		dst.Source = c.cleanRecipients(from)
+		dst.Source = c.redactor.Redact(from)
 	}
 	dst.SpecVersion = ceSpecVersion
 	dst.Type = c.evtType
@@ -372,14 +559,3 @@ func (c svc) convertAttachments(src *enmime.Envelope, dst *pb.CloudEvent, from s
 	}
 	return
 }
-
-func (c svc) cleanRecipients(src string) (dst string) {
-	dst = src
-	for rcpt := range c.rcptsPublish {
-		dst = strings.ReplaceAll(dst, rcpt+"@", "")
-		dst = strings.ReplaceAll(dst, strings.ToLower(rcpt)+"@", "")
-		dst = strings.ReplaceAll(dst, rcpt, "")
-		dst = strings.ReplaceAll(dst, strings.ToLower(rcpt), "")
-	}
-	return
-}
@@ -1,19 +1,42 @@
 package converter
 
 import (
-	"fmt"
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
 	"github.com/awakari/int-email/config"
+	"github.com/awakari/int-email/model"
+	"github.com/awakari/int-email/service/arc"
+	"github.com/awakari/int-email/service/cleaner"
+	"github.com/awakari/int-email/service/dkim"
+	"github.com/awakari/int-email/service/dns"
+	"github.com/awakari/int-email/service/extractor"
+	"github.com/awakari/int-email/service/received"
+	"github.com/awakari/int-email/service/redact"
+	"github.com/awakari/int-email/service/unwrap"
 	"github.com/awakari/int-email/util"
 	"github.com/cloudevents/sdk-go/binding/format/protobuf/v2/pb"
+	msgauth "github.com/emersion/go-msgauth/dkim"
+	"github.com/jhillyerd/enmime"
 	"github.com/microcosm-cc/bluemonday"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/segmentio/ksuid"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 	"google.golang.org/protobuf/types/known/timestamppb"
 	"io"
 	"log/slog"
-	"os"
+	"math"
+	"net"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestSvc_Convert(t *testing.T) {
@@ -69,7 +92,7 @@ John`),
 			out: &pb.CloudEvent{
 				Source: "john@example.com",
 				Data: &pb.CloudEvent_TextData{
-					TextData: "Hi example.com,\n\nPlease find attached the meeting notes and presentation slides.\n\nBest regards,\nJohn",
+					TextData: "Hi ,\n\nPlease find attached the meeting notes and presentation slides.\n\nBest regards,\nJohn",
 				},
 				Attributes: map[string]*pb.CloudEventAttributeValue{
 					"contenttype": {
@@ -104,6 +127,11 @@ John`),
 							},
 						},
 					},
+					"timesource": {
+						Attr: &pb.CloudEventAttributeValue_CeString{
+							CeString: "date",
+						},
+					},
 				},
 			},
 		},
@@ -212,6 +240,11 @@ John`),
 							CeString: "1.0",
 						},
 					},
+					"timesource": {
+						Attr: &pb.CloudEventAttributeValue_CeString{
+							CeString: "now",
+						},
+					},
 					"summary": {
 						Attr: &pb.CloudEventAttributeValue_CeString{
 							CeString: "Meeting Notes and Attachment",
@@ -228,10 +261,16 @@ John`),
 			Name:  "awkinternal",
 			Value: 12345,
 		},
-		map[string]bool{
-			"jane.smith": true,
-		},
+		redact.NewRedactor([]string{"jane.smith"}, []string{"example.com"}),
 		false,
+		config.TimeConfig{},
+		dkim.NewService(dkim.NewKeyLookup(dns.Zone{}), 5),
+		config.DkimConfig{},
+		arc.NewMock(),
+		extractor.NewRegistry(extractor.Builtin()...),
+		unwrap.NewService(nil, config.UnwrapConfig{}),
+		cleaner.NewService(),
+		slog.Default(),
 	)
 	conv = NewLogging(conv, slog.Default())
 	for k, c := range cases {
@@ -239,7 +278,7 @@ John`),
 			dst := &pb.CloudEvent{
 				Attributes: make(map[string]*pb.CloudEventAttributeValue),
 			}
-			err := conv.Convert(c.r, dst, c.from, c.internal)
+			_, err := conv.Convert(context.TODO(), c.r, dst, model.Envelope{From: c.from, Internal: c.internal})
 			if c.err == nil {
 				assert.NotZero(t, dst.Id)
 				assert.Equal(t, c.out.Source, dst.Source)
@@ -254,37 +293,646 @@ John`),
 	}
 }
 
-func TestSvc_handleHtml(t *testing.T) {
-	if os.Getenv("CI") == "true" {
-		t.Skip("Skipping test in CI environment")
-	}
-	d, err := os.ReadFile("emaildata.html")
+func TestSvc_Convert_Dkim(t *testing.T) {
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
 	require.Nil(t, err)
+	msg := "From: John Doe <john@example.com>\r\n" +
+		"Subject: Meeting Notes\r\n" +
+		"Message-ID: <unique-message-id@example.com>\r\n" +
+		"Content-Type: text/plain; charset=\"UTF-8\"\r\n" +
+		"\r\n" +
+		"Please find attached the meeting notes.\r\n"
+	sign := func(domain string) string {
+		var dst bytes.Buffer
+		err = msgauth.Sign(&dst, strings.NewReader(msg), &msgauth.SignOptions{
+			Domain:   domain,
+			Selector: "sel1",
+			Signer:   key,
+		})
+		require.Nil(t, err)
+		return dst.String()
+	}
+	zone := dns.Zone{
+		Txt: map[string][]string{
+			"sel1._domainkey.example.com": {
+				"v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(pub),
+			},
+		},
+		Fail: map[string]bool{
+			"sel1._domainkey.down.example.com": true,
+		},
+	}
+	cases := map[string]struct {
+		msg      string
+		internal bool
+		cfg      config.DkimConfig
+		attrs    map[string]string
+		auth     Auth
+		err      error
+	}{
+		"unsigned accepted": {
+			msg: msg,
+			attrs: map[string]string{
+				"dkim": "none",
+				"arc":  "none",
+			},
+		},
+		"unsigned rejected": {
+			msg: msg,
+			cfg: config.DkimConfig{
+				RejectUnsigned: true,
+			},
+			err: ErrDkim,
+		},
+		"unsigned internal": {
+			msg:      msg,
+			internal: true,
+			cfg: config.DkimConfig{
+				RejectUnsigned: true,
+			},
+			attrs: map[string]string{
+				"dkim": "none",
+			},
+		},
+		"pass": {
+			msg: sign("example.com"),
+			cfg: config.DkimConfig{
+				RejectUnsigned: true,
+				RejectInvalid:  true,
+			},
+			attrs: map[string]string{
+				"dkim":          "pass",
+				"dkimdomains":   "example.com",
+				"dkimselectors": "sel1",
+				"dkimresults":   "pass",
+			},
+			auth: Auth{
+				DkimDomains: []string{"example.com"},
+			},
+		},
+		"pass and temperror": {
+			msg: "DKIM-Signature: v=1; a=ed25519-sha256; d=down.example.com; s=sel1; h=from; bh=x; b=y\r\n" +
+				sign("example.com"),
+			attrs: map[string]string{
+				"dkim":          "pass",
+				"dkimdomains":   "down.example.com, example.com",
+				"dkimselectors": "sel1, sel1",
+				"dkimresults":   "temperror, pass",
+			},
+			auth: Auth{
+				DkimDomains: []string{"example.com"},
+			},
+		},
+		"invalid accepted": {
+			msg: strings.Replace(sign("example.com"), "meeting notes", "minutes", 1),
+			cfg: config.DkimConfig{
+				RejectUnsigned: true,
+			},
+			attrs: map[string]string{
+				"dkim":        "fail",
+				"dkimresults": "fail",
+			},
+		},
+		"invalid rejected": {
+			msg: strings.Replace(sign("example.com"), "meeting notes", "minutes", 1),
+			cfg: config.DkimConfig{
+				RejectInvalid: true,
+			},
+			err: ErrDkim,
+		},
+		"invalid trusted forwarder": {
+			msg: "ARC-Seal: i=1; a=rsa-sha256; cv=none; d=lists.example.org; s=arc; b=\r\n" +
+				strings.Replace(sign("example.com"), "meeting notes", "minutes", 1),
+			cfg: config.DkimConfig{
+				RejectInvalid: true,
+			},
+			attrs: map[string]string{
+				"dkim":      "fail",
+				"arc":       "pass",
+				"arcsealer": "lists.example.org",
+			},
+			auth: Auth{
+				ArcTrusted: true,
+			},
+		},
+		"key unavailable": {
+			msg: sign("down.example.com"),
+			cfg: config.DkimConfig{
+				RejectInvalid: true,
+			},
+			err: ErrDkimUnavailable,
+		},
+	}
+	for k, c := range cases {
+		t.Run(k, func(t *testing.T) {
+			conv := NewConverter(
+				"com_awakari_email_v1",
+				bluemonday.NewPolicy(),
+				config.WriterInternalConfig{
+					Name:  "awkinternal",
+					Value: 12345,
+				},
+				redact.NewRedactor(nil, nil),
+				false,
+				config.TimeConfig{},
+				dkim.NewService(dkim.NewKeyLookup(zone), 5),
+				c.cfg,
+				arc.NewMock(),
+				extractor.NewRegistry(extractor.Builtin()...),
+				unwrap.NewService(nil, config.UnwrapConfig{}),
+				cleaner.NewService(),
+				slog.Default(),
+			)
+			dst := &pb.CloudEvent{
+				Attributes: make(map[string]*pb.CloudEventAttributeValue),
+			}
+			auth, err := conv.Convert(context.TODO(), strings.NewReader(c.msg), dst, model.Envelope{From: "john@example.com", Internal: c.internal})
+			assert.ErrorIs(t, err, c.err)
+			assert.Equal(t, c.auth, auth)
+			for attrK, attrV := range c.attrs {
+				assert.Equal(t, attrV, dst.Attributes[attrK].GetCeString(), attrK)
+			}
+		})
+	}
+}
+
+func TestSvc_extract(t *testing.T) {
 	conv := svc{
 		htmlPolicy: util.HtmlPolicy(),
+		extractors: extractor.NewRegistry(extractor.Builtin()...),
+		svcUnwrap:  unwrap.NewService(nil, config.UnwrapConfig{}),
 	}
 	evt := &pb.CloudEvent{
 		Attributes: make(map[string]*pb.CloudEventAttributeValue),
 	}
-	err = conv.handleHtml(string(d), evt)
-	assert.Nil(t, err)
-	fmt.Printf("%+v\n", evt.Attributes)
+	html := `<html><body><a href="https://shop.example.com/newsletter/sale-2024?uid=12345"> View in Browser </a>` +
+		`<p>Everything is 50% off.</p></body></html>`
+	err := conv.extract(context.TODO(), &enmime.Envelope{Root: &enmime.Part{}, HTML: html}, evt)
+	require.Nil(t, err)
+	assert.Equal(t, "https://shop.example.com/newsletter/sale-2024", evt.Attributes[ceKeyObjectUrl].GetCeUri())
 }
 
-func TestSvc_cleanRecipients(t *testing.T) {
-	if os.Getenv("CI") == "true" {
-		t.Skip("Skipping test in CI environment")
+func TestMetrics_Convert(t *testing.T) {
+	conv := NewMetrics(NewConverter(
+		"com_awakari_email_v1",
+		bluemonday.NewPolicy(),
+		config.WriterInternalConfig{},
+		redact.NewRedactor(nil, nil),
+		false,
+		config.TimeConfig{},
+		dkim.NewService(dkim.NewKeyLookup(dns.Zone{}), 5),
+		config.DkimConfig{},
+		arc.NewMock(),
+		extractor.NewRegistry(extractor.Builtin()...),
+		unwrap.NewService(nil, config.UnwrapConfig{}),
+		cleaner.NewService(),
+		slog.Default(),
+	))
+	okBefore := testutil.ToFloat64(converts.WithLabelValues("ok"))
+	parseBefore := testutil.ToFloat64(converts.WithLabelValues("parse"))
+	msg := "From: John Doe <john@example.com>\r\n" +
+		"Subject: Meeting Notes\r\n" +
+		"Message-ID: <unique-message-id@example.com>\r\n" +
+		"Content-Type: text/plain; charset=\"UTF-8\"\r\n" +
+		"\r\n" +
+		"Please find attached the meeting notes.\r\n"
+	_, err := conv.Convert(context.TODO(), strings.NewReader(msg), &pb.CloudEvent{Attributes: map[string]*pb.CloudEventAttributeValue{}}, model.Envelope{From: "john@example.com"})
+	require.Nil(t, err)
+	_, err = conv.Convert(context.TODO(), strings.NewReader(""), &pb.CloudEvent{Attributes: map[string]*pb.CloudEventAttributeValue{}}, model.Envelope{From: "john@example.com"})
+	require.ErrorIs(t, err, ErrParse)
+	assert.Equal(t, okBefore+1, testutil.ToFloat64(converts.WithLabelValues("ok")))
+	assert.Equal(t, parseBefore+1, testutil.ToFloat64(converts.WithLabelValues("parse")))
+}
+
+func TestTracing_Convert(t *testing.T) {
+	exp := tracetest.NewInMemoryExporter()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exp)))
+	conv := NewTracing(NewConverter(
+		"com_awakari_email_v1",
+		bluemonday.NewPolicy(),
+		config.WriterInternalConfig{},
+		redact.NewRedactor(nil, nil),
+		false,
+		config.TimeConfig{},
+		dkim.NewService(dkim.NewKeyLookup(dns.Zone{}), 5),
+		config.DkimConfig{},
+		arc.NewMock(),
+		extractor.NewRegistry(extractor.Builtin()...),
+		unwrap.NewService(nil, config.UnwrapConfig{}),
+		cleaner.NewService(),
+		slog.Default(),
+	))
+	ctx, span := otel.Tracer("test").Start(context.TODO(), "test")
+	_, err := conv.Convert(ctx, strings.NewReader(""), &pb.CloudEvent{Attributes: map[string]*pb.CloudEventAttributeValue{}}, model.Envelope{From: "john@example.com"})
+	span.End()
+	require.ErrorIs(t, err, ErrParse)
+	spans := exp.GetSpans()
+	require.Equal(t, 2, len(spans))
+	assert.Equal(t, "converter.convert", spans[0].Name)
+	assert.Equal(t, span.SpanContext().SpanID(), spans[0].Parent.SpanID())
+	assert.Equal(t, codes.Error, spans[0].Status.Code)
+}
+
+func TestSvc_Convert_Unwrap(t *testing.T) {
+	conv := NewConverter(
+		"com_awakari_email_v1",
+		util.HtmlPolicy(),
+		config.WriterInternalConfig{},
+		redact.NewRedactor(nil, nil),
+		false,
+		config.TimeConfig{},
+		dkim.NewService(dkim.NewKeyLookup(dns.Zone{}), 5),
+		config.DkimConfig{},
+		arc.NewMock(),
+		extractor.NewRegistry(extractor.Builtin()...),
+		unwrap.NewService(nil, config.UnwrapConfig{}),
+		cleaner.NewService(),
+		slog.Default(),
+	)
+	msg := "From: City Council <council@public.govdelivery.com>\r\n" +
+		"Message-ID: <agenda-7@public.govdelivery.com>\r\n" +
+		"Subject: Meeting agenda\r\n" +
+		"Content-Type: text/html; charset=\"UTF-8\"\r\n" +
+		"\r\n" +
+		`<p>The agenda is published.</p>` +
+		`<a href="https://links-1.govdelivery.com/CL0/https:%2F%2Fwww.example.gov%2Fagenda%3Fid=7%26utm_source=govdelivery/1/0100018f-abcd/AbCdEf=123">Read the agenda</a>` +
+		`<a href='https://example.com/minutes?utm_campaign=council&amp;page=2'>Minutes</a>` +
+		`<a href="https://example.com/contact">Contact</a>` + "\r\n"
+	dst := &pb.CloudEvent{
+		Attributes: make(map[string]*pb.CloudEventAttributeValue),
 	}
-	d, err := os.ReadFile("emaildata.html")
+	_, err := conv.Convert(context.TODO(), strings.NewReader(msg), dst, model.Envelope{From: "council@public.govdelivery.com"})
 	require.Nil(t, err)
-	conv := svc{
-		htmlPolicy: util.HtmlPolicy(),
-		rcptsPublish: map[string]bool{
-			"QaZxSw": true,
+	assert.Equal(t, "https://www.example.gov/agenda?id=7", dst.Attributes[ceKeyObjectUrl].GetCeUri())
+	txt := dst.GetTextData()
+	assert.Contains(t, txt, `href="https://www.example.gov/agenda?id=7"`)
+	assert.Contains(t, txt, `href="https://example.com/minutes?page=2"`)
+	assert.Contains(t, txt, `href="https://example.com/contact"`)
+	assert.NotContains(t, txt, "govdelivery.com/CL0")
+	assert.NotContains(t, txt, "utm_")
+}
+
+func TestSvc_Convert_Clean(t *testing.T) {
+	conv := NewConverter(
+		"com_awakari_email_v1",
+		util.HtmlPolicy(),
+		config.WriterInternalConfig{},
+		redact.NewRedactor([]string{"johndoe"}, []string{"example.com"}),
+		false,
+		config.TimeConfig{},
+		dkim.NewService(dkim.NewKeyLookup(dns.Zone{}), 5),
+		config.DkimConfig{},
+		arc.NewMock(),
+		extractor.NewRegistry(),
+		unwrap.NewService(nil, config.UnwrapConfig{}),
+		cleaner.NewService(),
+		slog.Default(),
+	)
+	msg := "From: Weekly <news@example.com>\r\n" +
+		"Message-ID: <weekly-42@example.com>\r\n" +
+		"Subject: Weekly #42\r\n" +
+		"Content-Type: text/html; charset=\"UTF-8\"\r\n" +
+		"\r\n" +
+		`<div style="display:none">Top stories for johndoe@example.com</div>` +
+		`<p>The top stories of the week.</p>` +
+		`<img src="https://example.us1.list-manage.com/track/open.php?u=1" width="1" height="1">` +
+		`<p>Sent to johndoe@example.com. <a href="https://example.com/unsubscribe?u=1">Unsubscribe</a></p>` + "\r\n"
+	dst := &pb.CloudEvent{
+		Attributes: make(map[string]*pb.CloudEventAttributeValue),
+	}
+	_, err := conv.Convert(context.TODO(), strings.NewReader(msg), dst, model.Envelope{From: "news@example.com"})
+	require.Nil(t, err)
+	assert.Equal(t, "Top stories for", dst.Attributes[ceKeyPreheader].GetCeString())
+	assert.Equal(t, "Weekly #42", dst.Attributes[ceKeySummary].GetCeString())
+	txt := dst.GetTextData()
+	assert.Contains(t, txt, "The top stories of the week.")
+	assert.NotContains(t, txt, "Top stories for")
+	assert.NotContains(t, txt, "list-manage")
+	assert.NotContains(t, txt, "Unsubscribe")
+}
+
+func TestSvc_resolveTime(t *testing.T) {
+	now := time.Date(2024, 10, 10, 12, 0, 0, 0, time.UTC)
+	c := svc{
+		cfgTime: config.TimeConfig{
+			FutureMax: time.Hour,
+			PastMax:   365 * 24 * time.Hour,
 		},
 	}
-	src := string(d)
-	assert.True(t, strings.Contains(src, "QaZxSw"))
-	dst := conv.cleanRecipients(src)
-	assert.False(t, strings.Contains(dst, "QaZxSw"))
+	hdrs := []string{
+		"from mx.example.org by mx.awakari.com with ESMTPS id abc; Thu, 10 Oct 2024 11:59:00 +0000",
+		"from smtp.example.com (smtp.example.com [192.0.2.1]) by mx.example.org; Thu, 10 Oct 2024 13:58:00 +0200 (CEST)",
+	}
+	cases := map[string]struct {
+		date     string
+		received []string
+		out      time.Time
+		src      string
+	}{
+		"date": {
+			date:     "Thu, 10 Oct 2024 11:30:00 +0000",
+			received: hdrs,
+			out:      time.Date(2024, 10, 10, 11, 30, 0, 0, time.UTC),
+			src:      "date",
+		},
+		"obsolete date": {
+			date: "10 Oct 24 07:30 EDT (Eastern Daylight Time)",
+			out:  time.Date(2024, 10, 10, 11, 30, 0, 0, time.UTC),
+			src:  "date",
+		},
+		"missing date": {
+			received: hdrs,
+			out:      time.Date(2024, 10, 10, 11, 58, 0, 0, time.UTC),
+			src:      "received",
+		},
+		"invalid date": {
+			date:     "yesterday",
+			received: hdrs,
+			out:      time.Date(2024, 10, 10, 11, 58, 0, 0, time.UTC),
+			src:      "received",
+		},
+		"far future date": {
+			date:     "Thu, 10 Oct 2030 11:30:00 +0000",
+			received: hdrs,
+			out:      time.Date(2024, 10, 10, 11, 58, 0, 0, time.UTC),
+			src:      "received",
+		},
+		"ancient date": {
+			date:     "Thu, 1 Jan 1970 00:00:00 +0000",
+			received: hdrs,
+			out:      time.Date(2024, 10, 10, 11, 58, 0, 0, time.UTC),
+			src:      "received",
+		},
+		"forged received": {
+			received: append(
+				[]string{
+					hdrs[0],
+					"from unknown by mx.example.org; Fri, 11 Oct 2024 10:00:00 +0000",
+				},
+				hdrs[1],
+			),
+			out: time.Date(2024, 10, 10, 11, 59, 0, 0, time.UTC),
+			src: "received",
+		},
+		"invalid received": {
+			received: []string{
+				"from mx.example.org by mx.awakari.com",
+			},
+			out: now,
+			src: "now",
+		},
+		"nothing": {
+			out: now,
+			src: "now",
+		},
+	}
+	for k, cs := range cases {
+		t.Run(k, func(t *testing.T) {
+			trusted := c.trustedHops(received.ParseAll(cs.received), "mx.awakari.com", net.ParseIP("192.0.2.25"), now)
+			out, src := c.resolveTime(cs.date, trusted, now)
+			assert.True(t, cs.out.Equal(out), out.String())
+			assert.Equal(t, cs.src, src)
+		})
+	}
+}
+
+func TestSvc_trustedHops(t *testing.T) {
+	now := time.Date(2024, 10, 10, 12, 0, 0, 0, time.UTC)
+	c := svc{}
+	hdrs := []string{
+		"from mx.example.org (mx.example.org [203.0.113.5]) by mx.awakari.com; Thu, 10 Oct 2024 11:59:00 +0000",
+		"from smtp.example.com (out.example.com [192.0.2.1]) by mx.example.org; Thu, 10 Oct 2024 11:58:00 +0000",
+		"from localhost (localhost [127.0.0.1]) by out.example.com; Thu, 10 Oct 2024 11:57:00 +0000",
+	}
+	cases := map[string]struct {
+		received []string
+		helo     string
+		remoteIp string
+		count    int
+	}{
+		"linked": {
+			received: hdrs,
+			helo:     "mx.awakari.com",
+			remoteIp: "192.0.2.25",
+			count:    3,
+		},
+		"added by the peer address": {
+			received: []string{
+				"from mx.example.org (mx.example.org [203.0.113.5]) by [192.0.2.25]; Thu, 10 Oct 2024 11:59:00 +0000",
+				hdrs[1],
+			},
+			helo:     "relay.example.net",
+			remoteIp: "192.0.2.25",
+			count:    2,
+		},
+		"another peer": {
+			received: hdrs,
+			helo:     "relay.example.net",
+			remoteIp: "192.0.2.25",
+		},
+		"unknown peer address": {
+			received: hdrs,
+			helo:     "mx.awakari.com",
+		},
+		"broken chain": {
+			received: []string{
+				hdrs[0],
+				"from smtp.example.com (out.example.com [192.0.2.1]) by mx.example.net; Thu, 10 Oct 2024 11:58:00 +0000",
+				hdrs[2],
+			},
+			helo:     "mx.awakari.com",
+			remoteIp: "192.0.2.25",
+			count:    1,
+		},
+		"address mismatch": {
+			received: []string{
+				hdrs[0],
+				"from smtp.example.com (out.example.com [192.0.2.1]) by [203.0.113.6]; Thu, 10 Oct 2024 11:58:00 +0000",
+			},
+			helo:     "mx.awakari.com",
+			remoteIp: "192.0.2.25",
+			count:    1,
+		},
+	}
+	for k, cs := range cases {
+		t.Run(k, func(t *testing.T) {
+			trusted := c.trustedHops(received.ParseAll(cs.received), cs.helo, net.ParseIP(cs.remoteIp), now)
+			assert.Len(t, trusted, cs.count)
+		})
+	}
+}
+
+func TestSvc_Convert_Received(t *testing.T) {
+	conv := NewConverter(
+		"com_awakari_email_v1",
+		bluemonday.NewPolicy(),
+		config.WriterInternalConfig{},
+		redact.NewRedactor(nil, nil),
+		false,
+		config.TimeConfig{},
+		dkim.NewService(dkim.NewKeyLookup(dns.Zone{}), 5),
+		config.DkimConfig{},
+		arc.NewMock(),
+		extractor.NewRegistry(),
+		unwrap.NewService(nil, config.UnwrapConfig{}),
+		cleaner.NewService(),
+		slog.Default(),
+	)
+	msg := "Received: from mx.example.org (mx.example.org [203.0.113.5]) by mx.awakari.com with ESMTPS id a1;\r\n" +
+		" Thu, 10 Oct 2024 12:36:30 +0000\r\n" +
+		"Received: from newsletter.example.com (out1.esp.example.net [198.51.100.7])\r\n" +
+		" by mx.example.org with ESMTP id b2; Thu, 10 Oct 2024 12:35:10 +0000\r\n" +
+		"Received: from localhost (localhost [127.0.0.1]) by newsletter.example.com with SMTP id c3;\r\n" +
+		" Thu, 10 Oct 2024 12:35:00 +0000\r\n" +
+		"From: Weekly <news@example.com>\r\n" +
+		"Message-ID: <weekly-42@example.com>\r\n" +
+		"Subject: Weekly #42\r\n" +
+		"Date: Thu, 10 Oct 2024 12:34:30 +0000\r\n" +
+		"Content-Type: text/plain; charset=\"UTF-8\"\r\n" +
+		"\r\n" +
+		"The top stories of the week.\r\n"
+	c := conv.(svc)
+	c.now = func() time.Time {
+		return time.Date(2024, 10, 10, 12, 36, 40, 0, time.UTC)
+	}
+	cases := map[string]struct {
+		env        model.Envelope
+		originIp   string
+		originHost string
+	}{
+		"linked to the peer": {
+			env: model.Envelope{
+				From:     "news@example.com",
+				Helo:     "mx.awakari.com",
+				RemoteIp: "192.0.2.25",
+			},
+			originIp:   "198.51.100.7",
+			originHost: "out1.esp.example.net",
+		},
+		"not linked to the peer": {
+			env: model.Envelope{
+				From:     "news@example.com",
+				Helo:     "mx.example.net",
+				RemoteIp: "203.0.113.9",
+			},
+		},
+	}
+	for k, cs := range cases {
+		t.Run(k, func(t *testing.T) {
+			dst := &pb.CloudEvent{
+				Attributes: make(map[string]*pb.CloudEventAttributeValue),
+			}
+			_, err := c.Convert(context.TODO(), strings.NewReader(msg), dst, cs.env)
+			require.Nil(t, err)
+			assert.Equal(t, int32(3), dst.Attributes[ceKeyHops].GetCeInteger())
+			assert.Equal(t, cs.originIp, dst.Attributes[ceKeyOriginIp].GetCeString())
+			assert.Equal(t, cs.originHost, dst.Attributes[ceKeyOriginHost].GetCeString())
+			assert.Equal(t, int32(130), dst.Attributes[ceKeyDeliveryLatency].GetCeInteger())
+			assert.Equal(t, "date", dst.Attributes[ceKeyTimeSource].GetCeString())
+		})
+	}
+}
+
+func TestSvc_convertHops_Latency(t *testing.T) {
+	now := time.Date(2024, 10, 10, 12, 36, 40, 0, time.UTC)
+	cases := map[string]struct {
+		t       time.Time
+		tSrc    string
+		latency int32
+		absent  bool
+	}{
+		"delivered": {
+			t:       now.Add(-time.Minute),
+			tSrc:    timeSourceDate,
+			latency: 60,
+		},
+		"clocks skew": {
+			t:       now.Add(time.Minute),
+			tSrc:    timeSourceReceived,
+			latency: 0,
+		},
+		"out of range": {
+			t:       time.Date(1900, 1, 1, 0, 0, 0, 0, time.UTC),
+			tSrc:    timeSourceDate,
+			latency: math.MaxInt32,
+		},
+		"receive time": {
+			t:      now,
+			tSrc:   timeSourceNow,
+			absent: true,
+		},
+	}
+	for k, c := range cases {
+		t.Run(k, func(t *testing.T) {
+			dst := &pb.CloudEvent{
+				Attributes: make(map[string]*pb.CloudEventAttributeValue),
+			}
+			svc{}.convertHops(nil, nil, c.t, c.tSrc, now, dst)
+			if c.absent {
+				assert.Nil(t, dst.Attributes[ceKeyDeliveryLatency])
+			} else {
+				assert.Equal(t, c.latency, dst.Attributes[ceKeyDeliveryLatency].GetCeInteger())
+			}
+		})
+	}
+}
+
+func TestSvc_Convert_EventId(t *testing.T) {
+	conv := NewConverter(
+		"com_awakari_email_v1",
+		bluemonday.NewPolicy(),
+		config.WriterInternalConfig{},
+		redact.NewRedactor(nil, nil),
+		false,
+		config.TimeConfig{},
+		dkim.NewService(dkim.NewKeyLookup(dns.Zone{}), 5),
+		config.DkimConfig{},
+		arc.NewMock(),
+		extractor.NewRegistry(),
+		unwrap.NewService(nil, config.UnwrapConfig{}),
+		cleaner.NewService(),
+		slog.Default(),
+	).(svc)
+	// every message is received later than the one before
+	receivedAt := time.Date(2024, 10, 10, 12, 40, 0, 0, time.UTC)
+	conv.now = func() time.Time {
+		receivedAt = receivedAt.Add(time.Hour)
+		return receivedAt
+	}
+	msg := func(msgId, body string) string {
+		return "From: Weekly <news@example.com>\r\n" +
+			"Message-ID: <" + msgId + ">\r\n" +
+			"Date: Thu, 10 Oct 2024 12:34:56 +0000\r\n" +
+			"Content-Type: text/plain; charset=\"UTF-8\"\r\n" +
+			"\r\n" +
+			body + "\r\n"
+	}
+	msgNoDate := func(msgId, body string) string {
+		return "From: Weekly <news@example.com>\r\n" +
+			"Message-ID: <" + msgId + ">\r\n" +
+			"Content-Type: text/plain; charset=\"UTF-8\"\r\n" +
+			"\r\n" +
+			body + "\r\n"
+	}
+	convert := func(src string) string {
+		dst := &pb.CloudEvent{
+			Attributes: make(map[string]*pb.CloudEventAttributeValue),
+		}
+		_, err := conv.Convert(context.TODO(), strings.NewReader(src), dst, model.Envelope{From: "news@example.com"})
+		require.Nil(t, err)
+		return dst.Id
+	}
+	id := convert(msg("weekly-42@example.com", "The top stories."))
+	kid, err := ksuid.Parse(id)
+	require.Nil(t, err)
+	assert.Equal(t, time.Date(2024, 10, 10, 12, 34, 56, 0, time.UTC), kid.Time().UTC())
+	assert.Equal(t, id, convert(msg("weekly-42@example.com", "The top stories.")))
+	assert.NotEqual(t, id, convert(msg("weekly-43@example.com", "The top stories.")))
+	assert.NotEqual(t, id, convert(msg("weekly-42@example.com", "The other stories.")))
+	// the time resolved otherwise is not stable
+	idNoDate := convert(msgNoDate("weekly-42@example.com", "The top stories."))
+	_, err = ksuid.Parse(idNoDate)
+	require.Nil(t, err)
+	assert.Equal(t, idNoDate, convert(msgNoDate("weekly-42@example.com", "The top stories.")))
+	assert.NotEqual(t, idNoDate, convert(msgNoDate("weekly-43@example.com", "The top stories.")))
 }
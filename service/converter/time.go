@@ -0,0 +1,85 @@
+package converter
+
+import (
+	"github.com/awakari/int-email/service/received"
+	"github.com/awakari/int-email/util"
+	"net"
+	"strings"
+	"time"
+)
+
+const ceKeyTimeSource = "timesource"
+
+// the sources of the event time
+const (
+	timeSourceDate     = "date"
+	timeSourceReceived = "received"
+	timeSourceNow      = "now"
+)
+
+// receivedSkewMax is the clock difference tolerated between the hops.
+const receivedSkewMax = 15 * time.Minute
+
+// resolveTime returns the message time from the Date header when it's sane, otherwise the earliest trusted Received
+// time, otherwise the current time.
+func (c svc) resolveTime(date string, trusted []received.Hop, now time.Time) (t time.Time, src string) {
+	var err error
+	if t, err = util.ParseDate(date); err == nil && c.timeSane(t, now) {
+		return t.UTC(), timeSourceDate
+	}
+	if len(trusted) > 0 {
+		return trusted[len(trusted)-1].Time.UTC(), timeSourceReceived
+	}
+	return now, timeSourceNow
+}
+
+// trustedHops returns the top hops of the Received headers chain linked to the SMTP peer. The headers are added on top
+// by every hop, so the top one is added by the peer and every next one by the host the hop above received the message
+// from. The chain is followed from the top while every hop is added by the expected host, the times are sane and don't
+// grow. Nothing is trusted when the peer address is unknown, the lower hops are not trusted after the first
+// inconsistent one: these may be forged by the sender.
+func (c svc) trustedHops(hops []received.Hop, helo string, remoteIp net.IP, now time.Time) (trusted []received.Hop) {
+	if remoteIp == nil {
+		return
+	}
+	names, ip := []string{helo}, remoteIp
+	prev := now
+	for _, h := range hops {
+		if !addedBy(h, names, ip) || h.Time.IsZero() || !c.timeSane(h.Time, now) || h.Time.After(prev.Add(receivedSkewMax)) {
+			break
+		}
+		trusted = append(trusted, h)
+		names, ip = []string{h.From, h.FromHost}, h.FromIp
+		prev = h.Time
+	}
+	return
+}
+
+// addedBy returns true when the "by" host of the hop is the one known by any of the names or the address.
+func addedBy(h received.Hop, names []string, ip net.IP) (ok bool) {
+	by := strings.TrimPrefix(strings.ToLower(strings.Trim(h.By, "[]")), "ipv6:")
+	if by == "" {
+		return
+	}
+	if byIp := net.ParseIP(by); byIp != nil {
+		return ip != nil && byIp.Equal(ip)
+	}
+	for _, n := range names {
+		if n != "" && strings.EqualFold(n, by) {
+			ok = true
+			break
+		}
+	}
+	return
+}
+
+func (c svc) timeSane(t, now time.Time) (ok bool) {
+	ok = true
+	if c.cfgTime.FutureMax > 0 && t.After(now.Add(c.cfgTime.FutureMax)) {
+		ok = false
+	}
+	if c.cfgTime.PastMax > 0 && t.Before(now.Add(-c.cfgTime.PastMax)) {
+		ok = false
+	}
+	return
+}
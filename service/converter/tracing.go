@@ -0,0 +1,32 @@
+package converter
+
+import (
+	"context"
+	"github.com/awakari/int-email/model"
+	"github.com/awakari/int-email/util"
+	"github.com/cloudevents/sdk-go/binding/format/protobuf/v2/pb"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"io"
+)
+
+type tracing struct {
+	svc Service
+}
+
+func NewTracing(svc Service) Service {
+	return tracing{
+		svc: svc,
+	}
+}
+
+func (t tracing) Convert(ctx context.Context, src io.Reader, dst *pb.CloudEvent, env model.Envelope) (auth Auth, err error) {
+	ctx, span := util.Tracer().Start(ctx, "converter.convert", trace.WithAttributes(
+		attribute.String("from", env.From),
+		attribute.Bool("internal", env.Internal),
+	))
+	auth, err = t.svc.Convert(ctx, src, dst, env)
+	span.SetAttributes(attribute.String("event.id", dst.Id))
+	util.SpanEnd(span, err)
+	return
+}
@@ -0,0 +1,43 @@
+package deadletter
+
+import (
+	"context"
+	"github.com/awakari/int-email/util"
+	"log/slog"
+)
+
+type logging struct {
+	svc Service
+	log *slog.Logger
+}
+
+func NewLogging(svc Service, log *slog.Logger) Service {
+	return logging{
+		svc: svc,
+		log: log,
+	}
+}
+
+func (l logging) Put(ctx context.Context, e Entry) (id string, err error) {
+	id, err = l.svc.Put(ctx, e)
+	l.log.Log(ctx, util.LogLevel(err), "deadletter.Put", "from", e.Envelope.From, "error", e.Error, "id", id, "err", err)
+	return
+}
+
+func (l logging) Get(ctx context.Context, id string) (e Entry, err error) {
+	e, err = l.svc.Get(ctx, id)
+	l.log.Log(ctx, util.LogLevel(err), "deadletter.Get", "id", id, "err", err)
+	return
+}
+
+func (l logging) List(ctx context.Context) (ids []string, err error) {
+	ids, err = l.svc.List(ctx)
+	l.log.Log(ctx, util.LogLevel(err), "deadletter.List", "count", len(ids), "err", err)
+	return
+}
+
+func (l logging) Delete(ctx context.Context, id string) (err error) {
+	err = l.svc.Delete(ctx, id)
+	l.log.Log(ctx, util.LogLevel(err), "deadletter.Delete", "id", id, "err", err)
+	return
+}
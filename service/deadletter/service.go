@@ -0,0 +1,124 @@
+package deadletter
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/awakari/int-email/model"
+	"github.com/awakari/int-email/util"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Entry is the raw message failed to be converted or written.
+type Entry struct {
+	Id       string         `json:"id"`
+	Envelope model.Envelope `json:"envelope"`
+	Raw      []byte         `json:"raw"`
+	Error    string         `json:"error"`
+	Time     time.Time      `json:"time"`
+}
+
+type Service interface {
+
+	// Put stores the entry. The entry id is derived from the raw message, so the same message failed again
+	// replaces the previous entry instead of being duplicated.
+	Put(ctx context.Context, e Entry) (id string, err error)
+
+	Get(ctx context.Context, id string) (e Entry, err error)
+
+	// List returns the ids of the stored entries, the oldest first.
+	List(ctx context.Context) (ids []string, err error)
+
+	Delete(ctx context.Context, id string) (err error)
+}
+
+type service struct {
+	dir string
+}
+
+const fileExt = ".json"
+const filePrefixTmp = ".tmp-"
+
+var ErrNotFound = errors.New("dead letter not found")
+
+func NewService(dir string) (svc Service, err error) {
+	err = os.MkdirAll(dir, 0o700)
+	if err == nil {
+		svc = service{
+			dir: dir,
+		}
+	}
+	return
+}
+
+func (svc service) Put(ctx context.Context, e Entry) (id string, err error) {
+	hash := sha256.Sum256(e.Raw)
+	e.Id = hex.EncodeToString(hash[:16])
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+	var data []byte
+	data, err = json.Marshal(e)
+	if err == nil {
+		err = util.WriteFileAtomic(svc.dir, e.Id+fileExt, filePrefixTmp, data)
+	}
+	if err == nil {
+		id = e.Id
+	}
+	return
+}
+
+func (svc service) Get(ctx context.Context, id string) (e Entry, err error) {
+	var data []byte
+	data, err = os.ReadFile(svc.path(id))
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		err = fmt.Errorf("%w: %s", ErrNotFound, id)
+	case err == nil:
+		err = json.Unmarshal(data, &e)
+	}
+	return
+}
+
+func (svc service) List(ctx context.Context) (ids []string, err error) {
+	var files []os.DirEntry
+	files, err = os.ReadDir(svc.dir)
+	modTimes := map[string]time.Time{}
+	for _, f := range files {
+		name := f.Name()
+		if f.IsDir() || !strings.HasSuffix(name, fileExt) || strings.HasPrefix(name, filePrefixTmp) {
+			continue
+		}
+		id := strings.TrimSuffix(name, fileExt)
+		var info os.FileInfo
+		info, err = f.Info()
+		if err != nil {
+			break
+		}
+		ids = append(ids, id)
+		modTimes[id] = info.ModTime()
+	}
+	sort.SliceStable(ids, func(i, j int) bool {
+		return modTimes[ids[i]].Before(modTimes[ids[j]])
+	})
+	return
+}
+
+func (svc service) Delete(ctx context.Context, id string) (err error) {
+	err = os.Remove(svc.path(id))
+	if errors.Is(err, os.ErrNotExist) {
+		err = fmt.Errorf("%w: %s", ErrNotFound, id)
+	}
+	return
+}
+
+func (svc service) path(id string) string {
+	return filepath.Join(svc.dir, filepath.Base(id)+fileExt)
+}
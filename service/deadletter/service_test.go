@@ -0,0 +1,74 @@
+package deadletter
+
+import (
+	"context"
+	"github.com/awakari/int-email/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"log/slog"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestService(t *testing.T) {
+	dir := t.TempDir()
+	svc, err := NewService(dir)
+	require.Nil(t, err)
+	svc = NewLogging(svc, slog.Default())
+	ctx := context.TODO()
+
+	id1, err := svc.Put(ctx, Entry{
+		Envelope: model.Envelope{
+			From: "john@example.com",
+		},
+		Raw:   []byte("Subject: one\r\n\r\nbody\r\n"),
+		Error: "failed to parse",
+	})
+	require.Nil(t, err)
+	id2, err := svc.Put(ctx, Entry{
+		Envelope: model.Envelope{
+			From: "jane@example.com",
+		},
+		Raw:   []byte("Subject: two\r\n\r\nbody\r\n"),
+		Error: "failed to write",
+	})
+	require.Nil(t, err)
+	assert.NotEqual(t, id1, id2)
+	// make the order independent of the file system time resolution
+	require.Nil(t, os.Chtimes(svc.(logging).svc.(service).path(id1), time.Time{}, time.Now().Add(-time.Minute)))
+
+	// the same message failed again replaces the entry
+	id1Again, err := svc.Put(ctx, Entry{
+		Envelope: model.Envelope{
+			From: "john@example.com",
+		},
+		Raw:   []byte("Subject: one\r\n\r\nbody\r\n"),
+		Error: "failed to parse again",
+	})
+	require.Nil(t, err)
+	assert.Equal(t, id1, id1Again)
+	require.Nil(t, os.Chtimes(svc.(logging).svc.(service).path(id1), time.Time{}, time.Now().Add(-time.Minute)))
+
+	ids, err := svc.List(ctx)
+	require.Nil(t, err)
+	assert.Equal(t, []string{id1, id2}, ids)
+
+	e, err := svc.Get(ctx, id1)
+	require.Nil(t, err)
+	assert.Equal(t, id1, e.Id)
+	assert.Equal(t, "john@example.com", e.Envelope.From)
+	assert.Equal(t, "Subject: one\r\n\r\nbody\r\n", string(e.Raw))
+	assert.Equal(t, "failed to parse again", e.Error)
+	assert.False(t, e.Time.IsZero())
+
+	err = svc.Delete(ctx, id1)
+	require.Nil(t, err)
+	_, err = svc.Get(ctx, id1)
+	assert.ErrorIs(t, err, ErrNotFound)
+	err = svc.Delete(ctx, id1)
+	assert.ErrorIs(t, err, ErrNotFound)
+	ids, err = svc.List(ctx)
+	require.Nil(t, err)
+	assert.Equal(t, []string{id2}, ids)
+}
@@ -0,0 +1,58 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"github.com/awakari/int-email/model"
+	"github.com/awakari/int-email/service/dedup"
+	"io"
+	"log/slog"
+)
+
+type deduplicating struct {
+	svc   Service
+	store dedup.Store
+	log   *slog.Logger
+}
+
+// NewDedup returns the service accepting the same message only once while the store keeps its key.
+// The duplicate is accepted without the processing, so the sender doesn't retry it.
+func NewDedup(svc Service, store dedup.Store, log *slog.Logger) Service {
+	return deduplicating{
+		svc:   svc,
+		store: store,
+		log:   log,
+	}
+}
+
+func (d deduplicating) Submit(ctx context.Context, env model.Envelope, r io.Reader) (err error) {
+	var raw []byte
+	raw, err = io.ReadAll(r)
+	var key string
+	if err == nil {
+		key = dedup.Key(raw)
+	}
+	var dup bool
+	if key != "" {
+		prev, found, storeErr := d.store.PutIfAbsent(ctx, key, env.CorrelationId)
+		switch {
+		case storeErr != nil:
+			// the duplicates are less harmful than the lost messages
+			d.log.WarnContext(ctx, "dedup: store failure, processing the message", "key", key, "err", storeErr)
+			key = ""
+		case found:
+			d.log.InfoContext(ctx, "dedup: duplicate message dropped", "key", key, "from", env.From, "originalCorrelationId", prev)
+			dup = true
+		}
+	}
+	if err == nil && !dup {
+		err = d.svc.Submit(ctx, env, bytes.NewReader(raw))
+	}
+	if err != nil && key != "" {
+		// let the sender retry
+		if delErr := d.store.Delete(ctx, key); delErr != nil {
+			d.log.WarnContext(ctx, "dedup: store failure, the message retry will be dropped", "key", key, "err", delErr)
+		}
+	}
+	return
+}
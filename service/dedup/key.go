@@ -0,0 +1,52 @@
+package dedup
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/mail"
+	"strings"
+)
+
+// Key returns the deduplication key of the raw message: the hash of the normalized Message-ID and the body.
+// The body is hashed too because some senders reuse the Message-ID for the different messages.
+// The key is empty when the message has no Message-ID.
+func Key(raw []byte) (key string) {
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	var msgId string
+	var body []byte
+	if err == nil {
+		msgId = normalizeMessageId(msg.Header.Get("Message-Id"))
+		body, err = io.ReadAll(msg.Body)
+	}
+	if err == nil && msgId != "" {
+		h := sha256.New()
+		h.Write([]byte(msgId))
+		h.Write([]byte{0})
+		h.Write(normalizeBody(body))
+		key = hex.EncodeToString(h.Sum(nil))
+	}
+	return
+}
+
+// normalizeMessageId strips the angle brackets, the comments and the case: "<ABC@Example.com> (x)" is "abc@example.com".
+func normalizeMessageId(src string) (dst string) {
+	dst = strings.TrimSpace(src)
+	if end := strings.Index(dst, ">"); strings.HasPrefix(dst, "<") && end > 0 {
+		dst = dst[1:end]
+	}
+	dst = strings.ToLower(strings.TrimSpace(dst))
+	return
+}
+
+// normalizeBody removes the differences the relays may introduce: the line endings and the trailing white spaces.
+func normalizeBody(src []byte) (dst []byte) {
+	dst = bytes.ReplaceAll(src, []byte("\r\n"), []byte("\n"))
+	lines := bytes.Split(dst, []byte("\n"))
+	for i, line := range lines {
+		lines[i] = bytes.TrimRight(line, " \t")
+	}
+	dst = bytes.TrimRight(bytes.Join(lines, []byte("\n")), "\n")
+	return
+}
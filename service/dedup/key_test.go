@@ -0,0 +1,53 @@
+package dedup
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestKey(t *testing.T) {
+	msg := "Received: from a by b; Thu, 10 Oct 2024 12:34:56 +0000\r\n" +
+		"Message-ID: <Weekly-42@Example.com>\r\n" +
+		"Subject: Weekly #42\r\n" +
+		"\r\n" +
+		"The top stories.\r\n"
+	key := Key([]byte(msg))
+	assert.Equal(t, 64, len(key))
+	cases := map[string]struct {
+		src  string
+		same bool
+	}{
+		"other relay headers": {
+			src: "Received: from c by d; Thu, 10 Oct 2024 12:35:56 +0000\r\n" +
+				"Message-ID: <Weekly-42@Example.com>\r\n" +
+				"Subject: Weekly #42\r\n" +
+				"\r\n" +
+				"The top stories.\r\n",
+			same: true,
+		},
+		"message id case, comment and line endings": {
+			src: "Message-ID:  <weekly-42@example.com> (resent)\n" +
+				"Subject: Weekly #42\n" +
+				"\n" +
+				"The top stories.  \n\n",
+			same: true,
+		},
+		"other body": {
+			src: "Message-ID: <Weekly-42@Example.com>\r\n" +
+				"\r\n" +
+				"The other stories.\r\n",
+		},
+		"other message id": {
+			src: "Message-ID: <Weekly-43@Example.com>\r\n" +
+				"\r\n" +
+				"The top stories.\r\n",
+		},
+	}
+	for k, c := range cases {
+		t.Run(k, func(t *testing.T) {
+			assert.Equal(t, c.same, key == Key([]byte(c.src)))
+		})
+	}
+	assert.Equal(t, "", Key([]byte("Subject: no id\r\n\r\nbody\r\n")))
+	assert.Equal(t, "", Key(nil))
+}
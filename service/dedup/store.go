@@ -0,0 +1,49 @@
+package dedup
+
+import (
+	"context"
+	"github.com/hashicorp/golang-lru/v2/expirable"
+	"sync"
+	"time"
+)
+
+// Store keeps the keys of the accepted messages for the configured time.
+// A shared store lets the replicas see the messages accepted by each other.
+type Store interface {
+
+	// PutIfAbsent stores the value by the key unless the key is already present. When the key is present, the stored
+	// value is returned with found set. The check and the put should be atomic.
+	PutIfAbsent(ctx context.Context, key, val string) (prev string, found bool, err error)
+
+	// Delete removes the key, so the message is accepted again, e.g. when its processing fails.
+	Delete(ctx context.Context, key string) (err error)
+}
+
+type memStore struct {
+	lock  *sync.Mutex
+	cache *expirable.LRU[string, string]
+}
+
+// NewMemStore returns the in-memory store of the replica, the least recently used keys are evicted when the size is
+// exceeded.
+func NewMemStore(size uint32, ttl time.Duration) Store {
+	return memStore{
+		lock:  &sync.Mutex{},
+		cache: expirable.NewLRU[string, string](int(size), nil, ttl),
+	}
+}
+
+func (m memStore) PutIfAbsent(ctx context.Context, key, val string) (prev string, found bool, err error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	prev, found = m.cache.Get(key)
+	if !found {
+		m.cache.Add(key, val)
+	}
+	return
+}
+
+func (m memStore) Delete(ctx context.Context, key string) (err error) {
+	m.cache.Remove(key)
+	return
+}
@@ -0,0 +1,41 @@
+package dedup
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestMemStore(t *testing.T) {
+	s := NewMemStore(2, time.Minute)
+	prev, found, err := s.PutIfAbsent(context.TODO(), "key1", "session1")
+	require.Nil(t, err)
+	assert.False(t, found)
+	assert.Equal(t, "", prev)
+	prev, found, err = s.PutIfAbsent(context.TODO(), "key1", "session2")
+	require.Nil(t, err)
+	assert.True(t, found)
+	assert.Equal(t, "session1", prev)
+	err = s.Delete(context.TODO(), "key1")
+	require.Nil(t, err)
+	_, found, err = s.PutIfAbsent(context.TODO(), "key1", "session3")
+	require.Nil(t, err)
+	assert.False(t, found)
+	// evicted by the size
+	_, _, _ = s.PutIfAbsent(context.TODO(), "key2", "session4")
+	_, _, _ = s.PutIfAbsent(context.TODO(), "key3", "session5")
+	_, found, err = s.PutIfAbsent(context.TODO(), "key1", "session6")
+	require.Nil(t, err)
+	assert.False(t, found)
+}
+
+func TestMemStore_Ttl(t *testing.T) {
+	s := NewMemStore(10, 10*time.Millisecond)
+	_, found, _ := s.PutIfAbsent(context.TODO(), "key1", "session1")
+	assert.False(t, found)
+	time.Sleep(20 * time.Millisecond)
+	_, found, _ = s.PutIfAbsent(context.TODO(), "key1", "session2")
+	assert.False(t, found)
+}
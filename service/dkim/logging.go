@@ -0,0 +1,25 @@
+package dkim
+
+import (
+	"context"
+	"github.com/awakari/int-email/util"
+	"log/slog"
+)
+
+type logging struct {
+	svc Service
+	log *slog.Logger
+}
+
+func NewLogging(svc Service, log *slog.Logger) Service {
+	return logging{
+		svc: svc,
+		log: log,
+	}
+}
+
+func (l logging) Verify(ctx context.Context, msg []byte) (vs []Verification, err error) {
+	vs, err = l.svc.Verify(ctx, msg)
+	l.log.Log(ctx, util.LogLevel(err), "dkim.Verify", "len", len(msg), "verifications", vs, "err", err)
+	return
+}
@@ -0,0 +1,209 @@
+package dkim
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"github.com/awakari/int-email/service/dns"
+	"github.com/emersion/go-msgauth/dkim"
+	"net/textproto"
+	"slices"
+	"strings"
+)
+
+// Result of a single signature verification, see https://www.rfc-editor.org/rfc/rfc8601#section-2.7.1
+type Result string
+
+const (
+	ResultNone      Result = "none"
+	ResultPass      Result = "pass"
+	ResultFail      Result = "fail"
+	ResultTempError Result = "temperror"
+	ResultPermError Result = "permerror"
+)
+
+type Verification struct {
+	Domain   string
+	Selector string
+	Result   Result
+}
+
+type Service interface {
+	// Verify checks every DKIM-Signature header of the raw message and returns one verification per signature.
+	Verify(ctx context.Context, msg []byte) (vs []Verification, err error)
+}
+
+// KeyLookup resolves the public key records of the signing domain, see https://www.rfc-editor.org/rfc/rfc6376#section-3.6.2
+type KeyLookup interface {
+	LookupKey(ctx context.Context, selector, domain string) (txts []string, err error)
+}
+
+type service struct {
+	keys             KeyLookup
+	verificationsMax int
+}
+
+type dnsKeyLookup struct {
+	resolver dns.Resolver
+}
+
+type ctxKeyVerified struct{}
+
+type verified struct {
+	vs  []Verification
+	err error
+}
+
+const headerSignature = "DKIM-Signature"
+const keyQuerySep = "._domainkey."
+
+func NewService(keys KeyLookup, verificationsMax int) Service {
+	return service{
+		keys:             keys,
+		verificationsMax: verificationsMax,
+	}
+}
+
+// WithVerified returns the context carrying the verification result of the message, so the message is verified once.
+func WithVerified(ctx context.Context, vs []Verification, err error) context.Context {
+	return context.WithValue(ctx, ctxKeyVerified{}, verified{
+		vs:  vs,
+		err: err,
+	})
+}
+
+// Verified returns the verification result from the context, found is false when the message is not verified yet.
+func Verified(ctx context.Context) (vs []Verification, found bool, err error) {
+	var v verified
+	v, found = ctx.Value(ctxKeyVerified{}).(verified)
+	vs, err = v.vs, v.err
+	return
+}
+
+func NewKeyLookup(resolver dns.Resolver) KeyLookup {
+	return dnsKeyLookup{
+		resolver: resolver,
+	}
+}
+
+func (dkl dnsKeyLookup) LookupKey(ctx context.Context, selector, domain string) (txts []string, err error) {
+	txts, err = dkl.resolver.LookupTXT(ctx, selector+keyQuerySep+domain)
+	return
+}
+
+func (svc service) Verify(ctx context.Context, msg []byte) (vs []Verification, err error) {
+	opts := dkim.VerifyOptions{
+		LookupTXT: func(query string) (txts []string, err error) {
+			selector, domain, _ := strings.Cut(query, keyQuerySep)
+			return svc.keys.LookupKey(ctx, selector, domain)
+		},
+		MaxVerifications: svc.verificationsMax,
+	}
+	var verifs []*dkim.Verification
+	verifs, err = dkim.VerifyWithOptions(bytes.NewReader(msg), &opts)
+	if errors.Is(err, dkim.ErrTooManySignatures) {
+		err = nil
+	}
+	if err == nil {
+		sigs := signatures(msg)
+		for _, verif := range verifs {
+			vs = append(vs, Verification{
+				Domain:   verif.Domain,
+				Selector: selectorOf(verif, sigs),
+				Result:   result(verif.Err),
+			})
+		}
+	}
+	return
+}
+
+// Aggregate returns the best result of all verifications.
+func Aggregate(vs []Verification) (r Result) {
+	r = ResultNone
+	for _, v := range vs {
+		switch {
+		case v.Result == ResultPass:
+			r = ResultPass
+			return
+		case r == ResultNone, v.Result == ResultTempError:
+			r = v.Result
+		}
+	}
+	return
+}
+
+func result(err error) (r Result) {
+	switch {
+	case err == nil:
+		r = ResultPass
+	case dkim.IsTempFail(err):
+		r = ResultTempError
+	case dkim.IsPermFail(err):
+		r = ResultPermError
+	default:
+		r = ResultFail
+	}
+	return
+}
+
+// signature is the tags of the signature header identifying the verification of it.
+type signature struct {
+	domain     string
+	identifier string
+	selector   string
+	headerKeys []string
+	// the verification is already matched
+	matched bool
+}
+
+// signatures returns the signature headers tags in the order of appearance.
+func signatures(msg []byte) (sigs []*signature) {
+	h, _ := textproto.NewReader(bufio.NewReader(bytes.NewReader(msg))).ReadMIMEHeader()
+	for _, v := range h.Values(headerSignature) {
+		sig := &signature{}
+		for _, tag := range strings.Split(v, ";") {
+			k, v, _ := strings.Cut(tag, "=")
+			v = strings.Join(strings.Fields(v), "")
+			switch strings.TrimSpace(k) {
+			case "d":
+				sig.domain = v
+			case "i":
+				sig.identifier = v
+			case "s":
+				sig.selector = v
+			case "h":
+				sig.headerKeys = strings.Split(v, ":")
+			}
+		}
+		if sig.identifier == "" {
+			sig.identifier = "@" + sig.domain
+		}
+		sigs = append(sigs, sig)
+	}
+	return
+}
+
+// selectorOf returns the selector of the first not matched signature having the same tags as the verification. The
+// verification of the malformed signature lacks some tags, the missing ones are not compared.
+func selectorOf(verif *dkim.Verification, sigs []*signature) (selector string) {
+	for _, sig := range sigs {
+		if !sig.matched && sig.matches(verif) {
+			sig.matched = true
+			selector = sig.selector
+			break
+		}
+	}
+	return
+}
+
+func (sig *signature) matches(verif *dkim.Verification) (ok bool) {
+	ok = sig.domain == verif.Domain
+	if ok && verif.Identifier != "" {
+		ok = sig.identifier == verif.Identifier
+	}
+	if ok && verif.HeaderKeys != nil {
+		ok = slices.Equal(sig.headerKeys, verif.HeaderKeys)
+	}
+	return
+}
@@ -0,0 +1,215 @@
+package dkim
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"github.com/awakari/int-email/service/dns"
+	"github.com/emersion/go-msgauth/dkim"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+const msg = "From: John Doe <john@example.com>\r\n" +
+	"To: Jane Smith <jane.smith@example.com>\r\n" +
+	"Subject: Meeting Notes\r\n" +
+	"Date: Thu, 10 Oct 2024 12:34:56 +0000\r\n" +
+	"Message-ID: <unique-message-id@example.com>\r\n" +
+	"\r\n" +
+	"Hi Jane,\r\n" +
+	"\r\n" +
+	"Please find attached the meeting notes.\r\n"
+
+func sign(t *testing.T, src, domain, selector string, key ed25519.PrivateKey) string {
+	var dst bytes.Buffer
+	err := dkim.Sign(&dst, strings.NewReader(src), &dkim.SignOptions{
+		Domain:   domain,
+		Selector: selector,
+		Signer:   key,
+	})
+	require.Nil(t, err)
+	return dst.String()
+}
+
+func TestService_Verify(t *testing.T) {
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	require.Nil(t, err)
+	zone := dns.Zone{
+		Txt: map[string][]string{
+			"sel1._domainkey.example.com": {
+				"v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(pub),
+			},
+		},
+		Fail: map[string]bool{
+			"sel1._domainkey.down.example.com": true,
+		},
+	}
+	signed := sign(t, msg, "example.com", "sel1", key)
+	cases := map[string]struct {
+		msg string
+		out []Verification
+	}{
+		"unsigned": {
+			msg: msg,
+		},
+		"pass": {
+			msg: signed,
+			out: []Verification{
+				{
+					Domain:   "example.com",
+					Selector: "sel1",
+					Result:   ResultPass,
+				},
+			},
+		},
+		"body modified": {
+			msg: strings.Replace(signed, "meeting notes", "minutes", 1),
+			out: []Verification{
+				{
+					Domain:   "example.com",
+					Selector: "sel1",
+					Result:   ResultFail,
+				},
+			},
+		},
+		"no key": {
+			msg: sign(t, msg, "example.com", "sel2", key),
+			out: []Verification{
+				{
+					Domain:   "example.com",
+					Selector: "sel2",
+					Result:   ResultPermError,
+				},
+			},
+		},
+		"key unavailable": {
+			msg: sign(t, msg, "down.example.com", "sel1", key),
+			out: []Verification{
+				{
+					Domain:   "down.example.com",
+					Selector: "sel1",
+					Result:   ResultTempError,
+				},
+			},
+		},
+		"multiple signatures": {
+			msg: sign(t, signed, "down.example.com", "sel1", key),
+			out: []Verification{
+				{
+					Domain:   "down.example.com",
+					Selector: "sel1",
+					Result:   ResultTempError,
+				},
+				{
+					Domain:   "example.com",
+					Selector: "sel1",
+					Result:   ResultPass,
+				},
+			},
+		},
+	}
+	svc := NewService(NewKeyLookup(zone), 5)
+	svc = NewLogging(svc, slog.Default())
+	for k, c := range cases {
+		t.Run(k, func(t *testing.T) {
+			vs, err := svc.Verify(context.TODO(), []byte(c.msg))
+			assert.Nil(t, err)
+			assert.Equal(t, c.out, vs)
+		})
+	}
+}
+
+func TestAggregate(t *testing.T) {
+	cases := map[string]struct {
+		in  []Verification
+		out Result
+	}{
+		"none": {
+			out: ResultNone,
+		},
+		"pass wins": {
+			in: []Verification{
+				{Result: ResultFail},
+				{Result: ResultTempError},
+				{Result: ResultPass},
+			},
+			out: ResultPass,
+		},
+		"temperror wins over fail": {
+			in: []Verification{
+				{Result: ResultFail},
+				{Result: ResultTempError},
+			},
+			out: ResultTempError,
+		},
+		"first failure": {
+			in: []Verification{
+				{Result: ResultPermError},
+				{Result: ResultFail},
+			},
+			out: ResultPermError,
+		},
+	}
+	for k, c := range cases {
+		t.Run(k, func(t *testing.T) {
+			assert.Equal(t, c.out, Aggregate(c.in))
+		})
+	}
+}
+
+func TestSelectorOf(t *testing.T) {
+	hdrs := "DKIM-Signature: v=1; a=ed25519-sha256; d=example.com; s=sel1; h=from:to; bh=x; b=y\r\n" +
+		"DKIM-Signature: v=1; a=ed25519-sha256; d=example.com; s=sel2; h=from:subject; bh=x; b=y\r\n" +
+		"DKIM-Signature: v=1; a=ed25519-sha256; d=example.com; i=news@example.com; s=sel3; h=from:to; bh=x; b=y\r\n" +
+		"DKIM-Signature: v=1; d=example.org; s=sel4\r\n"
+	cases := map[string]struct {
+		verifs []*dkim.Verification
+		out    []string
+	}{
+		"not in the header order": {
+			verifs: []*dkim.Verification{
+				{Domain: "example.com", Identifier: "news@example.com", HeaderKeys: []string{"from", "to"}},
+				{Domain: "example.com", Identifier: "@example.com", HeaderKeys: []string{"from", "subject"}},
+				{Domain: "example.com", Identifier: "@example.com", HeaderKeys: []string{"from", "to"}},
+			},
+			out: []string{"sel3", "sel2", "sel1"},
+		},
+		"malformed": {
+			verifs: []*dkim.Verification{
+				{Domain: "example.org"},
+				{Domain: "example.com", Identifier: "news@example.com"},
+			},
+			out: []string{"sel4", "sel3"},
+		},
+		"same tags": {
+			verifs: []*dkim.Verification{
+				{Domain: "example.com"},
+				{Domain: "example.com"},
+				{Domain: "example.com"},
+				{Domain: "example.com"},
+			},
+			out: []string{"sel1", "sel2", "sel3", ""},
+		},
+		"unknown": {
+			verifs: []*dkim.Verification{
+				{Domain: "example.net"},
+			},
+			out: []string{""},
+		},
+	}
+	for k, c := range cases {
+		t.Run(k, func(t *testing.T) {
+			sigs := signatures([]byte(hdrs + "\r\n" + msg))
+			var out []string
+			for _, verif := range c.verifs {
+				out = append(out, selectorOf(verif, sigs))
+			}
+			assert.Equal(t, c.out, out)
+		})
+	}
+}
@@ -0,0 +1,32 @@
+package dmarc
+
+import (
+	"context"
+	"github.com/awakari/int-email/util"
+	"log/slog"
+)
+
+type logging struct {
+	svc Service
+	log *slog.Logger
+}
+
+func NewLogging(svc Service, log *slog.Logger) Service {
+	return logging{
+		svc: svc,
+		log: log,
+	}
+}
+
+func (l logging) Evaluate(ctx context.Context, in Input) (v Verdict, err error) {
+	v, err = l.svc.Evaluate(ctx, in)
+	l.log.Log(
+		ctx, util.LogLevel(err), "dmarc.Evaluate",
+		"fromDomain", in.FromDomain,
+		"result", v.Result,
+		"disposition", v.Disposition,
+		"override", v.Override,
+		"err", err,
+	)
+	return
+}
@@ -0,0 +1,191 @@
+package dmarc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/awakari/int-email/service/dns"
+	"github.com/awakari/int-email/service/spf"
+	"github.com/emersion/go-msgauth/dmarc"
+	"golang.org/x/net/publicsuffix"
+	"math/rand/v2"
+	"strings"
+)
+
+// Result of the DMARC evaluation, see https://www.rfc-editor.org/rfc/rfc7489#section-11.2
+type Result string
+
+const (
+	ResultNone      Result = "none"
+	ResultPass      Result = "pass"
+	ResultFail      Result = "fail"
+	ResultTempError Result = "temperror"
+	ResultPermError Result = "permerror"
+)
+
+type Policy string
+
+const (
+	PolicyNone       Policy = "none"
+	PolicyQuarantine Policy = "quarantine"
+	PolicyReject     Policy = "reject"
+)
+
+type Input struct {
+	// FromDomain is the domain of the RFC5322.From header address.
+	FromDomain string
+	SpfResult  spf.Result
+	// SpfDomain is the domain the SPF check has been performed for: MAIL FROM or HELO.
+	SpfDomain string
+	// DkimDomains contains the domains of the successfully verified DKIM signatures.
+	DkimDomains []string
+	// ArcTrusted is true when the message has been relayed by the trusted forwarder with the valid ARC chain.
+	ArcTrusted bool
+}
+
+type Verdict struct {
+	Result Result
+	// Policy is the policy published for the From domain.
+	Policy Policy
+	// Disposition is the policy to apply to the message after the "pct" sampling.
+	Disposition Policy
+	// Override is the reason to not apply the policy, see https://www.rfc-editor.org/rfc/rfc7489#section-6.7
+	Override Override
+}
+
+type Override string
+
+const (
+	OverrideNone             Override = ""
+	OverrideTrustedForwarder Override = "trusted_forwarder"
+)
+
+type Service interface {
+	Evaluate(ctx context.Context, in Input) (v Verdict, err error)
+}
+
+type service struct {
+	resolver dns.Resolver
+	// sample returns the value in the [0, 100) range
+	sample func() int
+}
+
+func NewService(resolver dns.Resolver) Service {
+	return service{
+		resolver: resolver,
+		sample: func() int {
+			return rand.IntN(100)
+		},
+	}
+}
+
+func (svc service) Evaluate(ctx context.Context, in Input) (v Verdict, err error) {
+	v.Result = ResultNone
+	v.Policy = PolicyNone
+	v.Disposition = PolicyNone
+	fromDomain := strings.ToLower(in.FromDomain)
+	if fromDomain == "" {
+		return
+	}
+	var rec *dmarc.Record
+	var subDomain bool
+	rec, subDomain, err = svc.lookup(ctx, fromDomain)
+	switch {
+	case errors.Is(err, dmarc.ErrNoPolicy):
+		err = nil
+	case dmarc.IsTempFail(err):
+		v.Result = ResultTempError
+	case err != nil:
+		v.Result = ResultPermError
+	default:
+		v.Policy = Policy(rec.Policy)
+		if subDomain && rec.SubdomainPolicy != "" {
+			v.Policy = Policy(rec.SubdomainPolicy)
+		}
+		switch {
+		case in.SpfResult == spf.ResultPass && aligned(fromDomain, in.SpfDomain, rec.SPFAlignment):
+			v.Result = ResultPass
+		case alignedAny(fromDomain, in.DkimDomains, rec.DKIMAlignment):
+			v.Result = ResultPass
+		default:
+			v.Result = ResultFail
+			v.Disposition = v.Policy
+			switch {
+			case in.ArcTrusted:
+				v.Disposition = PolicyNone
+				v.Override = OverrideTrustedForwarder
+			case rec.Percent != nil && svc.sample() >= *rec.Percent:
+				v.Disposition = downgrade(v.Policy)
+			}
+		}
+	}
+	return
+}
+
+// lookup returns the DMARC record of the From domain or falls back to the organizational domain record,
+// see https://www.rfc-editor.org/rfc/rfc7489#section-6.6.3
+func (svc service) lookup(ctx context.Context, fromDomain string) (rec *dmarc.Record, subDomain bool, err error) {
+	opts := dmarc.LookupOptions{
+		LookupTXT: func(domain string) ([]string, error) {
+			return svc.resolver.LookupTXT(ctx, domain)
+		},
+	}
+	rec, err = dmarc.LookupWithOptions(fromDomain, &opts)
+	if errors.Is(err, dmarc.ErrNoPolicy) {
+		orgDomain := organizationalDomain(fromDomain)
+		if orgDomain != fromDomain {
+			rec, err = dmarc.LookupWithOptions(orgDomain, &opts)
+			subDomain = true
+		}
+	}
+	if err != nil && !errors.Is(err, dmarc.ErrNoPolicy) && !dmarc.IsTempFail(err) {
+		err = fmt.Errorf("invalid DMARC record for %s: %w", fromDomain, err)
+	}
+	return
+}
+
+// Aligned returns true when any of the authenticated domains is aligned with the From domain in the relaxed mode.
+func Aligned(fromDomain string, authDomains []string) bool {
+	return alignedAny(strings.ToLower(fromDomain), authDomains, dmarc.AlignmentRelaxed)
+}
+
+func aligned(fromDomain, authDomain string, mode dmarc.AlignmentMode) (ok bool) {
+	authDomain = strings.ToLower(authDomain)
+	switch mode {
+	case dmarc.AlignmentStrict:
+		ok = authDomain == fromDomain
+	default:
+		ok = authDomain != "" && organizationalDomain(authDomain) == organizationalDomain(fromDomain)
+	}
+	return
+}
+
+func alignedAny(fromDomain string, authDomains []string, mode dmarc.AlignmentMode) (ok bool) {
+	for _, authDomain := range authDomains {
+		if aligned(fromDomain, authDomain, mode) {
+			ok = true
+			break
+		}
+	}
+	return
+}
+
+func organizationalDomain(domain string) (orgDomain string) {
+	var err error
+	orgDomain, err = publicsuffix.EffectiveTLDPlusOne(domain)
+	if err != nil {
+		orgDomain = domain
+	}
+	return
+}
+
+// downgrade returns the next less strict policy, see https://www.rfc-editor.org/rfc/rfc7489#section-6.6.4
+func downgrade(src Policy) (dst Policy) {
+	switch src {
+	case PolicyReject:
+		dst = PolicyQuarantine
+	default:
+		dst = PolicyNone
+	}
+	return
+}
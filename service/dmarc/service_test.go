@@ -0,0 +1,195 @@
+package dmarc
+
+import (
+	"context"
+	"github.com/awakari/int-email/service/dns"
+	"github.com/awakari/int-email/service/spf"
+	"github.com/stretchr/testify/assert"
+	"log/slog"
+	"testing"
+)
+
+func TestService_Evaluate(t *testing.T) {
+	zone := dns.Zone{
+		Txt: map[string][]string{
+			"_dmarc.example.com": {
+				"v=DMARC1; p=reject; sp=quarantine",
+			},
+			"_dmarc.strict.example.org": {
+				"v=DMARC1; p=quarantine; aspf=s; adkim=s",
+			},
+			"_dmarc.sampled.example.org": {
+				"v=DMARC1; p=reject; pct=10",
+			},
+			"_dmarc.monitor.example.org": {
+				"v=DMARC1; p=none",
+			},
+			"_dmarc.broken.example.org": {
+				"v=DMARC1; p=everything",
+			},
+		},
+		Fail: map[string]bool{
+			"_dmarc.down.example.org": true,
+		},
+	}
+	cases := map[string]struct {
+		in  Input
+		out Verdict
+		err bool
+	}{
+		"no from domain": {
+			out: Verdict{
+				Result:      ResultNone,
+				Policy:      PolicyNone,
+				Disposition: PolicyNone,
+			},
+		},
+		"no record": {
+			in: Input{
+				FromDomain: "example.net",
+			},
+			out: Verdict{
+				Result:      ResultNone,
+				Policy:      PolicyNone,
+				Disposition: PolicyNone,
+			},
+		},
+		"spf relaxed alignment": {
+			in: Input{
+				FromDomain: "example.com",
+				SpfResult:  spf.ResultPass,
+				SpfDomain:  "bounce.example.com",
+			},
+			out: Verdict{
+				Result:      ResultPass,
+				Policy:      PolicyReject,
+				Disposition: PolicyNone,
+			},
+		},
+		"spf aligned but not passed": {
+			in: Input{
+				FromDomain: "example.com",
+				SpfResult:  spf.ResultSoftFail,
+				SpfDomain:  "example.com",
+			},
+			out: Verdict{
+				Result:      ResultFail,
+				Policy:      PolicyReject,
+				Disposition: PolicyReject,
+			},
+		},
+		"trusted forwarder": {
+			in: Input{
+				FromDomain: "example.com",
+				SpfResult:  spf.ResultPass,
+				SpfDomain:  "lists.example.org",
+				ArcTrusted: true,
+			},
+			out: Verdict{
+				Result:      ResultFail,
+				Policy:      PolicyReject,
+				Disposition: PolicyNone,
+				Override:    OverrideTrustedForwarder,
+			},
+		},
+		"dkim relaxed alignment": {
+			in: Input{
+				FromDomain: "Example.COM",
+				SpfResult:  spf.ResultPass,
+				SpfDomain:  "esp.example.net",
+				DkimDomains: []string{
+					"esp.example.net",
+					"mail.example.com",
+				},
+			},
+			out: Verdict{
+				Result:      ResultPass,
+				Policy:      PolicyReject,
+				Disposition: PolicyNone,
+			},
+		},
+		"strict alignment": {
+			in: Input{
+				FromDomain: "strict.example.org",
+				SpfResult:  spf.ResultPass,
+				SpfDomain:  "bounce.strict.example.org",
+				DkimDomains: []string{
+					"example.org",
+				},
+			},
+			out: Verdict{
+				Result:      ResultFail,
+				Policy:      PolicyQuarantine,
+				Disposition: PolicyQuarantine,
+			},
+		},
+		"subdomain policy": {
+			in: Input{
+				FromDomain: "news.example.com",
+				SpfResult:  spf.ResultPass,
+				SpfDomain:  "esp.example.net",
+			},
+			out: Verdict{
+				Result:      ResultFail,
+				Policy:      PolicyQuarantine,
+				Disposition: PolicyQuarantine,
+			},
+		},
+		"not sampled": {
+			in: Input{
+				FromDomain: "sampled.example.org",
+			},
+			out: Verdict{
+				Result:      ResultFail,
+				Policy:      PolicyReject,
+				Disposition: PolicyQuarantine,
+			},
+		},
+		"monitor only": {
+			in: Input{
+				FromDomain: "monitor.example.org",
+			},
+			out: Verdict{
+				Result:      ResultFail,
+				Policy:      PolicyNone,
+				Disposition: PolicyNone,
+			},
+		},
+		"temperror": {
+			in: Input{
+				FromDomain: "down.example.org",
+			},
+			out: Verdict{
+				Result:      ResultTempError,
+				Policy:      PolicyNone,
+				Disposition: PolicyNone,
+			},
+			err: true,
+		},
+		"permerror": {
+			in: Input{
+				FromDomain: "broken.example.org",
+			},
+			out: Verdict{
+				Result:      ResultPermError,
+				Policy:      PolicyNone,
+				Disposition: PolicyNone,
+			},
+			err: true,
+		},
+	}
+	var svc Service = service{
+		resolver: zone,
+		sample: func() int {
+			return 50
+		},
+	}
+	svc = NewLogging(svc, slog.Default())
+	for k, c := range cases {
+		t.Run(k, func(t *testing.T) {
+			v, err := svc.Evaluate(context.TODO(), c.in)
+			assert.Equal(t, c.out, v)
+			assert.Equal(t, c.err, err != nil)
+		})
+	}
+}
@@ -0,0 +1,14 @@
+package dns
+
+import (
+	"context"
+	"net"
+)
+
+// Resolver is the subset of the net.Resolver methods used by the sender authentication checks.
+type Resolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+	LookupAddr(ctx context.Context, addr string) (names []string, err error)
+}
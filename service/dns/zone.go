@@ -0,0 +1,56 @@
+package dns
+
+import (
+	"context"
+	"net"
+	"strings"
+)
+
+// Zone is an in-memory Resolver. Names are matched case-insensitively and without the trailing dot.
+type Zone struct {
+	Txt map[string][]string
+	Mx  map[string][]*net.MX
+	Ip  map[string][]net.IPAddr
+	Ptr map[string][]string
+	// Fail contains the names which lookup should fail with a temporary error.
+	Fail map[string]bool
+}
+
+func (z Zone) LookupTXT(ctx context.Context, name string) (txts []string, err error) {
+	return lookup(z, z.Txt, name)
+}
+
+func (z Zone) LookupMX(ctx context.Context, name string) (mxs []*net.MX, err error) {
+	return lookup(z, z.Mx, name)
+}
+
+func (z Zone) LookupIPAddr(ctx context.Context, host string) (addrs []net.IPAddr, err error) {
+	return lookup(z, z.Ip, host)
+}
+
+func (z Zone) LookupAddr(ctx context.Context, addr string) (names []string, err error) {
+	return lookup(z, z.Ptr, addr)
+}
+
+func lookup[T any](z Zone, records map[string][]T, name string) (vals []T, err error) {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	switch {
+	case z.Fail[name]:
+		err = &net.DNSError{
+			Err:         "server misbehaving",
+			Name:        name,
+			IsTemporary: true,
+		}
+	default:
+		var found bool
+		vals, found = records[name]
+		if !found {
+			err = &net.DNSError{
+				Err:        "no such host",
+				Name:       name,
+				IsNotFound: true,
+			}
+		}
+	}
+	return
+}
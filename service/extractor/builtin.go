@@ -0,0 +1,110 @@
+package extractor
+
+import (
+	"github.com/PuerkitoBio/goquery"
+	"strings"
+)
+
+// link takes the object url from the first link found in the document.
+type link struct {
+	name  string
+	match Match
+	find  func(doc *goquery.Document) *goquery.Selection
+	// trunc drops the url query, e.g. the tracking parameters
+	trunc bool
+	// fallback applies only when the object url is not known yet
+	fallback bool
+}
+
+// Builtin returns the extractors for the known publishers in the order to register.
+func Builtin() []Extractor {
+	return []Extractor{
+		link{
+			name: "ghost",
+			match: Match{
+				Selectors: []string{
+					"a.post-title-link",
+				},
+			},
+			find: func(doc *goquery.Document) *goquery.Selection {
+				return doc.Find("a.post-title-link")
+			},
+			trunc: true,
+		},
+		link{
+			name: "govdelivery",
+			match: Match{
+				Selectors: []string{
+					`a[href*="govdelivery.com"]`,
+				},
+			},
+			find: func(doc *goquery.Document) *goquery.Selection {
+				return doc.Find(`a[href*="govdelivery.com"]`)
+			},
+		},
+		link{
+			name: "quora",
+			match: Match{
+				Selectors: []string{
+					"td.answer_details a",
+				},
+			},
+			find: func(doc *goquery.Document) *goquery.Selection {
+				return doc.Find("td.answer_details").Find("a")
+			},
+		},
+		link{
+			name: "substack",
+			match: Match{
+				Selectors: []string{
+					"a.email-button-outline",
+				},
+			},
+			find: func(doc *goquery.Document) *goquery.Selection {
+				return doc.Find("a.email-button-outline")
+			},
+			trunc:    true,
+			fallback: true,
+		},
+		link{
+			name: "viewinbrowser",
+			find: func(doc *goquery.Document) *goquery.Selection {
+				return doc.
+					Find("a").
+					FilterFunction(func(i int, s *goquery.Selection) bool {
+						return strings.TrimSpace(strings.ToLower(s.Text())) == "view in browser"
+					})
+			},
+			trunc: true,
+		},
+	}
+}
+
+func (l link) Name() string {
+	return l.name
+}
+
+func (l link) Match() Match {
+	return l.match
+}
+
+func (l link) Extract(in Input, dst map[string]string) {
+	if l.fallback && dst[KeyObjectUrl] != "" {
+		return
+	}
+	if u := Href(l.find(in.Doc).First(), l.trunc); u != "" {
+		dst[KeyObjectUrl] = u
+	}
+	return
+}
+
+// Href returns the link target of the first selected node, optionally without the query.
+func Href(s *goquery.Selection, trunc bool) (u string) {
+	u, _ = s.First().Attr("href")
+	if trunc {
+		if end := strings.Index(u, "?"); end > 0 {
+			u = u[:end]
+		}
+	}
+	return
+}
@@ -0,0 +1,108 @@
+package extractor
+
+import (
+	"fmt"
+	"github.com/PuerkitoBio/goquery"
+	"net/mail"
+	"net/textproto"
+	"regexp"
+	"strings"
+)
+
+// The attribute keys an extractor may set.
+const (
+	KeyObjectUrl = "objecturl"
+	KeyTitle     = "title"
+	KeyAuthor    = "author"
+	KeyImage     = "image"
+	KeySummary   = "summary"
+)
+
+// Input is the message to extract the publisher specific attributes from.
+type Input struct {
+	Header     textproto.MIMEHeader
+	FromDomain string
+	Doc        *goquery.Document
+	// Unwrap resolves the tracking link to the link target, the link is kept as is when nil.
+	Unwrap func(u string) string
+}
+
+// Match declares when the extractor applies: any of the non-empty conditions is enough.
+// The empty Match applies to every message.
+type Match struct {
+	// FromDomains match the From header domain or any of its parent domains.
+	FromDomains []string `json:"fromDomains,omitempty" yaml:"fromDomains,omitempty"`
+	// ListIds match the List-Id header substring.
+	ListIds []string `json:"listIds,omitempty" yaml:"listIds,omitempty"`
+	// Mailers match the X-Mailer header substring, case-insensitive.
+	Mailers []string `json:"mailers,omitempty" yaml:"mailers,omitempty"`
+	// Selectors are the DOM markers: the CSS selectors present in the HTML body.
+	Selectors []string `json:"selectors,omitempty" yaml:"selectors,omitempty"`
+	// Headers match the header values by the regular expressions.
+	Headers map[string]*regexp.Regexp `json:"-" yaml:"-"`
+}
+
+type Extractor interface {
+
+	// Name identifies the extractor in the logs and tests.
+	Name() string
+
+	Match() Match
+
+	// Extract sets the attributes found in the input to dst, e.g. KeyObjectUrl.
+	// The dst contains the attributes set before, including the ones set by the preceding extractors.
+	Extract(in Input, dst map[string]string)
+}
+
+func NewInput(header textproto.MIMEHeader, html string) (in Input, err error) {
+	in.Header = header
+	if header == nil {
+		in.Header = textproto.MIMEHeader{}
+	}
+	// the From header is not required to extract anything
+	if from, fromErr := mail.ParseAddress(in.Header.Get("From")); fromErr == nil {
+		in.FromDomain = strings.ToLower(from.Address[strings.LastIndex(from.Address, "@")+1:])
+	}
+	in.Doc, err = goquery.NewDocumentFromReader(strings.NewReader(html))
+	if err != nil {
+		err = fmt.Errorf("failed to parse html: %w", err)
+	}
+	return
+}
+
+func (m Match) Applies(in Input) (ok bool) {
+	if len(m.FromDomains) == 0 && len(m.ListIds) == 0 && len(m.Mailers) == 0 && len(m.Selectors) == 0 && len(m.Headers) == 0 {
+		return true
+	}
+	for _, d := range m.FromDomains {
+		d = strings.ToLower(d)
+		if in.FromDomain == d || strings.HasSuffix(in.FromDomain, "."+d) {
+			return true
+		}
+	}
+	listId := in.Header.Get("List-Id")
+	for _, id := range m.ListIds {
+		if listId != "" && strings.Contains(listId, id) {
+			return true
+		}
+	}
+	mailer := strings.ToLower(in.Header.Get("X-Mailer"))
+	for _, name := range m.Mailers {
+		if mailer != "" && strings.Contains(mailer, strings.ToLower(name)) {
+			return true
+		}
+	}
+	for _, sel := range m.Selectors {
+		if in.Doc != nil && in.Doc.Find(sel).Length() > 0 {
+			return true
+		}
+	}
+	for k, re := range m.Headers {
+		for _, v := range in.Header.Values(k) {
+			if re.MatchString(v) {
+				return true
+			}
+		}
+	}
+	return
+}
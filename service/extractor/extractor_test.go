@@ -0,0 +1,128 @@
+package extractor
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"github.com/PuerkitoBio/goquery"
+	"github.com/jhillyerd/enmime"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "update the golden files")
+
+func readInput(t *testing.T, path string) (in Input) {
+	f, err := os.Open(path)
+	require.Nil(t, err)
+	defer f.Close()
+	e, err := enmime.ReadEnvelope(f)
+	require.Nil(t, err)
+	in, err = NewInput(e.Root.Header, e.HTML)
+	require.Nil(t, err)
+	return
+}
+
+// TestBuiltin_Golden runs every builtin extractor against own testdata/<name>.eml
+// and compares the attributes with testdata/<name>.golden.json. Run with -update to regenerate.
+func TestBuiltin_Golden(t *testing.T) {
+	for _, e := range Builtin() {
+		t.Run(e.Name(), func(t *testing.T) {
+			in := readInput(t, filepath.Join("testdata", e.Name()+".eml"))
+			require.True(t, e.Match().Applies(in))
+			attrs := map[string]string{}
+			e.Extract(in, attrs)
+			golden := filepath.Join("testdata", e.Name()+".golden.json")
+			if *update {
+				buf := &bytes.Buffer{}
+				enc := json.NewEncoder(buf)
+				enc.SetEscapeHTML(false)
+				enc.SetIndent("", "  ")
+				require.Nil(t, enc.Encode(attrs))
+				require.Nil(t, os.WriteFile(golden, buf.Bytes(), 0o644))
+			}
+			data, err := os.ReadFile(golden)
+			require.Nil(t, err)
+			var expected map[string]string
+			require.Nil(t, json.Unmarshal(data, &expected))
+			assert.Equal(t, expected, attrs)
+		})
+	}
+}
+
+func TestMatch_Applies(t *testing.T) {
+	in, err := NewInput(
+		textproto.MIMEHeader{
+			"From":     {"Jane <jane@news.example.com>"},
+			"List-Id":  {"Example News <news.example.com>"},
+			"X-Mailer": {"MailChimp Mailer - **CID1234**"},
+		},
+		`<html><body><div class="mcnPreviewText">preview</div></body></html>`,
+	)
+	require.Nil(t, err)
+	cases := map[string]struct {
+		m  Match
+		ok bool
+	}{
+		"empty matches any": {
+			ok: true,
+		},
+		"from parent domain": {
+			m:  Match{FromDomains: []string{"example.com"}},
+			ok: true,
+		},
+		"from other domain": {
+			m: Match{FromDomains: []string{"ample.com"}},
+		},
+		"list id": {
+			m:  Match{ListIds: []string{"<news.example.com>"}},
+			ok: true,
+		},
+		"mailer": {
+			m:  Match{Mailers: []string{"mailchimp"}},
+			ok: true,
+		},
+		"dom marker": {
+			m:  Match{Selectors: []string{"div.mcnPreviewText"}},
+			ok: true,
+		},
+		"none of": {
+			m: Match{
+				FromDomains: []string{"substack.com"},
+				Mailers:     []string{"ghost"},
+				Selectors:   []string{"a.post-title-link"},
+			},
+		},
+	}
+	for k, c := range cases {
+		t.Run(k, func(t *testing.T) {
+			assert.Equal(t, c.ok, c.m.Applies(in))
+		})
+	}
+}
+
+func TestRegistry_Extract(t *testing.T) {
+	r := NewRegistry(Builtin()...)
+	in := readInput(t, filepath.Join("testdata", "substack.eml"))
+	// the object url known before, e.g. from the List-Post header, is kept
+	attrs := map[string]string{
+		KeyObjectUrl: "https://example.substack.com",
+	}
+	applied := r.Extract(in, attrs)
+	assert.Equal(t, []string{"substack", "viewinbrowser"}, applied)
+	assert.Equal(t, "https://example.substack.com", attrs[KeyObjectUrl])
+	// the later extractor overrides
+	r.Register(link{
+		name: "custom",
+		find: func(doc *goquery.Document) *goquery.Selection {
+			return doc.Find("a.email-button-outline")
+		},
+	})
+	applied = r.Extract(in, attrs)
+	assert.Equal(t, []string{"substack", "viewinbrowser", "custom"}, applied)
+	assert.Equal(t, "https://example.substack.com/p/a-new-post?utm_source=substack&utm_medium=email", attrs[KeyObjectUrl])
+}
@@ -0,0 +1,45 @@
+package extractor
+
+import "sync"
+
+// Registry keeps the extractors in the order of the registration.
+type Registry interface {
+
+	// Register appends the extractor, it runs after the ones registered before.
+	Register(e Extractor)
+
+	// Extract runs every applicable extractor in the order of the registration,
+	// so the attribute set by the earlier extractor may be overridden by the later one.
+	// Returns the names of the applied extractors.
+	Extract(in Input, dst map[string]string) (applied []string)
+}
+
+type registry struct {
+	lock       *sync.RWMutex
+	extractors []Extractor
+}
+
+func NewRegistry(extractors ...Extractor) Registry {
+	return &registry{
+		lock:       &sync.RWMutex{},
+		extractors: extractors,
+	}
+}
+
+func (r *registry) Register(e Extractor) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.extractors = append(r.extractors, e)
+}
+
+func (r *registry) Extract(in Input, dst map[string]string) (applied []string) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	for _, e := range r.extractors {
+		if e.Match().Applies(in) {
+			e.Extract(in, dst)
+			applied = append(applied, e.Name())
+		}
+	}
+	return
+}
@@ -0,0 +1,335 @@
+package extractor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/andybalholm/cascadia"
+	"github.com/awakari/int-email/model"
+	"gopkg.in/yaml.v3"
+	"log/slog"
+	"net/url"
+	"os"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RulesFile is the format of the declarative rules file. YAML is expected, JSON is accepted as well.
+type RulesFile struct {
+	Rules []Rule `yaml:"rules"`
+}
+
+type Rule struct {
+	Name  string    `yaml:"name"`
+	Match RuleMatch `yaml:"match"`
+	// Attributes describe how to get the attribute value by the attribute key, e.g. "objecturl" or "title".
+	Attributes map[string]RuleAttribute `yaml:"attributes"`
+}
+
+// RuleMatch is the rule condition, any of the non-empty conditions is enough. The empty one matches every message.
+type RuleMatch struct {
+	FromDomains []string `yaml:"fromDomains"`
+	// Headers are the regular expressions to match the header values by the header name.
+	Headers   map[string]string `yaml:"headers"`
+	Selectors []string          `yaml:"selectors"`
+}
+
+type RuleAttribute struct {
+	// Selector is the CSS selector of the element to take the value from, the first element found.
+	Selector string `yaml:"selector"`
+	// Attr is the element attribute to take, e.g. "href", the element text when empty.
+	Attr string `yaml:"attr"`
+	// Header is the message header to take the value from instead of the HTML.
+	Header string `yaml:"header"`
+	// Regex is applied to the value, or to the whole HTML when neither Selector nor Header is set.
+	// The value is the first capturing group if any, otherwise the whole match.
+	Regex string     `yaml:"regex"`
+	Url   UrlOptions `yaml:"url"`
+}
+
+// UrlOptions is the post-processing of the value being an url.
+type UrlOptions struct {
+	// TruncQuery drops the whole query.
+	TruncQuery bool `yaml:"truncQuery"`
+	// DropParams removes the query parameters by name, the trailing "*" matches any suffix, e.g. "utm_*".
+	DropParams []string `yaml:"dropParams"`
+}
+
+// RuleSet is the extractor running the rules loaded from the file. The rules are applied in the file order.
+type RuleSet interface {
+	Extractor
+
+	// Load reads the rules file. The rules loaded before are kept when the file is invalid.
+	Load() (err error)
+
+	// Watch reloads the rules file when it is modified, until the context is done.
+	Watch(ctx context.Context, interval time.Duration)
+}
+
+type ruleSet struct {
+	path     string
+	reserved map[string]bool
+	log      *slog.Logger
+	lock     *sync.RWMutex
+	rules    []rule
+	modTime  time.Time
+	size     int64
+}
+
+type rule struct {
+	name  string
+	match Match
+	attrs []ruleAttr
+}
+
+type ruleAttr struct {
+	RuleAttribute
+	key string
+	re  *regexp.Regexp
+}
+
+var ErrInvalidRules = errors.New("invalid extraction rules")
+
+// reAttrKey is the valid CloudEvents attribute name of the limited length.
+var reAttrKey = regexp.MustCompile(`^[a-z0-9]{1,20}$`)
+
+// NewRuleSet returns the rules loaded from the path. The rules may not set the authentication and the tracing attributes
+// (see model.AttrKeysReserved), neither the additional reserved ones, e.g. the internal message attribute.
+func NewRuleSet(path string, reserved []string, log *slog.Logger) RuleSet {
+	rs := &ruleSet{
+		path:     path,
+		reserved: map[string]bool{},
+		log:      log,
+		lock:     &sync.RWMutex{},
+	}
+	for _, k := range append(slices.Clone(model.AttrKeysReserved), reserved...) {
+		rs.reserved[k] = true
+	}
+	return rs
+}
+
+func (rs *ruleSet) Name() string {
+	return "rules"
+}
+
+func (rs *ruleSet) Match() Match {
+	return Match{}
+}
+
+func (rs *ruleSet) Extract(in Input, dst map[string]string) {
+	rs.lock.RLock()
+	defer rs.lock.RUnlock()
+	for _, r := range rs.rules {
+		if r.match.Applies(in) {
+			r.Extract(in, dst)
+		}
+	}
+	return
+}
+
+func (rs *ruleSet) Load() (err error) {
+	var info os.FileInfo
+	info, err = os.Stat(rs.path)
+	var data []byte
+	if err == nil {
+		data, err = os.ReadFile(rs.path)
+	}
+	var rules []rule
+	if err == nil {
+		rules, err = parseRules(data, rs.reserved)
+	}
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	if info != nil {
+		// don't retry the same invalid file until it is modified
+		rs.modTime, rs.size = info.ModTime(), info.Size()
+	}
+	if err == nil {
+		rs.rules = rules
+	}
+	return
+}
+
+func (rs *ruleSet) Watch(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		if !rs.modified() {
+			continue
+		}
+		switch err := rs.Load(); err {
+		case nil:
+			rs.log.Info("extractor: rules reloaded", "path", rs.path, "count", rs.count())
+		default:
+			rs.log.Error("extractor: failed to reload the rules, keeping the previous ones", "path", rs.path, "err", err)
+		}
+	}
+}
+
+func (rs *ruleSet) modified() bool {
+	info, err := os.Stat(rs.path)
+	rs.lock.RLock()
+	defer rs.lock.RUnlock()
+	return err == nil && (!info.ModTime().Equal(rs.modTime) || info.Size() != rs.size)
+}
+
+func (rs *ruleSet) count() int {
+	rs.lock.RLock()
+	defer rs.lock.RUnlock()
+	return len(rs.rules)
+}
+
+func parseRules(data []byte, reserved map[string]bool) (rules []rule, err error) {
+	var f RulesFile
+	err = yaml.Unmarshal(data, &f)
+	if err != nil {
+		err = fmt.Errorf("%w: %s", ErrInvalidRules, err)
+	}
+	for i := 0; err == nil && i < len(f.Rules); i++ {
+		var r rule
+		r, err = compileRule(f.Rules[i], reserved)
+		if err != nil {
+			err = fmt.Errorf("%w: rule %d %q: %s", ErrInvalidRules, i, f.Rules[i].Name, err)
+		}
+		rules = append(rules, r)
+	}
+	return
+}
+
+func compileRule(src Rule, reserved map[string]bool) (r rule, err error) {
+	r.name = src.Name
+	r.match.FromDomains = src.Match.FromDomains
+	r.match.Selectors = src.Match.Selectors
+	for _, sel := range src.Match.Selectors {
+		if _, err = cascadia.Compile(sel); err != nil {
+			return
+		}
+	}
+	if len(src.Match.Headers) > 0 {
+		r.match.Headers = map[string]*regexp.Regexp{}
+	}
+	for k, expr := range src.Match.Headers {
+		if r.match.Headers[k], err = regexp.Compile(expr); err != nil {
+			return
+		}
+	}
+	if len(src.Attributes) == 0 {
+		err = errors.New("no attributes")
+		return
+	}
+	for k, a := range src.Attributes {
+		switch {
+		case !reAttrKey.MatchString(k):
+			err = fmt.Errorf("attribute %q: invalid key, should be %s", k, reAttrKey)
+			return
+		case reserved[k]:
+			err = fmt.Errorf("attribute %s: reserved key", k)
+			return
+		}
+		ra := ruleAttr{
+			RuleAttribute: a,
+			key:           k,
+		}
+		if a.Selector != "" {
+			if _, err = cascadia.Compile(a.Selector); err != nil {
+				return
+			}
+		}
+		if a.Regex != "" {
+			if ra.re, err = regexp.Compile(a.Regex); err != nil {
+				return
+			}
+		}
+		if a.Selector == "" && a.Header == "" && a.Regex == "" {
+			err = fmt.Errorf("attribute %s: no selector, header or regex", k)
+			return
+		}
+		r.attrs = append(r.attrs, ra)
+	}
+	// apply in the stable order
+	sort.Slice(r.attrs, func(i, j int) bool {
+		return r.attrs[i].key < r.attrs[j].key
+	})
+	return
+}
+
+func (r rule) Extract(in Input, dst map[string]string) {
+	for _, a := range r.attrs {
+		if v := a.value(in); v != "" {
+			dst[a.key] = v
+		}
+	}
+	return
+}
+
+func (a ruleAttr) value(in Input) (v string) {
+	switch {
+	case a.Header != "":
+		v = in.Header.Get(a.Header)
+	case a.Selector != "":
+		s := in.Doc.Find(a.Selector).First()
+		switch a.Attr {
+		case "":
+			v = s.Text()
+		default:
+			v, _ = s.Attr(a.Attr)
+		}
+	default:
+		v, _ = in.Doc.Html()
+	}
+	if a.re != nil {
+		m := a.re.FindStringSubmatch(v)
+		switch len(m) {
+		case 0:
+			v = ""
+		case 1:
+			v = m[0]
+		default:
+			v = m[1]
+		}
+	}
+	v = strings.TrimSpace(v)
+	// the tracking link query is the link target, unwrap before dropping anything from it
+	if v != "" && a.key == KeyObjectUrl && in.Unwrap != nil {
+		v = in.Unwrap(v)
+	}
+	if v != "" && (a.Url.TruncQuery || len(a.Url.DropParams) > 0) {
+		v = a.Url.apply(v)
+	}
+	return
+}
+
+func (o UrlOptions) apply(src string) (dst string) {
+	dst = src
+	if o.TruncQuery {
+		if end := strings.Index(dst, "?"); end > 0 {
+			dst = dst[:end]
+		}
+		return
+	}
+	u, err := url.Parse(src)
+	if err != nil {
+		return
+	}
+	q := u.Query()
+	for k := range q {
+		for _, p := range o.DropParams {
+			prefix, wildcard := strings.CutSuffix(p, "*")
+			if k == p || (wildcard && strings.HasPrefix(k, prefix)) {
+				q.Del(k)
+			}
+		}
+	}
+	u.RawQuery = q.Encode()
+	dst = u.String()
+	return
+}
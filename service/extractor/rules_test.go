@@ -0,0 +1,132 @@
+package extractor
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRuleSet_Extract(t *testing.T) {
+	rs := NewRuleSet(filepath.Join("testdata", "rules.yaml"), []string{"awkinternal"}, slog.Default())
+	require.Nil(t, rs.Load())
+	in := readInput(t, filepath.Join("testdata", "ghost.eml"))
+	attrs := map[string]string{}
+	rs.Extract(in, attrs)
+	assert.Equal(t, map[string]string{
+		KeyObjectUrl: "https://weekly.example.com/issue-42/",
+		KeyTitle:     "Issue 42",
+		KeyAuthor:    "The Weekly",
+	}, attrs)
+	// the url options apply to the unwrapped link
+	in.Unwrap = func(u string) string {
+		return "https://weekly.example.com/issue-43/?utm_medium=email&id=43"
+	}
+	attrs = map[string]string{}
+	rs.Extract(in, attrs)
+	assert.Equal(t, "https://weekly.example.com/issue-43/?id=43", attrs[KeyObjectUrl])
+	// not matching
+	in = readInput(t, filepath.Join("testdata", "quora.eml"))
+	attrs = map[string]string{}
+	rs.Extract(in, attrs)
+	assert.Empty(t, attrs)
+}
+
+func TestParseRules(t *testing.T) {
+	cases := map[string]struct {
+		src string
+		err error
+	}{
+		"json": {
+			src: `{"rules": [{"name": "json", "match": {"fromDomains": ["example.com"]}, "attributes": {"summary": {"regex": "<p>(.+?)</p>"}}}]}`,
+		},
+		"empty": {},
+		"invalid syntax": {
+			src: "rules: [",
+			err: ErrInvalidRules,
+		},
+		"invalid regex": {
+			src: `{"rules": [{"name": "re", "attributes": {"title": {"regex": "("}}}]}`,
+			err: ErrInvalidRules,
+		},
+		"invalid selector": {
+			src: `{"rules": [{"name": "sel", "attributes": {"title": {"selector": "a[href"}}}]}`,
+			err: ErrInvalidRules,
+		},
+		"no attributes": {
+			src: `{"rules": [{"name": "none"}]}`,
+			err: ErrInvalidRules,
+		},
+		"invalid key": {
+			src: `{"rules": [{"name": "key", "attributes": {"Post-Title": {"selector": "h1"}}}]}`,
+			err: ErrInvalidRules,
+		},
+		"too long key": {
+			src: `{"rules": [{"name": "key", "attributes": {"titleofthepostinthebody": {"selector": "h1"}}}]}`,
+			err: ErrInvalidRules,
+		},
+		"reserved key": {
+			src: `{"rules": [{"name": "key", "attributes": {"dkim": {"regex": "pass"}}}]}`,
+			err: ErrInvalidRules,
+		},
+		"object url": {
+			src: `{"rules": [{"name": "key", "attributes": {"objecturl": {"selector": "a", "attr": "href"}}}]}`,
+		},
+		"reserved correlation id": {
+			src: `{"rules": [{"name": "key", "attributes": {"correlationid": {"header": "Message-Id"}}}]}`,
+			err: ErrInvalidRules,
+		},
+		"additional reserved key": {
+			src: `{"rules": [{"name": "key", "attributes": {"awkinternal": {"regex": "1"}}}]}`,
+			err: ErrInvalidRules,
+		},
+		"any valid key among invalid fails": {
+			src: `{"rules": [{"name": "key", "attributes": {"title": {"selector": "h1"}, "spf": {"regex": "pass"}}}]}`,
+			err: ErrInvalidRules,
+		},
+	}
+	reserved := NewRuleSet("", []string{"awkinternal"}, slog.Default()).(*ruleSet).reserved
+	for k, c := range cases {
+		t.Run(k, func(t *testing.T) {
+			_, err := parseRules([]byte(c.src), reserved)
+			assert.ErrorIs(t, err, c.err)
+		})
+	}
+}
+
+func TestUrlOptions_apply(t *testing.T) {
+	src := "https://example.com/post?id=1&utm_source=email&utm_medium=newsletter&ref=x"
+	assert.Equal(t, "https://example.com/post", UrlOptions{TruncQuery: true}.apply(src))
+	assert.Equal(t, "https://example.com/post?id=1", UrlOptions{DropParams: []string{"utm_*", "ref"}}.apply(src))
+}
+
+func TestRuleSet_Watch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.yaml")
+	require.Nil(t, os.WriteFile(path, []byte("rules: []\n"), 0o644))
+	rs := NewRuleSet(path, nil, slog.Default())
+	require.Nil(t, rs.Load())
+	in := readInput(t, filepath.Join("testdata", "ghost.eml"))
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+	go rs.Watch(ctx, 10*time.Millisecond)
+
+	data, err := os.ReadFile(filepath.Join("testdata", "rules.yaml"))
+	require.Nil(t, err)
+	require.Nil(t, os.WriteFile(path, data, 0o644))
+	assert.Eventually(t, func() bool {
+		attrs := map[string]string{}
+		rs.Extract(in, attrs)
+		return attrs[KeyTitle] == "Issue 42"
+	}, time.Second, 10*time.Millisecond)
+
+	// the invalid file doesn't replace the loaded rules
+	require.Nil(t, os.WriteFile(path, []byte("rules: ["), 0o644))
+	time.Sleep(50 * time.Millisecond)
+	attrs := map[string]string{}
+	rs.Extract(in, attrs)
+	assert.Equal(t, "Issue 42", attrs[KeyTitle])
+}
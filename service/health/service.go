@@ -0,0 +1,178 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Check returns nil when the checked component is healthy.
+type Check func(ctx context.Context) (err error)
+
+type Status struct {
+	Live  bool `json:"live"`
+	Ready bool `json:"ready"`
+	// Checks contains the result of every check: "ok" or the error text.
+	Checks     map[string]string `json:"checks"`
+	SpoolDepth int               `json:"spoolDepth"`
+	// Errors contains the error rate per the pipeline stage since the start.
+	Errors map[string]ErrorRate `json:"errors"`
+}
+
+type ErrorRate struct {
+	Total  uint64  `json:"total"`
+	Errors uint64  `json:"errors"`
+	Ratio  float64 `json:"ratio"`
+}
+
+type Service interface {
+
+	// Live returns nil when the process is able to serve, otherwise it should be restarted.
+	Live(ctx context.Context) (err error)
+
+	// Ready returns nil when the process is able to accept and deliver the messages.
+	Ready(ctx context.Context) (err error)
+
+	// Status returns the detailed status.
+	Status(ctx context.Context) (s Status)
+}
+
+// Counter describes the metric counting the results by the "result" label.
+type Counter struct {
+	Name string
+	// Success contains the "result" label values those are not errors.
+	Success []string
+}
+
+type service struct {
+	liveness   map[string]Check
+	readiness  map[string]Check
+	spoolDepth func() (int, error)
+	gatherer   prometheus.Gatherer
+	counters   map[string]Counter
+}
+
+func NewService(liveness, readiness map[string]Check, spoolDepth func() (int, error), gatherer prometheus.Gatherer, counters map[string]Counter) Service {
+	return service{
+		liveness:   liveness,
+		readiness:  readiness,
+		spoolDepth: spoolDepth,
+		gatherer:   gatherer,
+		counters:   counters,
+	}
+}
+
+func (svc service) Live(ctx context.Context) (err error) {
+	_, err = run(ctx, svc.liveness)
+	return
+}
+
+func (svc service) Ready(ctx context.Context) (err error) {
+	_, err = run(ctx, svc.readiness)
+	return
+}
+
+func (svc service) Status(ctx context.Context) (s Status) {
+	s.Checks = map[string]string{}
+	var results map[string]error
+	var err error
+	results, err = run(ctx, svc.liveness)
+	s.Live = err == nil
+	for name, r := range results {
+		s.Checks[name] = result(r)
+	}
+	results, err = run(ctx, svc.readiness)
+	s.Ready = s.Live && err == nil
+	for name, r := range results {
+		s.Checks[name] = result(r)
+	}
+	s.SpoolDepth, err = svc.spoolDepth()
+	if err != nil {
+		s.Checks["spool"] = err.Error()
+	}
+	s.Errors = svc.errorRates()
+	return
+}
+
+func (svc service) errorRates() (rates map[string]ErrorRate) {
+	rates = map[string]ErrorRate{}
+	families, _ := svc.gatherer.Gather()
+	for stage, c := range svc.counters {
+		var rate ErrorRate
+		for _, f := range families {
+			if f.GetName() != c.Name {
+				continue
+			}
+			for _, m := range f.GetMetric() {
+				n := uint64(m.GetCounter().GetValue())
+				rate.Total += n
+				if !success(m.GetLabel(), c.Success) {
+					rate.Errors += n
+				}
+			}
+		}
+		if rate.Total > 0 {
+			rate.Ratio = float64(rate.Errors) / float64(rate.Total)
+		}
+		rates[stage] = rate
+	}
+	return
+}
+
+// Cached returns the check which reuses the last result of the check until the ttl expires.
+// Useful for the expensive checks, e.g. connecting to the upstream.
+func Cached(check Check, ttl time.Duration) Check {
+	var lock sync.Mutex
+	var last time.Time
+	var lastErr error
+	return func(ctx context.Context) (err error) {
+		lock.Lock()
+		defer lock.Unlock()
+		if time.Since(last) >= ttl {
+			lastErr = check(ctx)
+			last = time.Now()
+		}
+		return lastErr
+	}
+}
+
+func run(ctx context.Context, checks map[string]Check) (results map[string]error, err error) {
+	results = map[string]error{}
+	var names []string
+	for name := range checks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		r := checks[name](ctx)
+		results[name] = r
+		if r != nil {
+			err = errors.Join(err, fmt.Errorf("%s: %w", name, r))
+		}
+	}
+	return
+}
+
+func result(err error) (r string) {
+	r = "ok"
+	if err != nil {
+		r = err.Error()
+	}
+	return
+}
+
+func success(labels []*dto.LabelPair, values []string) (ok bool) {
+	for _, l := range labels {
+		if l.GetName() == "result" && slices.Contains(values, l.GetValue()) {
+			ok = true
+			break
+		}
+	}
+	return
+}
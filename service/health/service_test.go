@@ -0,0 +1,115 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestService_Status(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	writes := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "writes_total"}, []string{"result"})
+	reg.MustRegister(writes)
+	writes.WithLabelValues("ok").Add(3)
+	writes.WithLabelValues("temporary").Add(1)
+	ok := func(ctx context.Context) error {
+		return nil
+	}
+	down := func(ctx context.Context) error {
+		return errors.New("unavailable")
+	}
+	cases := map[string]struct {
+		liveness  map[string]Check
+		readiness map[string]Check
+		live      bool
+		ready     bool
+		checks    map[string]string
+	}{
+		"healthy": {
+			liveness: map[string]Check{
+				"smtp": ok,
+			},
+			readiness: map[string]Check{
+				"tls":    ok,
+				"writer": ok,
+			},
+			live:  true,
+			ready: true,
+			checks: map[string]string{
+				"smtp":   "ok",
+				"tls":    "ok",
+				"writer": "ok",
+			},
+		},
+		"upstream down": {
+			liveness: map[string]Check{
+				"smtp": ok,
+			},
+			readiness: map[string]Check{
+				"tls":    ok,
+				"writer": down,
+			},
+			live: true,
+			checks: map[string]string{
+				"smtp":   "ok",
+				"tls":    "ok",
+				"writer": "unavailable",
+			},
+		},
+		"not live is not ready": {
+			liveness: map[string]Check{
+				"smtp": down,
+			},
+			readiness: map[string]Check{
+				"writer": ok,
+			},
+			checks: map[string]string{
+				"smtp":   "unavailable",
+				"writer": "ok",
+			},
+		},
+	}
+	for k, c := range cases {
+		t.Run(k, func(t *testing.T) {
+			svc := NewService(
+				c.liveness,
+				c.readiness,
+				func() (int, error) {
+					return 2, nil
+				},
+				reg,
+				map[string]Counter{
+					"writer": {
+						Name:    "writes_total",
+						Success: []string{"ok"},
+					},
+					"converter": {
+						Name: "converts_total",
+					},
+				},
+			)
+			assert.Equal(t, c.live, svc.Live(context.TODO()) == nil)
+			s := svc.Status(context.TODO())
+			assert.Equal(t, c.live, s.Live)
+			assert.Equal(t, c.ready, s.Ready)
+			assert.Equal(t, c.checks, s.Checks)
+			assert.Equal(t, 2, s.SpoolDepth)
+			assert.Equal(t, ErrorRate{Total: 4, Errors: 1, Ratio: 0.25}, s.Errors["writer"])
+			assert.Equal(t, ErrorRate{}, s.Errors["converter"])
+		})
+	}
+}
+
+func TestCached(t *testing.T) {
+	var calls int
+	check := Cached(func(ctx context.Context) error {
+		calls++
+		return errors.New("unavailable")
+	}, time.Hour)
+	assert.NotNil(t, check(context.TODO()))
+	assert.NotNil(t, check(context.TODO()))
+	assert.Equal(t, 1, calls)
+}
@@ -2,7 +2,7 @@ package service
 
 import (
 	"context"
-	"fmt"
+	"github.com/awakari/int-email/model"
 	"github.com/awakari/int-email/util"
 	"io"
 	"log/slog"
@@ -20,8 +20,8 @@ func NewLogging(svc Service, log *slog.Logger) Service {
 	}
 }
 
-func (l logging) Submit(ctx context.Context, from string, internal bool, r io.Reader) (err error) {
-	err = l.svc.Submit(ctx, from, internal, r)
-	l.log.Log(ctx, util.LogLevel(err), fmt.Sprintf("service.Submit(from=%s, internal=%t): %s", from, internal, err))
+func (l logging) Submit(ctx context.Context, env model.Envelope, r io.Reader) (err error) {
+	err = l.svc.Submit(ctx, env, r)
+	l.log.Log(ctx, util.LogLevel(err), "service.Submit", "from", env.From, "internal", env.Internal, "spf", env.SpfResult, "err", err)
 	return
 }
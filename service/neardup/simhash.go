@@ -0,0 +1,48 @@
+package neardup
+
+import (
+	"hash/fnv"
+	"html"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// shingleLen is the count of the words hashed together, so the word order matters.
+const shingleLen = 2
+
+// wordsMin is the min count of the words to fingerprint, the shorter texts are too similar to each other.
+const wordsMin = 20
+
+var reTag = regexp.MustCompile(`<[^>]*>`)
+
+// Fingerprint returns the 64 bits SimHash of the text or the HTML: the similar texts have the fingerprints differing in
+// the few bits only. The fingerprint is not ok when the text is too short.
+func Fingerprint(text string) (fp uint64, ok bool) {
+	text = html.UnescapeString(reTag.ReplaceAllString(text, " "))
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	ok = len(words) >= wordsMin
+	if ok {
+		var weights [64]int
+		for i := 0; i+shingleLen <= len(words); i++ {
+			h := fnv.New64a()
+			_, _ = h.Write([]byte(strings.Join(words[i:i+shingleLen], " ")))
+			sum := h.Sum64()
+			for bit := 0; bit < 64; bit++ {
+				if sum&(1<<bit) != 0 {
+					weights[bit]++
+				} else {
+					weights[bit]--
+				}
+			}
+		}
+		for bit, w := range weights {
+			if w > 0 {
+				fp |= 1 << bit
+			}
+		}
+	}
+	return
+}
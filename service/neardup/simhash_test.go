@@ -0,0 +1,62 @@
+package neardup
+
+import (
+	"github.com/stretchr/testify/assert"
+	"math/bits"
+	"strings"
+	"testing"
+)
+
+const article = "The city council has published the agenda of the next meeting. The meeting is open to the public and takes " +
+	"place in the town hall on Thursday evening. The residents are welcome to comment on the budget proposal, the new " +
+	"bike lanes along the river and the renovation of the central library. The comments may also be sent by email " +
+	"before the end of the month. The council expects to vote on the budget in December after the public hearing."
+
+func TestFingerprint(t *testing.T) {
+	fp, ok := Fingerprint(article)
+	assert.True(t, ok)
+	cases := map[string]struct {
+		src         string
+		distanceMax int
+		distanceMin int
+	}{
+		"same": {
+			src: article,
+		},
+		"html": {
+			src: "<div><p>" + strings.Replace(article, ". ", ".</p><p>", -1) + "</p></div>",
+		},
+		"case and punctuation": {
+			src: strings.ToUpper(strings.ReplaceAll(article, ",", " ;")),
+		},
+		"resent with the greeting": {
+			src:         "In case you missed it: " + article,
+			distanceMax: 6,
+		},
+		"the word changed": {
+			src:         strings.Replace(article, "December", "January", 1),
+			distanceMax: 6,
+		},
+		"other article": {
+			src: "The football club has signed the new goalkeeper from the neighbouring town for the next two seasons. " +
+				"The coach said the team needed the experience in the defence after the disappointing start of the " +
+				"league. The tickets for the first home match are on sale at the stadium and online from Monday.",
+			distanceMin: 12,
+			distanceMax: 64,
+		},
+	}
+	for k, c := range cases {
+		t.Run(k, func(t *testing.T) {
+			fpOther, okOther := Fingerprint(c.src)
+			assert.True(t, okOther)
+			d := bits.OnesCount64(fp ^ fpOther)
+			assert.LessOrEqual(t, d, c.distanceMax)
+			assert.GreaterOrEqual(t, d, c.distanceMin)
+		})
+	}
+}
+
+func TestFingerprint_Short(t *testing.T) {
+	_, ok := Fingerprint("<p>See you on Thursday!</p>")
+	assert.False(t, ok)
+}
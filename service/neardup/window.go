@@ -0,0 +1,92 @@
+package neardup
+
+import (
+	"context"
+	"github.com/awakari/int-email/config"
+	"math"
+	"math/bits"
+	"sync"
+	"time"
+)
+
+// Window keeps the fingerprints of the recent events to find the near-duplicates among them.
+type Window interface {
+
+	// Check returns the id of the recent event similar to the fingerprint. When not found, the fingerprint is added with
+	// the event id. The event found by its own id is not a duplicate, e.g. the same event retried.
+	Check(ctx context.Context, fp uint64, id string) (origId string, found bool)
+
+	// Delete removes the fingerprint added with the event id, e.g. when the event is not accepted.
+	Delete(ctx context.Context, id string)
+}
+
+// the actions on the near-duplicate event
+const (
+	ActionMark = "mark"
+	ActionDrop = "drop"
+)
+
+type entry struct {
+	fp   uint64
+	id   string
+	time time.Time
+}
+
+type window struct {
+	lock        *sync.Mutex
+	entries     []entry
+	next        *int
+	ttl         time.Duration
+	distanceMax int
+}
+
+// NewWindow returns the window of the configured size, the oldest fingerprint is replaced when the window is full.
+func NewWindow(cfg config.NearDupConfig) Window {
+	return window{
+		lock:    &sync.Mutex{},
+		entries: make([]entry, cfg.Window.Size),
+		next:    new(int),
+		ttl:     cfg.Window.Ttl,
+		// the count of the fingerprint bits allowed to differ
+		distanceMax: int(math.Floor((1 - cfg.SimilarityMin) * 64)),
+	}
+}
+
+func (w window) Check(ctx context.Context, fp uint64, id string) (origId string, found bool) {
+	if len(w.entries) == 0 {
+		return
+	}
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	now := time.Now()
+	distanceMin := w.distanceMax + 1
+	for _, e := range w.entries {
+		if e.id == "" || now.Sub(e.time) > w.ttl {
+			continue
+		}
+		if d := bits.OnesCount64(fp ^ e.fp); d < distanceMin {
+			distanceMin = d
+			origId = e.id
+		}
+	}
+	found = origId != "" && origId != id
+	if origId == "" {
+		w.entries[*w.next] = entry{
+			fp:   fp,
+			id:   id,
+			time: now,
+		}
+		*w.next = (*w.next + 1) % len(w.entries)
+	}
+	return
+}
+
+func (w window) Delete(ctx context.Context, id string) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	for i, e := range w.entries {
+		if e.id == id {
+			w.entries[i] = entry{}
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package neardup
+
+import (
+	"context"
+	"github.com/awakari/int-email/config"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestWindow_Check(t *testing.T) {
+	cfg := config.NearDupConfig{
+		SimilarityMin: 0.95,
+	}
+	cfg.Window.Size = 2
+	cfg.Window.Ttl = time.Minute
+	w := NewWindow(cfg)
+	_, found := w.Check(context.TODO(), 0b1111, "evt1")
+	assert.False(t, found)
+	// 3 bits differ
+	origId, found := w.Check(context.TODO(), 0b1000, "evt2")
+	assert.True(t, found)
+	assert.Equal(t, "evt1", origId)
+	// the same event retried
+	_, found = w.Check(context.TODO(), 0b1111, "evt1")
+	assert.False(t, found)
+	// 4 bits differ
+	_, found = w.Check(context.TODO(), 0b1111_0000, "evt3")
+	assert.False(t, found)
+	_, found = w.Check(context.TODO(), 0xFF00, "evt4")
+	assert.False(t, found)
+	// evt1 is replaced by evt4
+	_, found = w.Check(context.TODO(), 0b1111, "evt5")
+	assert.False(t, found)
+}
+
+func TestWindow_Delete(t *testing.T) {
+	cfg := config.NearDupConfig{
+		SimilarityMin: 0.95,
+	}
+	cfg.Window.Size = 2
+	cfg.Window.Ttl = time.Minute
+	w := NewWindow(cfg)
+	_, found := w.Check(context.TODO(), 0b1111, "evt1")
+	assert.False(t, found)
+	w.Delete(context.TODO(), "evt1")
+	_, found = w.Check(context.TODO(), 0b1111, "evt2")
+	assert.False(t, found)
+	// missing
+	w.Delete(context.TODO(), "evt3")
+	origId, found := w.Check(context.TODO(), 0b1111, "evt4")
+	assert.True(t, found)
+	assert.Equal(t, "evt2", origId)
+}
+
+func TestWindow_Check_Ttl(t *testing.T) {
+	cfg := config.NearDupConfig{
+		SimilarityMin: 0.95,
+	}
+	cfg.Window.Size = 10
+	cfg.Window.Ttl = 10 * time.Millisecond
+	w := NewWindow(cfg)
+	_, found := w.Check(context.TODO(), 1, "evt1")
+	assert.False(t, found)
+	time.Sleep(20 * time.Millisecond)
+	_, found = w.Check(context.TODO(), 1, "evt2")
+	assert.False(t, found)
+}
+
+func TestWindow_Check_Disabled(t *testing.T) {
+	w := NewWindow(config.NearDupConfig{})
+	_, found := w.Check(context.TODO(), 1, "evt1")
+	assert.False(t, found)
+	_, found = w.Check(context.TODO(), 1, "evt2")
+	assert.False(t, found)
+}
@@ -0,0 +1,94 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/awakari/int-email/model"
+	"github.com/awakari/int-email/service/dkim"
+	"github.com/awakari/int-email/service/dmarc"
+	"github.com/awakari/int-email/service/ratelimit"
+	"github.com/awakari/int-email/service/spf"
+	"io"
+	"log/slog"
+	"strings"
+)
+
+type rateLimiting struct {
+	svc      Service
+	dkim     dkim.Service
+	internal ratelimit.Limiter
+	publish  ratelimit.Limiter
+	log      *slog.Logger
+}
+
+var ErrRateLimit = model.NewError("sender rate limit reached, retry later", model.ErrLimitReached)
+
+// NewRateLimit returns the service deferring the messages of the sender exceeding the rate limit. The internal and the
+// publishing messages have own limits.
+func NewRateLimit(svc Service, svcDkim dkim.Service, internal, publish ratelimit.Limiter, log *slog.Logger) Service {
+	return rateLimiting{
+		svc:      svc,
+		dkim:     svcDkim,
+		internal: internal,
+		publish:  publish,
+		log:      log,
+	}
+}
+
+func (rl rateLimiting) Submit(ctx context.Context, env model.Envelope, r io.Reader) (err error) {
+	var raw []byte
+	raw, err = io.ReadAll(r)
+	if err == nil {
+		l := rl.publish
+		if env.Internal {
+			l = rl.internal
+		}
+		var k string
+		ctx, k = rl.senderKey(ctx, env, raw)
+		if l.Allow(k) {
+			err = rl.svc.Submit(ctx, env, bytes.NewReader(raw))
+		} else {
+			rl.log.WarnContext(ctx, "ratelimit: message deferred", "sender", k, "internal", env.Internal)
+			err = fmt.Errorf("%w: %s", ErrRateLimit, k)
+		}
+	}
+	return
+}
+
+// senderKey returns the authenticated sender domain: the From domain aligned with the SPF or the DKIM authenticated one,
+// otherwise the DKIM signing domain, otherwise the remote address. The envelope sender alone identifies nothing: it is
+// unique per message with VERP and shared by the customers of the same provider. The DKIM is verified only when the SPF
+// doesn't authenticate the From domain, the returned context carries the verification for the conversion.
+func (rl rateLimiting) senderKey(ctx context.Context, env model.Envelope, raw []byte) (ctxVerified context.Context, k string) {
+	ctxVerified = ctx
+	from := fromDomain(raw)
+	if from != "" && spf.Result(env.SpfResult) == spf.ResultPass {
+		spfDomain := addrDomain(env.From)
+		if spfDomain == "" {
+			spfDomain = strings.ToLower(env.Helo)
+		}
+		if dmarc.Aligned(from, []string{spfDomain}) {
+			k = from
+		}
+	}
+	if k == "" {
+		vs, err := rl.dkim.Verify(ctx, raw)
+		ctxVerified = dkim.WithVerified(ctx, vs, err)
+		var dkimDomains []string
+		for _, v := range vs {
+			if v.Result == dkim.ResultPass {
+				dkimDomains = append(dkimDomains, strings.ToLower(v.Domain))
+			}
+		}
+		switch {
+		case from != "" && dmarc.Aligned(from, dkimDomains):
+			k = from
+		case len(dkimDomains) > 0:
+			k = dkimDomains[0]
+		default:
+			k = env.RemoteIp
+		}
+	}
+	return
+}
@@ -0,0 +1,105 @@
+package ratelimit
+
+import (
+	"github.com/hashicorp/golang-lru/v2/expirable"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"sync"
+	"time"
+)
+
+// Limiter is the token bucket per key: the bucket of the rate per minute capacity is refilled at the same rate.
+type Limiter interface {
+
+	// Allow takes the token from the bucket of the key, returns false when the bucket is empty.
+	Allow(key string) (ok bool)
+}
+
+// the policies of the traffic types
+const (
+	PolicyInternal = "internal"
+	PolicyPublish  = "publish"
+)
+
+var senders = promauto.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Namespace: "int_email",
+		Subsystem: "ratelimit",
+		Name:      "senders",
+		Help:      "Senders seen within the last minute, having the bucket tracked",
+	},
+	[]string{
+		"policy",
+	},
+)
+
+var decisions = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "int_email",
+		Subsystem: "ratelimit",
+		Name:      "decisions_total",
+		Help:      "Rate limit decisions by the result: allowed or limited",
+	},
+	[]string{
+		"policy",
+		"result",
+	},
+)
+
+type bucket struct {
+	tokens float64
+	time   time.Time
+}
+
+type limiter struct {
+	policy   string
+	capacity float64
+	// rate is the count of the tokens refilled per second
+	rate    float64
+	lock    *sync.Mutex
+	buckets *expirable.LRU[string, bucket]
+	now     func() time.Time
+}
+
+// NewLimiter returns the limiter of the policy allowing the rate per minute for every key, the limit is disabled when
+// the rate is not positive. Up to the size of the least recently seen keys are tracked, the bucket not seen for a
+// minute is full anyway and is forgotten.
+func NewLimiter(policy string, perMinute int, size uint32) Limiter {
+	return limiter{
+		policy:   policy,
+		capacity: float64(perMinute),
+		rate:     float64(perMinute) / time.Minute.Seconds(),
+		lock:     &sync.Mutex{},
+		buckets:  expirable.NewLRU[string, bucket](int(size), nil, time.Minute),
+		now:      time.Now,
+	}
+}
+
+func (l limiter) Allow(key string) (ok bool) {
+	ok = l.capacity <= 0
+	if !ok {
+		l.lock.Lock()
+		defer l.lock.Unlock()
+		now := l.now()
+		b, found := l.buckets.Get(key)
+		if found {
+			b.tokens = min(l.capacity, b.tokens+now.Sub(b.time).Seconds()*l.rate)
+		} else {
+			b.tokens = l.capacity
+		}
+		b.time = now
+		ok = b.tokens >= 1
+		if ok {
+			b.tokens--
+		}
+		// the expiration time is renewed too
+		l.buckets.Add(key, b)
+		senders.WithLabelValues(l.policy).Set(float64(l.buckets.Len()))
+	}
+	result := "allowed"
+	if !ok {
+		result = "limited"
+	}
+	decisions.WithLabelValues(l.policy, result).Inc()
+	return
+}
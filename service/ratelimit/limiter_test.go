@@ -0,0 +1,60 @@
+package ratelimit
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestLimiter_Allow(t *testing.T) {
+	cases := map[string]struct {
+		perMinute int
+		// the key and the seconds since the start of every call
+		calls []string
+		times []int
+		out   []bool
+	}{
+		"disabled": {
+			perMinute: 0,
+			calls:     []string{"john", "john", "john"},
+			times:     []int{0, 0, 0},
+			out:       []bool{true, true, true},
+		},
+		"burst up to the capacity": {
+			perMinute: 2,
+			calls:     []string{"john", "john", "john"},
+			times:     []int{0, 0, 0},
+			out:       []bool{true, true, false},
+		},
+		"keys are independent": {
+			perMinute: 1,
+			calls:     []string{"john", "jane", "john"},
+			times:     []int{0, 0, 0},
+			out:       []bool{true, true, false},
+		},
+		"refilled at the rate": {
+			perMinute: 2,
+			calls:     []string{"john", "john", "john", "john", "john"},
+			times:     []int{0, 0, 10, 30, 31},
+			out:       []bool{true, true, false, true, false},
+		},
+		"limited calls don't take the tokens": {
+			perMinute: 1,
+			calls:     []string{"john", "john", "john", "john"},
+			times:     []int{0, 30, 59, 60},
+			out:       []bool{true, false, false, true},
+		},
+	}
+	for k, c := range cases {
+		t.Run(k, func(t *testing.T) {
+			l := NewLimiter(PolicyPublish, c.perMinute, 10).(limiter)
+			start := time.Now()
+			for i, key := range c.calls {
+				l.now = func() time.Time {
+					return start.Add(time.Duration(c.times[i]) * time.Second)
+				}
+				assert.Equal(t, c.out[i], l.Allow(key), i)
+			}
+		})
+	}
+}
@@ -0,0 +1,163 @@
+package received
+
+import (
+	"errors"
+	"fmt"
+	"github.com/awakari/int-email/util"
+	"net"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Hop is the parsed Received trace header added by the host relaying the message.
+type Hop struct {
+
+	// From is the name the sending host introduced itself with (HELO/EHLO).
+	From string
+
+	// FromHost is the sending host name resolved by the receiving host.
+	FromHost string
+
+	// FromIp is the sending host address, nil when unknown.
+	FromIp net.IP
+
+	By       string
+	Protocol string
+
+	// Tls is true when the hop is encrypted, by the protocol (ESMTPS, etc) or by the TLS details comment.
+	Tls bool
+
+	Id  string
+	For string
+
+	// Time is zero when the header has no valid date.
+	Time time.Time
+}
+
+var ErrParse = errors.New("invalid received header")
+
+var reIp = regexp.MustCompile(`\[(?:(?i)IPv6:)?([0-9a-fA-F:.]+)]`)
+var reHost = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9.\-]*\.[a-zA-Z]{2,}\.?$`)
+var reTls = regexp.MustCompile(`(?i)(using\s+TLS|\bTLS\s*v?1[._]?[0-3]|version=TLS|cipher=|\bTLS_)`)
+var protocolsTls = map[string]bool{
+	"esmtps":     true,
+	"esmtpsa":    true,
+	"lmtps":      true,
+	"lmtpsa":     true,
+	"utf8smtps":  true,
+	"utf8smtpsa": true,
+	"smtps":      true,
+}
+
+// ParseAll parses the Received headers in their order, the topmost, added last, first.
+// The header failed to be parsed is kept as the hop with the zero time.
+func ParseAll(src []string) (hops []Hop) {
+	for _, s := range src {
+		h, _ := Parse(s)
+		hops = append(hops, h)
+	}
+	return
+}
+
+// Parse parses the RFC 5321 Received header: the optional "from", "by", "via", "with", "id" and "for" clauses with
+// the comments and the date after the last ";".
+func Parse(src string) (h Hop, err error) {
+	sepIdx := strings.LastIndex(src, ";")
+	if sepIdx < 0 {
+		err = fmt.Errorf("%w: no date: %q", ErrParse, src)
+		return
+	}
+	var clause string
+	for _, token := range tokenize(src[:sepIdx]) {
+		comment := strings.HasPrefix(token, "(")
+		if !comment {
+			switch kw := strings.ToLower(token); kw {
+			case "from", "by", "via", "with", "id", "for":
+				clause = kw
+				continue
+			}
+		}
+		if comment && reTls.MatchString(token) {
+			h.Tls = true
+		}
+		switch clause {
+		case "from":
+			h.parseFrom(token, comment)
+		case "by":
+			if !comment && h.By == "" {
+				h.By = strings.TrimSuffix(token, ".")
+			}
+		case "with":
+			if !comment && h.Protocol == "" {
+				h.Protocol = token
+				h.Tls = h.Tls || protocolsTls[strings.ToLower(token)]
+			}
+		case "id":
+			if !comment && h.Id == "" {
+				h.Id = token
+			}
+		case "for":
+			if !comment && h.For == "" {
+				h.For = strings.Trim(token, "<>")
+			}
+		}
+	}
+	h.Time, err = util.ParseDate(src[sepIdx+1:])
+	if err != nil {
+		err = fmt.Errorf("%w: %w", ErrParse, err)
+	}
+	return
+}
+
+func (h *Hop) parseFrom(token string, comment bool) {
+	if m := reIp.FindStringSubmatch(token); m != nil && h.FromIp == nil {
+		h.FromIp = net.ParseIP(m[1])
+	}
+	switch {
+	case !comment && h.From == "":
+		h.From = strings.TrimSuffix(token, ".")
+	case comment && h.FromHost == "":
+		// "(host.example.com [192.0.2.1])", "(helo=host.example.com)" is the sender name, not the resolved one
+		for _, f := range strings.Fields(strings.Trim(token, "()")) {
+			if reHost.MatchString(f) {
+				h.FromHost = strings.ToLower(strings.TrimSuffix(f, "."))
+				break
+			}
+		}
+	}
+}
+
+// tokenize splits the header by the white spaces, the comments are kept whole including the nested ones.
+func tokenize(src string) (tokens []string) {
+	var sb strings.Builder
+	depth := 0
+	flush := func() {
+		if sb.Len() > 0 {
+			tokens = append(tokens, sb.String())
+			sb.Reset()
+		}
+	}
+	for _, c := range src {
+		switch {
+		case c == '(':
+			if depth == 0 {
+				flush()
+			}
+			depth++
+			sb.WriteRune(c)
+		case c == ')' && depth > 0:
+			depth--
+			sb.WriteRune(c)
+			if depth == 0 {
+				flush()
+			}
+		case depth == 0 && (c == ' ' || c == '\t' || c == '\r' || c == '\n'):
+			flush()
+		default:
+			sb.WriteRune(c)
+		}
+	}
+	flush()
+	return
+}
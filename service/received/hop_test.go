@@ -0,0 +1,129 @@
+package received
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	cases := map[string]struct {
+		src string
+		out Hop
+		err error
+	}{
+		"gmail": {
+			src: "from mail-sor-f41.google.com (mail-sor-f41.google.com. [209.85.220.41])\r\n" +
+				"        by mx.google.com with SMTPS id a640c23a62f3a-a99;\r\n" +
+				"        Thu, 10 Oct 2024 05:34:56 -0700 (PDT)",
+			out: Hop{
+				From:     "mail-sor-f41.google.com",
+				FromHost: "mail-sor-f41.google.com",
+				FromIp:   net.ParseIP("209.85.220.41"),
+				By:       "mx.google.com",
+				Protocol: "SMTPS",
+				Tls:      true,
+				Id:       "a640c23a62f3a-a99",
+				Time:     time.Date(2024, 10, 10, 12, 34, 56, 0, time.UTC),
+			},
+		},
+		"postfix with tls details": {
+			src: "from smtp.example.com (smtp.example.com [192.0.2.1])\r\n" +
+				"\t(using TLSv1.3 with cipher TLS_AES_256_GCM_SHA384 (256/256 bits))\r\n" +
+				"\t(No client certificate requested)\r\n" +
+				"\tby mx.example.org (Postfix) with ESMTP id 4XYZ\r\n" +
+				"\tfor <news@awakari.com>; Thu, 10 Oct 2024 12:34:56 +0000 (UTC)",
+			out: Hop{
+				From:     "smtp.example.com",
+				FromHost: "smtp.example.com",
+				FromIp:   net.ParseIP("192.0.2.1"),
+				By:       "mx.example.org",
+				Protocol: "ESMTP",
+				Tls:      true,
+				Id:       "4XYZ",
+				For:      "news@awakari.com",
+				Time:     time.Date(2024, 10, 10, 12, 34, 56, 0, time.UTC),
+			},
+		},
+		"exim": {
+			src: "from [198.51.100.7] (helo=newsletter.example.com)\r\n" +
+				"\tby mail.example.org with esmtpsa (TLS1.3) tls TLS_AES_256_GCM_SHA384\r\n" +
+				"\t(Exim 4.96) id 1sz-0001; Thu, 10 Oct 2024 12:34:56 +0000",
+			out: Hop{
+				From:     "[198.51.100.7]",
+				FromIp:   net.ParseIP("198.51.100.7"),
+				By:       "mail.example.org",
+				Protocol: "esmtpsa",
+				Tls:      true,
+				Id:       "1sz-0001",
+				Time:     time.Date(2024, 10, 10, 12, 34, 56, 0, time.UTC),
+			},
+		},
+		"ipv6": {
+			src: "from relay.example.com (relay.example.com [IPv6:2001:db8::1]) by mx.example.org with ESMTP; 10 Oct 2024 12:34:56 +0000",
+			out: Hop{
+				From:     "relay.example.com",
+				FromHost: "relay.example.com",
+				FromIp:   net.ParseIP("2001:db8::1"),
+				By:       "mx.example.org",
+				Protocol: "ESMTP",
+				Time:     time.Date(2024, 10, 10, 12, 34, 56, 0, time.UTC),
+			},
+		},
+		"by only": {
+			src: "by 2002:a05:6a10:8a8c:b0:5a2:5a0b with SMTP id k12csp; Thu, 10 Oct 2024 12:34:56 -0700 (PDT)",
+			out: Hop{
+				By:       "2002:a05:6a10:8a8c:b0:5a2:5a0b",
+				Protocol: "SMTP",
+				Id:       "k12csp",
+				Time:     time.Date(2024, 10, 10, 19, 34, 56, 0, time.UTC),
+			},
+		},
+		"the host name with tls is not encrypted": {
+			src: "from mail-tls.example.com (mail-tls.example.com [192.0.2.1]) by mx.example.org with SMTP; 10 Oct 2024 12:34:56 +0000",
+			out: Hop{
+				From:     "mail-tls.example.com",
+				FromHost: "mail-tls.example.com",
+				FromIp:   net.ParseIP("192.0.2.1"),
+				By:       "mx.example.org",
+				Protocol: "SMTP",
+				Time:     time.Date(2024, 10, 10, 12, 34, 56, 0, time.UTC),
+			},
+		},
+		"no date": {
+			src: "from localhost by mx.example.org",
+			err: ErrParse,
+		},
+		"invalid date": {
+			src: "from localhost (localhost [127.0.0.1]) by mx.example.org; yesterday",
+			out: Hop{
+				From:   "localhost",
+				FromIp: net.ParseIP("127.0.0.1"),
+				By:     "mx.example.org",
+			},
+			err: ErrParse,
+		},
+	}
+	for k, c := range cases {
+		t.Run(k, func(t *testing.T) {
+			out, err := Parse(c.src)
+			assert.ErrorIs(t, err, c.err)
+			assert.True(t, c.out.Time.Equal(out.Time), out.Time.String())
+			c.out.Time = out.Time
+			assert.Equal(t, c.out, out)
+		})
+	}
+}
+
+func TestParseAll(t *testing.T) {
+	hops := ParseAll([]string{
+		"from mx.example.org by mx.awakari.com; Thu, 10 Oct 2024 12:35:00 +0000",
+		"invalid",
+		"from smtp.example.com by mx.example.org; Thu, 10 Oct 2024 12:34:56 +0000",
+	})
+	assert.Equal(t, 3, len(hops))
+	assert.Equal(t, "mx.awakari.com", hops[0].By)
+	assert.True(t, hops[1].Time.IsZero())
+	assert.Equal(t, "smtp.example.com", hops[2].From)
+}
@@ -0,0 +1,131 @@
+package redact
+
+import (
+	"encoding/base64"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// Redactor removes the addresses of the publishing recipients and the subscriber personalization from the published text.
+type Redactor interface {
+
+	// Redact removes our own addresses in any of the forms: plain, URL-encoded, tagged (name+tag@domain) and base64
+	// encoded in the link query. The link query parameters known to personalize the link are removed too.
+	Redact(src string) (dst string)
+}
+
+type redactor struct {
+	reAddr *regexp.Regexp
+}
+
+// personalParams are the link query parameters identifying the subscriber. The generic ones, e.g. "e" or "uid", are removed
+// only when the value is our address.
+var personalParams = map[string]bool{
+	"ck_subscriber_id": true,
+	"contact_id":       true,
+	"email":            true,
+	"email_address":    true,
+	"emailaddress":     true,
+	"mc_eid":           true,
+	"rcpt":             true,
+	"recipient":        true,
+	"subscriber":       true,
+	"subscriber_id":    true,
+	"subscriberid":     true,
+	"user_id":          true,
+	"userid":           true,
+}
+
+var reUrl = regexp.MustCompile(`(?i)https?://[^\s"'<>]+`)
+var reQuerySep = regexp.MustCompile(`&amp;|&`)
+
+// base64ValueLenMin is the min length of the query parameter value to try to decode it as base64.
+const base64ValueLenMin = 8
+
+// NewRedactor returns the redactor of the addresses having any of the names at any of the domains or their subdomains.
+func NewRedactor(names, domains []string) Redactor {
+	r := redactor{}
+	if len(names) > 0 && len(domains) > 0 {
+		r.reAddr = regexp.MustCompile(
+			`(?i)(^|[^a-z0-9._%+\-]|%[0-9a-f]{2})` +
+				`(` + quoteAll(names) + `)((\+|%2B)[a-z0-9._\-]*)?(@|%40)([a-z0-9\-]+\.)*(` + quoteAll(domains) + `)\b`,
+		)
+	}
+	return r
+}
+
+func quoteAll(src []string) string {
+	var quoted []string
+	for _, s := range src {
+		if s != "" {
+			quoted = append(quoted, regexp.QuoteMeta(s))
+		}
+	}
+	return strings.Join(quoted, "|")
+}
+
+func (r redactor) Redact(src string) (dst string) {
+	dst = reUrl.ReplaceAllStringFunc(src, r.redactUrl)
+	if r.reAddr != nil {
+		dst = r.reAddr.ReplaceAllString(dst, "${1}")
+	}
+	return
+}
+
+// redactUrl removes the query parameters personalizing the link or containing our address.
+// The kept parameters and the separators are not re-encoded, so the link in the HTML attribute remains escaped.
+func (r redactor) redactUrl(src string) (dst string) {
+	base, query, found := strings.Cut(src, "?")
+	if !found {
+		return src
+	}
+	query, fragment, hasFragment := strings.Cut(query, "#")
+	seps := reQuerySep.FindAllString(query, -1)
+	var kept []string
+	var keptSeps []string
+	for i, param := range reQuerySep.Split(query, -1) {
+		if r.personal(param) {
+			continue
+		}
+		if len(kept) > 0 {
+			keptSeps = append(keptSeps, seps[i-1])
+		}
+		kept = append(kept, param)
+	}
+	dst = base
+	if len(kept) > 0 {
+		dst += "?" + kept[0]
+		for i, param := range kept[1:] {
+			dst += keptSeps[i] + param
+		}
+	}
+	if hasFragment {
+		dst += "#" + fragment
+	}
+	return
+}
+
+func (r redactor) personal(param string) bool {
+	k, v, _ := strings.Cut(param, "=")
+	if k, err := url.QueryUnescape(k); err == nil && personalParams[strings.ToLower(k)] {
+		return true
+	}
+	if r.reAddr == nil || v == "" {
+		return false
+	}
+	if vDecoded, err := url.QueryUnescape(v); err == nil {
+		v = vDecoded
+	}
+	if r.reAddr.MatchString(v) {
+		return true
+	}
+	if len(v) >= base64ValueLenMin {
+		for _, enc := range []*base64.Encoding{base64.StdEncoding, base64.URLEncoding, base64.RawStdEncoding, base64.RawURLEncoding} {
+			if data, err := enc.DecodeString(v); err == nil && r.reAddr.Match(data) {
+				return true
+			}
+		}
+	}
+	return false
+}
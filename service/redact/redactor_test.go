@@ -0,0 +1,101 @@
+package redact
+
+import (
+	"encoding/base64"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestRedactor_Redact(t *testing.T) {
+	r := NewRedactor([]string{"news", "Jane.Smith"}, []string{"awakari.com"})
+	b64 := base64.URLEncoding.EncodeToString([]byte(`{"email":"news@awakari.com","list":7}`))
+	cases := map[string]struct {
+		src string
+		dst string
+	}{
+		"plain": {
+			src: "Sent to news@awakari.com.",
+			dst: "Sent to .",
+		},
+		"case insensitive": {
+			src: "Hi NEWS@Awakari.com and jane.smith@awakari.com",
+			dst: "Hi  and ",
+		},
+		"tagged": {
+			src: "Sent to news+weekly@awakari.com",
+			dst: "Sent to ",
+		},
+		"subdomain": {
+			src: "Sent to news@email.awakari.com",
+			dst: "Sent to ",
+		},
+		"url encoded in path": {
+			src: "https://example.com/unsubscribe/news%40awakari.com/confirm",
+			dst: "https://example.com/unsubscribe//confirm",
+		},
+		"url encoded tagged": {
+			src: "https://example.com/u/mailto%3Anews%2Bweekly%40awakari.com",
+			dst: "https://example.com/u/mailto%3A",
+		},
+		"query param value": {
+			src: `<a href="https://example.com/post?id=7&amp;to=news%40awakari.com&amp;ref=mail">Read</a>`,
+			dst: `<a href="https://example.com/post?id=7&amp;ref=mail">Read</a>`,
+		},
+		"base64 query param value": {
+			src: "https://example.com/u?t=" + b64 + "&x=1",
+			dst: "https://example.com/u?x=1",
+		},
+		"personalization params": {
+			src: `<a href="https://example.com/post?email=someone%40example.com&amp;subscriber_id=123&amp;p=2#top">Read</a>`,
+			dst: `<a href="https://example.com/post?p=2#top">Read</a>`,
+		},
+		"only personalization params": {
+			src: "https://example.com/post?mc_eid=abc&subscriber_id=1 and more",
+			dst: "https://example.com/post and more",
+		},
+		"generic params having our address": {
+			src: "https://example.com/post?e=news%40awakari.com&uid=" + b64 + "&p=2",
+			dst: "https://example.com/post?p=2",
+		},
+		// false positives
+		"generic params": {
+			src: "https://example.com/search?q=go&e=1&uid=123",
+			dst: "https://example.com/search?q=go&e=1&uid=123",
+		},
+		"the name in the text": {
+			src: "The news of the week: news, newsletters and breaking news",
+			dst: "The news of the week: news, newsletters and breaking news",
+		},
+		"other domain": {
+			src: "Write to news@example.com or news@awakari.community",
+			dst: "Write to news@example.com or news@awakari.community",
+		},
+		"longer name": {
+			src: "Write to breakingnews@awakari.com or news.desk@awakari.com",
+			dst: "Write to breakingnews@awakari.com or news.desk@awakari.com",
+		},
+		"lookalike domain": {
+			src: "Write to news@notawakari.com",
+			dst: "Write to news@notawakari.com",
+		},
+		"the name in the link": {
+			src: "https://example.com/news/2024?section=news&page=2",
+			dst: "https://example.com/news/2024?section=news&page=2",
+		},
+		"base64 not ours": {
+			src: "https://example.com/u?t=" + base64.URLEncoding.EncodeToString([]byte("news@example.com")),
+			dst: "https://example.com/u?t=" + base64.URLEncoding.EncodeToString([]byte("news@example.com")),
+		},
+	}
+	for k, c := range cases {
+		t.Run(k, func(t *testing.T) {
+			assert.Equal(t, c.dst, r.Redact(c.src))
+		})
+	}
+}
+
+func TestRedactor_Redact_NoRecipients(t *testing.T) {
+	r := NewRedactor(nil, nil)
+	assert.Equal(t, "news@awakari.com", r.Redact("news@awakari.com"))
+	assert.Equal(t, "https://example.com/post?p=2", r.Redact("https://example.com/post?email=news%40awakari.com&p=2"))
+}
@@ -1,38 +1,216 @@
 package service
 
 import (
+	"bytes"
 	"context"
+	"errors"
+	"fmt"
+	"github.com/awakari/int-email/config"
+	"github.com/awakari/int-email/model"
 	"github.com/awakari/int-email/service/converter"
+	"github.com/awakari/int-email/service/deadletter"
+	"github.com/awakari/int-email/service/dmarc"
+	"github.com/awakari/int-email/service/neardup"
+	"github.com/awakari/int-email/service/spf"
+	"github.com/awakari/int-email/service/spool"
 	"github.com/awakari/int-email/service/writer"
 	"github.com/cloudevents/sdk-go/binding/format/protobuf/v2/pb"
 	"io"
+	"net/mail"
+	"strings"
 )
 
 type Service interface {
-	Submit(ctx context.Context, from string, internal bool, r io.Reader) (err error)
+	Submit(ctx context.Context, env model.Envelope, r io.Reader) (err error)
 }
 
 type svc struct {
-	conv   converter.Service
-	writer writer.Service
-	group  string
+	conv       converter.Service
+	spool      spool.Service
+	deadLetter deadletter.Service
+	group      string
+	dmarc      dmarc.Service
+	cfgDmarc   config.DmarcConfig
+	nearDup    neardup.Window
+	cfgNearDup config.NearDupConfig
+	breaker    writer.Breaker
 }
 
-func NewService(conv converter.Service, writer writer.Service, group string) Service {
+const ceKeySpf = model.AttrKeySpf
+const ceKeyCorrelationId = model.AttrKeyCorrelationId
+const ceKeyDmarc = model.AttrKeyDmarc
+const ceKeyDmarcPolicy = model.AttrKeyDmarcPolicy
+const ceKeyDmarcOverride = model.AttrKeyDmarcOverride
+const ceKeyDuplicateOf = "duplicateof"
+
+var ErrDmarc = model.NewError("message rejected by the DMARC policy of the sender domain", model.ErrPolicy)
+
+func NewService(conv converter.Service, svcSpool spool.Service, svcDeadLetter deadletter.Service, group string, svcDmarc dmarc.Service, cfgDmarc config.DmarcConfig, nearDup neardup.Window, cfgNearDup config.NearDupConfig, brk writer.Breaker) Service {
 	return svc{
-		conv:   conv,
-		writer: writer,
-		group:  group,
+		conv:       conv,
+		spool:      svcSpool,
+		deadLetter: svcDeadLetter,
+		group:      group,
+		dmarc:      svcDmarc,
+		cfgDmarc:   cfgDmarc,
+		nearDup:    nearDup,
+		cfgNearDup: cfgNearDup,
+		breaker:    brk,
 	}
 }
 
-func (s svc) Submit(ctx context.Context, from string, internal bool, r io.Reader) (err error) {
+func (s svc) Submit(ctx context.Context, env model.Envelope, r io.Reader) (err error) {
+	var raw []byte
+	raw, err = io.ReadAll(r)
 	evt := &pb.CloudEvent{
 		Attributes: make(map[string]*pb.CloudEventAttributeValue),
 	}
-	err = s.conv.Convert(r, evt, from, internal)
+	var auth converter.Auth
+	if err == nil {
+		auth, err = s.conv.Convert(ctx, bytes.NewReader(raw), evt, env)
+		if errors.Is(err, converter.ErrParse) {
+			// keep the message to replay it once the conversion is fixed
+			_, dlErr := s.deadLetter.Put(ctx, deadletter.Entry{
+				Envelope: env,
+				Raw:      raw,
+				Error:    err.Error(),
+			})
+			err = errors.Join(err, dlErr)
+		}
+	}
+	if err == nil && env.CorrelationId != "" {
+		evt.Attributes[ceKeyCorrelationId] = &pb.CloudEventAttributeValue{
+			Attr: &pb.CloudEventAttributeValue_CeString{
+				CeString: env.CorrelationId,
+			},
+		}
+	}
+	if err == nil && env.SpfTag && env.SpfResult != "" {
+		evt.Attributes[ceKeySpf] = &pb.CloudEventAttributeValue{
+			Attr: &pb.CloudEventAttributeValue_CeString{
+				CeString: env.SpfResult,
+			},
+		}
+	}
+	group := s.group
+	if err == nil {
+		group, err = s.applyDmarc(ctx, env, raw, auth, evt)
+	}
+	var nearDupAdded bool
+	if err == nil && group != "" && !env.Internal {
+		group, nearDupAdded = s.applyNearDup(ctx, evt, group)
+	}
+	if err == nil && group != "" && s.breaker.Open(group, evt.Source) {
+		// let the sender retry later instead of spooling the messages nobody can write now
+		err = fmt.Errorf("%w: %s", writer.ErrUnavailable, evt.Source)
+	}
+	if err == nil && group != "" {
+		// the sender gets the reply once the message is persisted, the spool writes it in the background
+		err = s.spool.Put(ctx, spool.Entry{
+			Envelope: env,
+			Raw:      raw,
+			Event:    evt,
+			Group:    group,
+			User:     evt.Source,
+		})
+	}
+	if err != nil && nearDupAdded {
+		// the event not accepted is not the original of the similar ones
+		s.nearDup.Delete(ctx, evt.Id)
+	}
+	return
+}
+
+// applyDmarc evaluates the DMARC policy of the From domain and returns the group to write the event to.
+// The empty group means the event should be dropped.
+func (s svc) applyDmarc(ctx context.Context, env model.Envelope, raw []byte, auth converter.Auth, evt *pb.CloudEvent) (group string, err error) {
+	in := dmarc.Input{
+		FromDomain:  fromDomain(raw),
+		SpfResult:   spf.Result(env.SpfResult),
+		SpfDomain:   addrDomain(env.From),
+		DkimDomains: auth.DkimDomains,
+		ArcTrusted:  auth.ArcTrusted,
+	}
+	if in.SpfDomain == "" {
+		in.SpfDomain = env.Helo
+	}
+	v, _ := s.dmarc.Evaluate(ctx, in)
+	evt.Attributes[ceKeyDmarc] = &pb.CloudEventAttributeValue{
+		Attr: &pb.CloudEventAttributeValue_CeString{
+			CeString: string(v.Result),
+		},
+	}
+	if v.Result == dmarc.ResultFail {
+		evt.Attributes[ceKeyDmarcPolicy] = &pb.CloudEventAttributeValue{
+			Attr: &pb.CloudEventAttributeValue_CeString{
+				CeString: string(v.Disposition),
+			},
+		}
+	}
+	if v.Override != dmarc.OverrideNone {
+		evt.Attributes[ceKeyDmarcOverride] = &pb.CloudEventAttributeValue{
+			Attr: &pb.CloudEventAttributeValue_CeString{
+				CeString: string(v.Override),
+			},
+		}
+	}
+	group = s.group
+	switch {
+	case env.Internal, !s.cfgDmarc.Enforce:
+	case v.Disposition == dmarc.PolicyReject:
+		// https://www.rfc-editor.org/rfc/rfc7489#section-6.7
+		err = fmt.Errorf("%w: %s", ErrDmarc, in.FromDomain)
+	case v.Disposition == dmarc.PolicyQuarantine:
+		group = s.cfgDmarc.QuarantineGroup
+	}
+	return
+}
+
+// applyNearDup finds the recent event similar to the given one and returns the group to write the event to.
+// The empty group means the event should be dropped. Returns true when the event fingerprint is added to the window.
+func (s svc) applyNearDup(ctx context.Context, evt *pb.CloudEvent, group string) (string, bool) {
+	fp, ok := neardup.Fingerprint(evt.GetTextData())
+	var origId string
+	var added bool
+	if ok {
+		origId, ok = s.nearDup.Check(ctx, fp, evt.Id)
+		// nothing similar is found, not even the same event retried
+		added = origId == ""
+	}
+	switch {
+	case !ok:
+	case s.cfgNearDup.Action == neardup.ActionDrop:
+		group = ""
+	default:
+		evt.Attributes[ceKeyDuplicateOf] = &pb.CloudEventAttributeValue{
+			Attr: &pb.CloudEventAttributeValue_CeString{
+				CeString: origId,
+			},
+		}
+	}
+	return group, added
+}
+
+func fromDomain(raw []byte) (domain string) {
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
 	if err == nil {
-		err = s.writer.Write(context.TODO(), evt, s.group, evt.Source)
+		from := msg.Header.Get("From")
+		var addr *mail.Address
+		addr, err = mail.ParseAddress(from)
+		switch err {
+		case nil:
+			domain = addrDomain(addr.Address)
+		default:
+			domain = addrDomain(strings.TrimSuffix(strings.TrimSpace(from), ">"))
+		}
+	}
+	return
+}
+
+func addrDomain(addr string) (domain string) {
+	sepIdx := strings.LastIndex(addr, "@")
+	if sepIdx >= 0 {
+		domain = strings.ToLower(addr[sepIdx+1:])
 	}
 	return
 }
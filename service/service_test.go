@@ -1,22 +1,48 @@
 package service
 
 import (
+	"bytes"
 	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"github.com/awakari/client-sdk-go/api/grpc/resolver"
 	"github.com/awakari/int-email/config"
+	"github.com/awakari/int-email/model"
+	"github.com/awakari/int-email/service/arc"
+	"github.com/awakari/int-email/service/cleaner"
 	"github.com/awakari/int-email/service/converter"
+	"github.com/awakari/int-email/service/deadletter"
+	"github.com/awakari/int-email/service/dkim"
+	"github.com/awakari/int-email/service/dmarc"
+	"github.com/awakari/int-email/service/dns"
+	"github.com/awakari/int-email/service/extractor"
+	"github.com/awakari/int-email/service/neardup"
+	"github.com/awakari/int-email/service/ratelimit"
+	"github.com/awakari/int-email/service/redact"
+	"github.com/awakari/int-email/service/spf"
+	"github.com/awakari/int-email/service/spool"
+	"github.com/awakari/int-email/service/unwrap"
 	"github.com/awakari/int-email/service/writer"
+	"github.com/cloudevents/sdk-go/binding/format/protobuf/v2/pb"
+	msgauth "github.com/emersion/go-msgauth/dkim"
 	"github.com/microcosm-cc/bluemonday"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"io"
 	"log/slog"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestSvc_Submit(t *testing.T) {
 	cases := map[string]struct {
 		from     string
 		internal bool
+		spf      spf.Result
+		spfTag   bool
 		in       io.Reader
 		err      error
 	}{
@@ -25,7 +51,9 @@ func TestSvc_Submit(t *testing.T) {
 			err: converter.ErrParse,
 		},
 		"ok": {
-			from: "johndoe@example.com",
+			from:   "johndoe@example.com",
+			spf:    spf.ResultPass,
+			spfTag: true,
 			in: strings.NewReader(`From: John Doe <john@example.com>
 To: Jane Smith <jane.smith@example.com>
 Subject: Meeting Notes and Attachment
@@ -42,7 +70,61 @@ Please find attached the meeting notes and presentation slides.
 Best regards,
 John`),
 		},
-		"fail write": {
+		"dmarc pass by the untagged spf": {
+			from: "bounce@example.com",
+			spf:  spf.ResultPass,
+			in: strings.NewReader(`From: John Doe <john@example.com>
+To: Jane Smith <jane.smith@example.com>
+Subject: Meeting Notes and Attachment
+Message-ID: <unique-message-id@example.com>
+Content-Type: text/plain; charset="UTF-8"
+
+Hi Jane,
+
+Please find attached the meeting notes and presentation slides.`),
+		},
+		"dmarc reject": {
+			from: "bounce@evil.example.org",
+			spf:  spf.ResultPass,
+			in: strings.NewReader(`From: John Doe <john@example.com>
+To: Jane Smith <jane.smith@example.com>
+Subject: Meeting Notes and Attachment
+Message-ID: <unique-message-id@example.com>
+Content-Type: text/plain; charset="UTF-8"
+
+Hi Jane,
+
+Please find attached the meeting notes and presentation slides.`),
+			err: ErrDmarc,
+		},
+		"dmarc reject ignored for internal": {
+			from:     "bounce@evil.example.org",
+			internal: true,
+			spf:      spf.ResultPass,
+			in: strings.NewReader(`From: John Doe <john@example.com>
+To: Jane Smith <jane.smith@example.com>
+Subject: Meeting Notes and Attachment
+Message-ID: <unique-message-id@example.com>
+Content-Type: text/plain; charset="UTF-8"
+
+Hi Jane,
+
+Please find attached the meeting notes and presentation slides.`),
+		},
+		"writer unavailable": {
+			from: "johndoe@example.com",
+			in: strings.NewReader(`From: John Doe <down@example.net>
+To: Jane Smith <jane.smith@example.com>
+Subject: Meeting Notes and Attachment
+Message-ID: <unique-message-id@example.com>
+Content-Type: text/plain; charset="UTF-8"
+
+Hi Jane,
+
+Please find attached the meeting notes and presentation slides.`),
+			err: writer.ErrUnavailable,
+		},
+		"write failure is deferred": {
 			from: "johndoe@example.com",
 			in: strings.NewReader(`From: fail
 To: Jane Smith <jane.smith@example.com>
@@ -59,29 +141,459 @@ Please find attached the meeting notes and presentation slides.
 
 Best regards,
 John`),
-			err: writer.ErrWrite,
 		},
 	}
 	log := slog.Default()
+	brk := writer.NewBreaker(config.WriterBreakerConfig{
+		Failures: 1,
+		Timeout:  time.Minute,
+	})
+	brk.Done("default", "down@example.net", resolver.ErrUnavailable)
+	svcDeadLetter, err := deadletter.NewService(t.TempDir())
+	require.Nil(t, err)
+	svcSpool, err := spool.NewService(
+		config.SpoolConfig{
+			Dir:         t.TempDir(),
+			AttemptsMax: 1,
+		},
+		writer.NewLogging(writer.NewMock(), log),
+		svcDeadLetter,
+		log,
+	)
+	require.Nil(t, err)
 	s := NewService(
 		converter.NewLogging(
 			converter.NewConverter(
 				"com_awakari_email_v1",
 				bluemonday.NewPolicy(),
 				config.WriterInternalConfig{},
-				map[string]bool{},
+				redact.NewRedactor(nil, nil),
 				false,
+				config.TimeConfig{},
+				dkim.NewService(dkim.NewKeyLookup(dns.Zone{}), 5),
+				config.DkimConfig{},
+				arc.NewMock(),
+				extractor.NewRegistry(extractor.Builtin()...),
+				unwrap.NewService(nil, config.UnwrapConfig{}),
+				cleaner.NewService(),
+				slog.Default(),
 			),
 			log,
 		),
-		writer.NewLogging(writer.NewMock(), log),
+		spool.NewLogging(svcSpool, log),
+		deadletter.NewLogging(svcDeadLetter, log),
 		"default",
+		dmarc.NewService(dns.Zone{
+			Txt: map[string][]string{
+				"_dmarc.example.com": {
+					"v=DMARC1; p=reject",
+				},
+			},
+		}),
+		config.DmarcConfig{
+			Enforce:         true,
+			QuarantineGroup: "quarantine",
+		},
+		neardup.NewWindow(config.NearDupConfig{}),
+		config.NearDupConfig{},
+		brk,
 	)
 	s = NewLogging(s, log)
 	for k, c := range cases {
 		t.Run(k, func(t *testing.T) {
-			err := s.Submit(context.TODO(), c.from, c.internal, c.in)
+			err := s.Submit(context.TODO(), model.Envelope{From: c.from, Internal: c.internal, SpfResult: string(c.spf), SpfTag: c.spfTag}, c.in)
 			assert.ErrorIs(t, err, c.err)
 		})
 	}
+	// only the message failed to be converted is kept
+	ids, err := svcDeadLetter.List(context.TODO())
+	require.Nil(t, err)
+	require.Equal(t, 1, len(ids))
+	e, err := svcDeadLetter.Get(context.TODO(), ids[0])
+	require.Nil(t, err)
+	assert.Empty(t, e.Raw)
+	assert.Contains(t, e.Error, converter.ErrParse.Error())
+}
+
+func TestSvc_Submit_NearDupNotAccepted(t *testing.T) {
+	cfg := config.NearDupConfig{
+		SimilarityMin: 0.9,
+		Action:        neardup.ActionMark,
+	}
+	cfg.Window.Size = 10
+	cfg.Window.Ttl = time.Minute
+	sp := &spoolStub{
+		err: errors.New("disk is full"),
+	}
+	s := svc{
+		conv: converter.NewConverter(
+			"com_awakari_email_v1",
+			bluemonday.NewPolicy(),
+			config.WriterInternalConfig{},
+			redact.NewRedactor(nil, nil),
+			false,
+			config.TimeConfig{},
+			dkim.NewService(dkim.NewKeyLookup(dns.Zone{}), 5),
+			config.DkimConfig{},
+			arc.NewMock(),
+			extractor.NewRegistry(),
+			unwrap.NewService(nil, config.UnwrapConfig{}),
+			cleaner.NewService(),
+			slog.Default(),
+		),
+		spool:      sp,
+		group:      "default",
+		dmarc:      dmarc.NewService(dns.Zone{}),
+		nearDup:    neardup.NewWindow(cfg),
+		cfgNearDup: cfg,
+		breaker:    writer.NewBreaker(config.WriterBreakerConfig{}),
+	}
+	msg := func(msgId string) io.Reader {
+		return strings.NewReader("From: Council <council@example.com>\r\n" +
+			"Message-ID: <" + msgId + ">\r\n" +
+			"Date: Thu, 10 Oct 2024 12:34:56 +0000\r\n" +
+			"Content-Type: text/plain; charset=\"UTF-8\"\r\n" +
+			"\r\n" +
+			"The city council has published the agenda of the next meeting. The meeting is open to the public " +
+			"and takes place in the town hall on Thursday evening. The residents are welcome to comment on the " +
+			"budget proposal and the new bike lanes along the river.\r\n")
+	}
+	err := s.Submit(context.TODO(), model.Envelope{From: "council@example.com"}, msg("agenda-1@example.com"))
+	assert.ErrorIs(t, err, sp.err)
+	sp.err = nil
+	// the message not accepted is not the original
+	err = s.Submit(context.TODO(), model.Envelope{From: "council@example.com"}, msg("agenda-2@example.com"))
+	require.Nil(t, err)
+	require.Len(t, sp.entries, 1)
+	assert.Nil(t, sp.entries[0].Event.Attributes[ceKeyDuplicateOf])
+	err = s.Submit(context.TODO(), model.Envelope{From: "council@example.com"}, msg("agenda-3@example.com"))
+	require.Nil(t, err)
+	require.Len(t, sp.entries, 2)
+	assert.Equal(t, sp.entries[0].Event.Id, sp.entries[1].Event.Attributes[ceKeyDuplicateOf].GetCeString())
+}
+
+// spoolStub keeps the entries put, failing when err is set.
+type spoolStub struct {
+	entries []spool.Entry
+	err     error
+}
+
+func (s *spoolStub) Put(ctx context.Context, e spool.Entry) (err error) {
+	err = s.err
+	if err == nil {
+		s.entries = append(s.entries, e)
+	}
+	return
+}
+
+func (s *spoolStub) Run(ctx context.Context) {
+}
+
+func (s *spoolStub) Depth() (n int, err error) {
+	return len(s.entries), nil
+}
+
+func (s *spoolStub) Flush(ctx context.Context) {
+}
+
+// storeStub is the shared dedup store, failing when err is set.
+type storeStub struct {
+	keys map[string]string
+	err  error
+}
+
+func (s *storeStub) PutIfAbsent(ctx context.Context, key, val string) (prev string, found bool, err error) {
+	err = s.err
+	if err == nil {
+		prev, found = s.keys[key]
+		if !found {
+			s.keys[key] = val
+		}
+	}
+	return
+}
+
+func (s *storeStub) Delete(ctx context.Context, key string) (err error) {
+	err = s.err
+	delete(s.keys, key)
+	return
+}
+
+// svcStub counts the submitted messages and fails the configured count of the submits.
+type svcStub struct {
+	submitted int
+	verified  int
+	failures  int
+}
+
+func (s *svcStub) Submit(ctx context.Context, env model.Envelope, r io.Reader) (err error) {
+	if s.failures > 0 {
+		s.failures--
+		return ErrDmarc
+	}
+	s.submitted++
+	if _, found, _ := dkim.Verified(ctx); found {
+		s.verified++
+	}
+	return
+}
+
+func TestDedup_Submit(t *testing.T) {
+	msg := "Message-ID: <weekly-42@example.com>\r\n\r\nThe top stories.\r\n"
+	cases := map[string]struct {
+		msgs      []string
+		failures  int
+		storeErr  error
+		submitted int
+		errs      int
+	}{
+		"duplicate dropped": {
+			msgs: []string{
+				msg,
+				"Received: from relay.example.com by mx.awakari.com; Thu, 10 Oct 2024 12:34:56 +0000\r\n" + msg,
+			},
+			submitted: 1,
+		},
+		"different messages": {
+			msgs: []string{
+				msg,
+				"Message-ID: <weekly-43@example.com>\r\n\r\nThe top stories.\r\n",
+				"Message-ID: <weekly-42@example.com>\r\n\r\nThe correction.\r\n",
+			},
+			submitted: 3,
+		},
+		"no message id": {
+			msgs: []string{
+				"Subject: hi\r\n\r\nhello\r\n",
+				"Subject: hi\r\n\r\nhello\r\n",
+			},
+			submitted: 2,
+		},
+		"failed message retried": {
+			msgs: []string{
+				msg,
+				msg,
+				msg,
+			},
+			failures:  1,
+			submitted: 1,
+			errs:      1,
+		},
+		"store failure": {
+			msgs: []string{
+				msg,
+				msg,
+			},
+			storeErr:  errors.New("connection refused"),
+			submitted: 2,
+		},
+	}
+	for k, c := range cases {
+		t.Run(k, func(t *testing.T) {
+			stub := &svcStub{
+				failures: c.failures,
+			}
+			store := &storeStub{
+				keys: map[string]string{},
+				err:  c.storeErr,
+			}
+			s := NewDedup(stub, store, slog.Default())
+			var errs int
+			for _, m := range c.msgs {
+				if err := s.Submit(context.TODO(), model.Envelope{CorrelationId: "session1"}, strings.NewReader(m)); err != nil {
+					errs++
+				}
+			}
+			assert.Equal(t, c.submitted, stub.submitted)
+			assert.Equal(t, c.errs, errs)
+		})
+	}
+}
+
+func TestRateLimit_Submit(t *testing.T) {
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	require.Nil(t, err)
+	msg := func(from string) string {
+		return "From: " + from + "\r\nSubject: hi\r\n\r\nhello\r\n"
+	}
+	signed := func(from, domain string) string {
+		var dst bytes.Buffer
+		err := msgauth.Sign(&dst, strings.NewReader(msg(from)), &msgauth.SignOptions{
+			Domain:   domain,
+			Selector: "sel1",
+			Signer:   key,
+		})
+		require.Nil(t, err)
+		return dst.String()
+	}
+	txt := []string{
+		"v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(pub),
+	}
+	svcDkim := dkim.NewService(dkim.NewKeyLookup(dns.Zone{
+		Txt: map[string][]string{
+			"sel1._domainkey.example.com":  txt,
+			"sel1._domainkey.esp.example":  txt,
+			"sel1._domainkey.mail.example": txt,
+		},
+	}), 5)
+	type submit struct {
+		env model.Envelope
+		msg string
+	}
+	cases := map[string]struct {
+		submits   []submit
+		submitted int
+		// the submitted messages carrying the DKIM verification, the SPF aligned ones are not verified
+		verified int
+		limited  int
+	}{
+		"publish limited per aligned from domain": {
+			submits: []submit{
+				{env: model.Envelope{From: "bounce-1@news.example.com", SpfResult: "pass"}, msg: msg("news@example.com")},
+				{env: model.Envelope{From: "bounce-2@news.example.com", SpfResult: "pass"}, msg: msg("News@Example.com")},
+				{env: model.Envelope{From: "bounce-3@news.example.com", SpfResult: "pass"}, msg: msg("digest@example.com")},
+				{env: model.Envelope{From: "bounce-4@news.example.org", SpfResult: "pass"}, msg: msg("news@example.org")},
+			},
+			submitted: 3,
+			verified:  0,
+			limited:   1,
+		},
+		"dkim aligned from domain": {
+			submits: []submit{
+				{env: model.Envelope{From: "bounce-1@esp.example", RemoteIp: "192.0.2.1"}, msg: signed("news@example.com", "example.com")},
+				{env: model.Envelope{From: "bounce-2@esp.example", RemoteIp: "192.0.2.2"}, msg: signed("news@example.com", "example.com")},
+				{env: model.Envelope{From: "bounce-3@esp.example", RemoteIp: "192.0.2.3"}, msg: signed("news@example.com", "example.com")},
+			},
+			submitted: 2,
+			verified:  2,
+			limited:   1,
+		},
+		"dkim signing domain when not aligned": {
+			submits: []submit{
+				{env: model.Envelope{From: "bounce-1@esp.example", RemoteIp: "192.0.2.1"}, msg: signed("news@example.org", "esp.example")},
+				{env: model.Envelope{From: "bounce-2@esp.example", RemoteIp: "192.0.2.2"}, msg: signed("news@example.net", "esp.example")},
+				{env: model.Envelope{From: "bounce-3@esp.example", RemoteIp: "192.0.2.3"}, msg: signed("news@example.com", "mail.example")},
+				{env: model.Envelope{From: "bounce-4@esp.example", RemoteIp: "192.0.2.4"}, msg: signed("news@example.org", "esp.example")},
+			},
+			submitted: 3,
+			verified:  3,
+			limited:   1,
+		},
+		"unauthenticated limited by the address": {
+			submits: []submit{
+				{env: model.Envelope{From: "news@example.com", RemoteIp: "192.0.2.1"}, msg: msg("news@example.com")},
+				{env: model.Envelope{From: "news@example.com", RemoteIp: "192.0.2.2"}, msg: msg("news@example.com")},
+				{env: model.Envelope{From: "news@example.com", SpfResult: "fail", RemoteIp: "192.0.2.1"}, msg: msg("news@example.com")},
+				{env: model.Envelope{RemoteIp: "192.0.2.1"}, msg: msg("news@example.com")},
+			},
+			submitted: 3,
+			verified:  3,
+			limited:   1,
+		},
+		"internal has own limit": {
+			submits: []submit{
+				{env: model.Envelope{From: "news@example.com", SpfResult: "pass"}, msg: msg("news@example.com")},
+				{env: model.Envelope{From: "news@example.com", SpfResult: "pass", Internal: true}, msg: msg("news@example.com")},
+				{env: model.Envelope{From: "news@example.com", SpfResult: "pass", Internal: true}, msg: msg("news@example.com")},
+			},
+			submitted: 2,
+			verified:  0,
+			limited:   1,
+		},
+	}
+	for k, c := range cases {
+		t.Run(k, func(t *testing.T) {
+			stub := &svcStub{}
+			s := NewRateLimit(
+				stub,
+				svcDkim,
+				ratelimit.NewLimiter(ratelimit.PolicyInternal, 1, 10),
+				ratelimit.NewLimiter(ratelimit.PolicyPublish, 2, 10),
+				slog.Default(),
+			)
+			var limited int
+			for _, sub := range c.submits {
+				err := s.Submit(context.TODO(), sub.env, strings.NewReader(sub.msg))
+				if err != nil {
+					assert.ErrorIs(t, err, ErrRateLimit)
+					assert.ErrorIs(t, err, model.ErrLimitReached)
+					limited++
+				}
+			}
+			assert.Equal(t, c.submitted, stub.submitted)
+			assert.Equal(t, c.verified, stub.verified)
+			assert.Equal(t, c.limited, limited)
+		})
+	}
+}
+
+func TestSvc_applyNearDup(t *testing.T) {
+	article := "The city council has published the agenda of the next meeting. The meeting is open to the public " +
+		"and takes place in the town hall on Thursday evening. The residents are welcome to comment on the budget " +
+		"proposal, the new bike lanes along the river and the renovation of the central library. The comments may " +
+		"also be sent by email before the end of the month. The council expects to vote on the budget in December " +
+		"after the public hearing."
+	cases := map[string]struct {
+		action      string
+		text        string
+		group       string
+		duplicateOf string
+	}{
+		"mark": {
+			action:      neardup.ActionMark,
+			text:        "<p>In case you missed it:</p><p>" + article + "</p>",
+			group:       "default",
+			duplicateOf: "evt1",
+		},
+		"drop": {
+			action: neardup.ActionDrop,
+			text:   "<p>In case you missed it:</p><p>" + article + "</p>",
+		},
+		"different": {
+			action: neardup.ActionDrop,
+			text: "The football club has signed the new goalkeeper from the neighbouring town for the next two " +
+				"seasons. The coach said the team needed the experience in the defence after the disappointing start.",
+			group: "default",
+		},
+		"too short": {
+			action: neardup.ActionDrop,
+			text:   "The city council has published the agenda.",
+			group:  "default",
+		},
+	}
+	for k, c := range cases {
+		t.Run(k, func(t *testing.T) {
+			cfg := config.NearDupConfig{
+				SimilarityMin: 0.9,
+				Action:        c.action,
+			}
+			cfg.Window.Size = 10
+			cfg.Window.Ttl = time.Minute
+			s := svc{
+				nearDup:    neardup.NewWindow(cfg),
+				cfgNearDup: cfg,
+			}
+			evt := &pb.CloudEvent{
+				Id: "evt1",
+				Data: &pb.CloudEvent_TextData{
+					TextData: article,
+				},
+				Attributes: map[string]*pb.CloudEventAttributeValue{},
+			}
+			group, added := s.applyNearDup(context.TODO(), evt, "default")
+			assert.Equal(t, "default", group)
+			assert.True(t, added)
+			assert.Nil(t, evt.Attributes[ceKeyDuplicateOf])
+			evt = &pb.CloudEvent{
+				Id: "evt2",
+				Data: &pb.CloudEvent_TextData{
+					TextData: c.text,
+				},
+				Attributes: map[string]*pb.CloudEventAttributeValue{},
+			}
+			group, _ = s.applyNearDup(context.TODO(), evt, "default")
+			assert.Equal(t, c.group, group)
+			assert.Equal(t, c.duplicateOf, evt.Attributes[ceKeyDuplicateOf].GetCeString())
+		})
+	}
 }
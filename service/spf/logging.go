@@ -0,0 +1,35 @@
+package spf
+
+import (
+	"context"
+	"log/slog"
+	"net"
+)
+
+type logging struct {
+	svc Service
+	log *slog.Logger
+}
+
+func NewLogging(svc Service, log *slog.Logger) Service {
+	return logging{
+		svc: svc,
+		log: log,
+	}
+}
+
+func (l logging) Check(ctx context.Context, ip net.IP, helo, sender string) (r Result, err error) {
+	r, err = l.svc.Check(ctx, ip, helo, sender)
+	l.log.Log(ctx, logLevel(r), "spf.Check", "ip", ip, "helo", helo, "sender", sender, "result", r, "err", err)
+	return
+}
+
+func logLevel(r Result) (lvl slog.Level) {
+	switch r {
+	case ResultTempError, ResultPermError:
+		lvl = slog.LevelWarn
+	default:
+		lvl = slog.LevelDebug
+	}
+	return
+}
@@ -0,0 +1,85 @@
+package spf
+
+import (
+	"blitiri.com.ar/go/spf"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/awakari/int-email/config"
+	"github.com/awakari/int-email/service/dns"
+	"net"
+)
+
+// Result of the SPF check, see https://www.rfc-editor.org/rfc/rfc7208#section-2.6
+type Result string
+
+const (
+	ResultNone      Result = "none"
+	ResultNeutral   Result = "neutral"
+	ResultPass      Result = "pass"
+	ResultFail      Result = "fail"
+	ResultSoftFail  Result = "softfail"
+	ResultTempError Result = "temperror"
+	ResultPermError Result = "permerror"
+)
+
+// Action defines what to do with the message given the SPF check result.
+type Action string
+
+const (
+	// ActionIgnore accepts the message and drops the SPF result.
+	ActionIgnore Action = "ignore"
+	// ActionTag accepts the message and exposes the SPF result as the event attribute.
+	ActionTag Action = "tag"
+	// ActionReject rejects the message.
+	ActionReject Action = "reject"
+)
+
+type Policy map[Result]Action
+
+type Service interface {
+	// Check evaluates the SPF record of the sender domain against the connecting client IP address.
+	// The sender may be empty for the null reverse path, the helo domain is used then.
+	// The returned error is informational only and describes the reason of the result.
+	Check(ctx context.Context, ip net.IP, helo, sender string) (r Result, err error)
+}
+
+type service struct {
+	resolver dns.Resolver
+}
+
+func NewService(resolver dns.Resolver) Service {
+	return service{
+		resolver: resolver,
+	}
+}
+
+var ErrInvalidAction = errors.New("invalid SPF action")
+
+// NewPolicy returns the policy of the configured actions, fails on the unknown action, e.g. a typo in the config.
+func NewPolicy(cfg config.SpfConfig) (p Policy, err error) {
+	p = Policy{
+		ResultNone:      Action(cfg.Action.None),
+		ResultNeutral:   Action(cfg.Action.Neutral),
+		ResultPass:      Action(cfg.Action.Pass),
+		ResultFail:      Action(cfg.Action.Fail),
+		ResultSoftFail:  Action(cfg.Action.SoftFail),
+		ResultTempError: Action(cfg.Action.TempError),
+		ResultPermError: Action(cfg.Action.PermError),
+	}
+	for r, a := range p {
+		switch a {
+		case ActionIgnore, ActionTag, ActionReject:
+		default:
+			err = errors.Join(err, fmt.Errorf("%w for %s: %q", ErrInvalidAction, r, a))
+		}
+	}
+	return
+}
+
+func (svc service) Check(ctx context.Context, ip net.IP, helo, sender string) (r Result, err error) {
+	var res spf.Result
+	res, err = spf.CheckHostWithSender(ip, helo, sender, spf.WithContext(ctx), spf.WithResolver(svc.resolver))
+	r = Result(res)
+	return
+}
@@ -0,0 +1,166 @@
+package spf
+
+import (
+	"context"
+	"github.com/awakari/int-email/config"
+	"github.com/awakari/int-email/service/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"log/slog"
+	"net"
+	"testing"
+)
+
+func TestService_Check(t *testing.T) {
+	zone := dns.Zone{
+		Txt: map[string][]string{
+			"example.com": {
+				"v=spf1 ip4:192.0.2.0/24 include:_spf.example.net -all",
+			},
+			"_spf.example.net": {
+				"v=spf1 ip6:2001:db8::/32 ~all",
+			},
+			"soft.example.com": {
+				"v=spf1 a ~all",
+			},
+			"neutral.example.com": {
+				"v=spf1 ?all",
+			},
+			"broken.example.com": {
+				"v=spf1 foo:bar -all",
+			},
+			"mail.example.org": {
+				"v=spf1 mx -all",
+			},
+		},
+		Mx: map[string][]*net.MX{
+			"mail.example.org": {
+				{
+					Host: "mx.example.org",
+					Pref: 10,
+				},
+			},
+		},
+		Ip: map[string][]net.IPAddr{
+			"soft.example.com": {
+				{
+					IP: net.ParseIP("198.51.100.1"),
+				},
+			},
+			"mx.example.org": {
+				{
+					IP: net.ParseIP("203.0.113.25"),
+				},
+			},
+		},
+		Fail: map[string]bool{
+			"down.example.com": true,
+		},
+	}
+	cases := map[string]struct {
+		ip     string
+		helo   string
+		sender string
+		out    Result
+	}{
+		"pass ip4": {
+			ip:     "192.0.2.10",
+			helo:   "mx.example.com",
+			sender: "news@example.com",
+			out:    ResultPass,
+		},
+		"pass include": {
+			ip:     "2001:db8::1",
+			helo:   "mx.example.com",
+			sender: "news@example.com",
+			out:    ResultPass,
+		},
+		"include softfail is not a match": {
+			ip:     "2001:db9::1",
+			helo:   "mx.example.com",
+			sender: "news@example.com",
+			out:    ResultFail,
+		},
+		"fail": {
+			ip:     "198.51.100.1",
+			helo:   "mx.example.com",
+			sender: "news@example.com",
+			out:    ResultFail,
+		},
+		"pass a": {
+			ip:     "198.51.100.1",
+			helo:   "mx.example.com",
+			sender: "news@soft.example.com",
+			out:    ResultPass,
+		},
+		"softfail": {
+			ip:     "198.51.100.2",
+			helo:   "mx.example.com",
+			sender: "news@soft.example.com",
+			out:    ResultSoftFail,
+		},
+		"neutral": {
+			ip:     "198.51.100.2",
+			helo:   "mx.example.com",
+			sender: "news@neutral.example.com",
+			out:    ResultNeutral,
+		},
+		"none": {
+			ip:     "198.51.100.2",
+			helo:   "mx.example.com",
+			sender: "news@unknown.example.com",
+			out:    ResultNone,
+		},
+		"temperror": {
+			ip:     "198.51.100.2",
+			helo:   "mx.example.com",
+			sender: "news@down.example.com",
+			out:    ResultTempError,
+		},
+		"permerror": {
+			ip:     "198.51.100.2",
+			helo:   "mx.example.com",
+			sender: "news@broken.example.com",
+			out:    ResultPermError,
+		},
+		"null sender uses helo": {
+			ip:   "203.0.113.25",
+			helo: "mail.example.org",
+			out:  ResultPass,
+		},
+	}
+	svc := NewService(zone)
+	svc = NewLogging(svc, slog.Default())
+	for k, c := range cases {
+		t.Run(k, func(t *testing.T) {
+			r, _ := svc.Check(context.TODO(), net.ParseIP(c.ip), c.helo, c.sender)
+			assert.Equal(t, c.out, r)
+		})
+	}
+}
+
+func TestNewPolicy(t *testing.T) {
+	cfg := config.SpfConfig{}
+	cfg.Action.None = "ignore"
+	cfg.Action.Neutral = "ignore"
+	cfg.Action.Pass = "tag"
+	cfg.Action.Fail = "reject"
+	cfg.Action.SoftFail = "tag"
+	cfg.Action.TempError = "tag"
+	cfg.Action.PermError = "tag"
+	p, err := NewPolicy(cfg)
+	require.Nil(t, err)
+	assert.Equal(t, ActionReject, p[ResultFail])
+	assert.Equal(t, ActionTag, p[ResultPass])
+	assert.Equal(t, ActionIgnore, p[ResultNone])
+	// typo
+	cfg.Action.Fail = "rejct"
+	_, err = NewPolicy(cfg)
+	assert.ErrorIs(t, err, ErrInvalidAction)
+	assert.ErrorContains(t, err, "rejct")
+	// missing
+	cfg.Action.Fail = "reject"
+	cfg.Action.None = ""
+	_, err = NewPolicy(cfg)
+	assert.ErrorIs(t, err, ErrInvalidAction)
+}
@@ -0,0 +1,40 @@
+package spool
+
+import (
+	"context"
+	"github.com/awakari/int-email/util"
+	"log/slog"
+)
+
+type logging struct {
+	svc Service
+	log *slog.Logger
+}
+
+func NewLogging(svc Service, log *slog.Logger) Service {
+	return logging{
+		svc: svc,
+		log: log,
+	}
+}
+
+func (l logging) Put(ctx context.Context, e Entry) (err error) {
+	err = l.svc.Put(ctx, e)
+	l.log.Log(ctx, util.LogLevel(err), "spool.Put", "evtId", e.Event.GetId(), "group", e.Group, "user", e.User, "err", err)
+	return
+}
+
+func (l logging) Depth() (n int, err error) {
+	return l.svc.Depth()
+}
+
+func (l logging) Flush(ctx context.Context) {
+	l.log.InfoContext(ctx, "spool.Flush")
+	l.svc.Flush(ctx)
+}
+
+func (l logging) Run(ctx context.Context) {
+	l.log.InfoContext(ctx, "spool.Run: started")
+	l.svc.Run(ctx)
+	l.log.InfoContext(ctx, "spool.Run: stopped")
+}
@@ -0,0 +1,405 @@
+package spool
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/awakari/int-email/config"
+	"github.com/awakari/int-email/model"
+	"github.com/awakari/int-email/service/deadletter"
+	"github.com/awakari/int-email/service/writer"
+	"github.com/awakari/int-email/util"
+	"github.com/cloudevents/sdk-go/binding/format/protobuf/v2/pb"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/protobuf/proto"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Entry is the accepted message waiting to be written.
+type Entry struct {
+	Id       string
+	Envelope model.Envelope
+	Raw      []byte
+	Event    *pb.CloudEvent
+	Group    string
+	User     string
+	Attempts uint32
+	Created  time.Time
+	// Next is the time of the next write attempt.
+	Next time.Time
+	// Trace is the trace context of the accepted message, so the background write continues the same trace.
+	Trace map[string]string
+}
+
+// Service is the write-ahead spool: the accepted messages are persisted to the local disk first
+// and written in the background, so they survive the process restarts and the writer outages.
+type Service interface {
+
+	// Put persists the entry. The entry is written later by Run.
+	Put(ctx context.Context, e Entry) (err error)
+
+	// Run drains the spool into the writer until the context is done.
+	// The entries of the same group and user are written in the order they were put, up to
+	// config.SpoolConfig.Concurrency entries at once.
+	// The write in progress is not interrupted when the context is done. The entries put by another process sharing the
+	// spool dir, e.g. the replay, are noticed by the dir modification time checked every pollInterval.
+	Run(ctx context.Context)
+
+	// Depth returns the count of the entries waiting to be written.
+	Depth() (n int, err error)
+
+	// Flush makes the single attempt to write the due entries, e.g. before the shutdown.
+	// Should not be invoked concurrently with Run.
+	Flush(ctx context.Context)
+}
+
+type service struct {
+	dir        string
+	writer     writer.Service
+	deadLetter deadletter.Service
+	cfg        config.SpoolConfig
+	log        *slog.Logger
+	notify     chan struct{}
+	idLock     *sync.Mutex
+	idLast     *int64
+}
+
+// record is the on-disk representation of the entry.
+type record struct {
+	Envelope model.Envelope    `json:"envelope"`
+	Raw      []byte            `json:"raw"`
+	Event    []byte            `json:"event"`
+	Group    string            `json:"group"`
+	User     string            `json:"user"`
+	Attempts uint32            `json:"attempts"`
+	Created  time.Time         `json:"created"`
+	Next     time.Time         `json:"next"`
+	Trace    map[string]string `json:"trace,omitempty"`
+}
+
+const fileExt = ".json"
+const filePrefixTmp = ".tmp-"
+
+// tmpAgeMin is the age of the temporary file considered abandoned, the younger one may be being written by another
+// process sharing the spool dir.
+const tmpAgeMin = time.Minute
+
+const pollInterval = time.Second
+
+var ErrPut = model.NewError("failed to spool the message", model.ErrTemporary)
+
+func NewService(cfg config.SpoolConfig, w writer.Service, dl deadletter.Service, log *slog.Logger) (svc Service, err error) {
+	err = os.MkdirAll(cfg.Dir, 0o700)
+	var tmps []string
+	if err == nil {
+		// leftovers of the interrupted writes, never acknowledged to the senders
+		tmps, err = filepath.Glob(filepath.Join(cfg.Dir, filePrefixTmp+"*"))
+	}
+	for _, tmp := range tmps {
+		fi, statErr := os.Stat(tmp)
+		if statErr == nil && time.Since(fi.ModTime()) > tmpAgeMin {
+			err = errors.Join(err, os.Remove(tmp))
+		}
+	}
+	if err == nil {
+		svc = service{
+			dir:        cfg.Dir,
+			writer:     w,
+			deadLetter: dl,
+			cfg:        cfg,
+			log:        log,
+			notify:     make(chan struct{}, 1),
+			idLock:     &sync.Mutex{},
+			idLast:     new(int64),
+		}
+	}
+	return
+}
+
+func (svc service) Put(ctx context.Context, e Entry) (err error) {
+	if e.Id == "" {
+		e.Id = svc.nextId()
+	}
+	if e.Created.IsZero() {
+		e.Created = time.Now().UTC()
+	}
+	if e.Trace == nil {
+		e.Trace = map[string]string{}
+		otel.GetTextMapPropagator().Inject(ctx, propagation.MapCarrier(e.Trace))
+	}
+	err = svc.save(e)
+	if err != nil {
+		err = fmt.Errorf("%w: %s", ErrPut, err)
+	}
+	if err == nil {
+		select {
+		case svc.notify <- struct{}{}:
+		default:
+		}
+	}
+	return
+}
+
+func (svc service) Run(ctx context.Context) {
+	for {
+		// taken before the pass, so the entries put meanwhile are not missed
+		mod := svc.modTime()
+		wait := svc.drain(ctx, context.WithoutCancel(ctx))
+		t := time.NewTimer(wait)
+		poll := time.NewTicker(pollInterval)
+		for waiting := true; waiting; {
+			select {
+			case <-ctx.Done():
+				t.Stop()
+				poll.Stop()
+				return
+			case <-svc.notify:
+				waiting = false
+			case <-t.C:
+				waiting = false
+			case <-poll.C:
+				waiting = svc.modTime().Equal(mod)
+			}
+		}
+		t.Stop()
+		poll.Stop()
+	}
+}
+
+// modTime returns the spool dir modification time, it changes when an entry is put or removed.
+func (svc service) modTime() (t time.Time) {
+	fi, err := os.Stat(svc.dir)
+	if err == nil {
+		t = fi.ModTime()
+	}
+	return
+}
+
+func (svc service) Depth() (n int, err error) {
+	var ids []string
+	ids, err = svc.list()
+	n = len(ids)
+	return
+}
+
+func (svc service) Flush(ctx context.Context) {
+	svc.drain(ctx, ctx)
+}
+
+// drain makes a single pass over the spooled entries and returns the time to wait before the next pass.
+// The pass stops when ctx is done, ctxWrite is used for the writes.
+func (svc service) drain(ctx, ctxWrite context.Context) (wait time.Duration) {
+	wait = svc.cfg.Retry.DelayMax
+	ids, err := svc.list()
+	if err != nil {
+		svc.log.Error("spool: failed to list", "dir", svc.dir, "err", err)
+		return
+	}
+	// keep the order of the entries of the same group and user: skip the rest after the failed one
+	blocked := map[string]bool{}
+	// the due entries of the same group and user to write at once
+	waves := map[string][]Entry{}
+	var keys []string
+	for _, id := range ids {
+		if ctx.Err() != nil {
+			break
+		}
+		var e Entry
+		e, err = svc.load(id)
+		if err != nil {
+			svc.log.Error("spool: failed to load the entry, skipping", "id", id, "err", err)
+			continue
+		}
+		k := e.Group + ":" + e.User
+		if blocked[k] {
+			continue
+		}
+		now := time.Now()
+		if e.Next.After(now) {
+			blocked[k] = true
+			wait = min(wait, e.Next.Sub(now))
+			continue
+		}
+		if _, found := waves[k]; !found {
+			keys = append(keys, k)
+		}
+		waves[k] = append(waves[k], e)
+		if len(waves[k]) >= int(svc.cfg.Concurrency) {
+			blocked[k] = svc.writeWave(ctxWrite, waves[k], &wait)
+			waves[k] = nil
+		}
+	}
+	for _, k := range keys {
+		if ctx.Err() == nil && len(waves[k]) > 0 {
+			svc.writeWave(ctxWrite, waves[k], &wait)
+		}
+	}
+	return
+}
+
+// writeWave writes the entries of the same group and user at once in the order, so the writer can batch them, and
+// returns whether any entry is left to write: the failed one retried and the ones after it, not written.
+// The wait is decreased to the nearest retry time.
+func (svc service) writeWave(ctxWrite context.Context, wave []Entry, wait *time.Duration) (left bool) {
+	ctxs := make([]context.Context, len(wave))
+	spans := make([]trace.Span, len(wave))
+	evts := make([]*pb.CloudEvent, len(wave))
+	for i, e := range wave {
+		ctxEntry := util.WithCorrelationId(ctxWrite, e.Envelope.CorrelationId)
+		ctxEntry = otel.GetTextMapPropagator().Extract(ctxEntry, propagation.MapCarrier(e.Trace))
+		ctxs[i], spans[i] = util.Tracer().Start(ctxEntry, "spool.write", trace.WithAttributes(
+			attribute.String("spool.id", e.Id),
+			attribute.Int("spool.attempts", int(e.Attempts)),
+		))
+		evts[i] = e.Event
+	}
+	// the writer and the retries follow the trace of the first entry
+	ackCount, errWrite := svc.writer.WriteBatch(ctxs[0], evts, wave[0].Group, wave[0].User)
+	for i, e := range wave {
+		ctxEntry := ctxs[i]
+		var err error
+		switch {
+		case i < int(ackCount):
+			util.SpanEnd(spans[i], nil)
+			err = svc.remove(e.Id)
+		case i > int(ackCount):
+			// not written after the failed one, keep the order
+			spans[i].End()
+			left = true
+		case errors.Is(errWrite, model.ErrContent), e.Attempts+1 >= svc.cfg.AttemptsMax:
+			util.SpanEnd(spans[i], errWrite)
+			svc.log.ErrorContext(ctxEntry, "spool: moving the entry to the dead letters", "id", e.Id, "attempts", e.Attempts+1, "err", errWrite)
+			_, err = svc.deadLetter.Put(ctxEntry, deadletter.Entry{
+				Envelope: e.Envelope,
+				Raw:      e.Raw,
+				Error:    errWrite.Error(),
+			})
+			if err == nil {
+				err = svc.remove(e.Id)
+			}
+			if i < len(wave)-1 {
+				// the ones after are due
+				*wait = 0
+			}
+		default:
+			util.SpanEnd(spans[i], errWrite)
+			e.Attempts++
+			delay := svc.retryDelay(e.Attempts)
+			e.Next = time.Now().Add(delay)
+			svc.log.WarnContext(ctxEntry, "spool: failed to write the entry, retrying", "id", e.Id, "attempts", e.Attempts, "delay", delay, "err", errWrite)
+			err = svc.save(e)
+			left = true
+			*wait = min(*wait, delay)
+		}
+		if err != nil {
+			svc.log.ErrorContext(ctxEntry, "spool: failed to update the entry", "id", e.Id, "err", err)
+		}
+	}
+	return
+}
+
+func (svc service) retryDelay(attempts uint32) (delay time.Duration) {
+	delay = svc.cfg.Retry.Delay
+	for i := uint32(1); i < attempts && delay < svc.cfg.Retry.DelayMax; i++ {
+		delay *= 2
+	}
+	delay = min(delay, svc.cfg.Retry.DelayMax)
+	return
+}
+
+// nextId returns the strictly increasing id, so the lexical order of the files is the order of the entries.
+func (svc service) nextId() string {
+	svc.idLock.Lock()
+	defer svc.idLock.Unlock()
+	id := time.Now().UnixNano()
+	if id <= *svc.idLast {
+		id = *svc.idLast + 1
+	}
+	*svc.idLast = id
+	return fmt.Sprintf("%020d", id)
+}
+
+func (svc service) list() (ids []string, err error) {
+	var files []os.DirEntry
+	files, err = os.ReadDir(svc.dir)
+	for _, f := range files {
+		name := f.Name()
+		if !f.IsDir() && strings.HasSuffix(name, fileExt) && !strings.HasPrefix(name, filePrefixTmp) {
+			ids = append(ids, strings.TrimSuffix(name, fileExt))
+		}
+	}
+	sort.Strings(ids)
+	return
+}
+
+func (svc service) load(id string) (e Entry, err error) {
+	var data []byte
+	data, err = os.ReadFile(svc.path(id))
+	var rec record
+	if err == nil {
+		err = json.Unmarshal(data, &rec)
+	}
+	evt := &pb.CloudEvent{}
+	if err == nil {
+		err = proto.Unmarshal(rec.Event, evt)
+	}
+	if err == nil {
+		e = Entry{
+			Id:       id,
+			Envelope: rec.Envelope,
+			Raw:      rec.Raw,
+			Event:    evt,
+			Group:    rec.Group,
+			User:     rec.User,
+			Attempts: rec.Attempts,
+			Created:  rec.Created,
+			Next:     rec.Next,
+			Trace:    rec.Trace,
+		}
+	}
+	return
+}
+
+func (svc service) save(e Entry) (err error) {
+	rec := record{
+		Envelope: e.Envelope,
+		Raw:      e.Raw,
+		Group:    e.Group,
+		User:     e.User,
+		Attempts: e.Attempts,
+		Created:  e.Created,
+		Next:     e.Next,
+		Trace:    e.Trace,
+	}
+	rec.Event, err = proto.Marshal(e.Event)
+	var data []byte
+	if err == nil {
+		data, err = json.Marshal(rec)
+	}
+	if err == nil {
+		err = util.WriteFileAtomic(svc.dir, e.Id+fileExt, filePrefixTmp, data)
+	}
+	return
+}
+
+func (svc service) remove(id string) (err error) {
+	err = os.Remove(svc.path(id))
+	if errors.Is(err, os.ErrNotExist) {
+		err = nil
+	}
+	return
+}
+
+func (svc service) path(id string) string {
+	return filepath.Join(svc.dir, id+fileExt)
+}
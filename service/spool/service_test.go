@@ -0,0 +1,465 @@
+package spool
+
+import (
+	"context"
+	"fmt"
+	"github.com/awakari/int-email/config"
+	"github.com/awakari/int-email/model"
+	"github.com/awakari/int-email/service/deadletter"
+	"github.com/awakari/int-email/service/writer"
+	"github.com/cloudevents/sdk-go/binding/format/protobuf/v2/pb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// writerStub fails the configured count of the writes per user and records the successful ones.
+// The writes for the "invalid" user and of the rejected events always fail permanently.
+type writerStub struct {
+	lock     sync.Mutex
+	failures map[string]int
+	rejected map[string]bool
+	written  []string
+	spans    []trace.SpanContext
+}
+
+func (w *writerStub) Close() error {
+	return nil
+}
+
+func (w *writerStub) Write(ctx context.Context, evt *pb.CloudEvent, groupId, userId string) (err error) {
+	_, err = w.WriteBatch(ctx, []*pb.CloudEvent{evt}, groupId, userId)
+	return
+}
+
+func (w *writerStub) WriteBatch(ctx context.Context, evts []*pb.CloudEvent, groupId, userId string) (ackCount uint32, err error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	for _, evt := range evts {
+		switch {
+		case userId == "invalid", w.rejected[evt.Id]:
+			err = fmt.Errorf("%w: %w", writer.ErrWrite, model.ErrContent)
+		case w.failures[userId] > 0:
+			w.failures[userId]--
+			err = writer.ErrWrite
+		}
+		if err != nil {
+			break
+		}
+		w.written = append(w.written, evt.Id)
+		w.spans = append(w.spans, trace.SpanContextFromContext(ctx))
+		ackCount++
+	}
+	return
+}
+
+func newEntry(id, user string) Entry {
+	return Entry{
+		Envelope: model.Envelope{
+			From: user + "@example.com",
+		},
+		Raw: []byte("Subject: " + id + "\r\n\r\nbody\r\n"),
+		Event: &pb.CloudEvent{
+			Id:     id,
+			Source: user,
+			Attributes: map[string]*pb.CloudEventAttributeValue{
+				"summary": {
+					Attr: &pb.CloudEventAttributeValue_CeString{
+						CeString: id,
+					},
+				},
+			},
+		},
+		Group: "default",
+		User:  user,
+	}
+}
+
+func TestService_Run(t *testing.T) {
+	cases := map[string]struct {
+		entries     []Entry
+		failures    map[string]int
+		attemptsMax uint32
+		passes      int
+		written     []string
+		left        int
+		dead        int
+	}{
+		"empty": {
+			attemptsMax: 3,
+			passes:      1,
+		},
+		"written in order": {
+			entries: []Entry{
+				newEntry("evt1", "john"),
+				newEntry("evt2", "jane"),
+				newEntry("evt3", "john"),
+			},
+			attemptsMax: 3,
+			passes:      1,
+			written: []string{
+				"evt1",
+				"evt2",
+				"evt3",
+			},
+		},
+		"failed entry blocks the same user only": {
+			entries: []Entry{
+				newEntry("evt1", "john"),
+				newEntry("evt2", "jane"),
+				newEntry("evt3", "john"),
+			},
+			failures: map[string]int{
+				"john": 1,
+			},
+			attemptsMax: 3,
+			passes:      1,
+			written: []string{
+				"evt2",
+			},
+			left: 2,
+		},
+		"retried": {
+			entries: []Entry{
+				newEntry("evt1", "john"),
+				newEntry("evt2", "jane"),
+				newEntry("evt3", "john"),
+			},
+			failures: map[string]int{
+				"john": 2,
+			},
+			attemptsMax: 3,
+			passes:      3,
+			written: []string{
+				"evt2",
+				"evt1",
+				"evt3",
+			},
+		},
+		"dead on permanent failure": {
+			entries: []Entry{
+				newEntry("evt1", "invalid"),
+				newEntry("evt2", "invalid"),
+				newEntry("evt3", "john"),
+			},
+			attemptsMax: 3,
+			passes:      1,
+			written: []string{
+				"evt3",
+			},
+			dead: 2,
+		},
+		"dead after attempts limit": {
+			entries: []Entry{
+				newEntry("evt1", "john"),
+				newEntry("evt2", "john"),
+			},
+			failures: map[string]int{
+				"john": 2,
+			},
+			attemptsMax: 2,
+			passes:      2,
+			written: []string{
+				"evt2",
+			},
+			dead: 1,
+		},
+	}
+	for k, c := range cases {
+		t.Run(k, func(t *testing.T) {
+			w := &writerStub{
+				failures: c.failures,
+			}
+			cfg := config.SpoolConfig{
+				Dir:         t.TempDir(),
+				AttemptsMax: c.attemptsMax,
+			}
+			cfg.Retry.DelayMax = time.Minute
+			dl, err := deadletter.NewService(t.TempDir())
+			require.Nil(t, err)
+			svc, err := NewService(cfg, w, dl, slog.Default())
+			require.Nil(t, err)
+			svc = NewLogging(svc, slog.Default())
+			for _, e := range c.entries {
+				err = svc.Put(context.TODO(), e)
+				require.Nil(t, err)
+			}
+			for i := 0; i < c.passes; i++ {
+				svc.(logging).svc.(service).drain(context.TODO(), context.TODO())
+			}
+			assert.Equal(t, c.written, w.written)
+			files, err := os.ReadDir(cfg.Dir)
+			require.Nil(t, err)
+			assert.Equal(t, c.left, len(files))
+			dead, err := dl.List(context.TODO())
+			require.Nil(t, err)
+			assert.Equal(t, c.dead, len(dead))
+		})
+	}
+}
+
+func TestService_Run_Concurrency(t *testing.T) {
+	cases := map[string]struct {
+		failures map[string]int
+		rejected map[string]bool
+		written  []string
+		left     int
+		dead     int
+	}{
+		"all written in order": {
+			written: []string{
+				"evt1",
+				"evt2",
+				"evt3",
+			},
+		},
+		"failed entry blocks the rest": {
+			failures: map[string]int{
+				"john": 1,
+			},
+			left: 3,
+		},
+		"failed entry blocks the ones after": {
+			rejected: map[string]bool{
+				"evt2": true,
+			},
+			written: []string{
+				"evt1",
+				"evt3",
+			},
+			dead: 1,
+		},
+	}
+	for k, c := range cases {
+		t.Run(k, func(t *testing.T) {
+			w := &writerStub{
+				failures: c.failures,
+				rejected: c.rejected,
+			}
+			cfg := config.SpoolConfig{
+				Dir:         t.TempDir(),
+				AttemptsMax: 3,
+				Concurrency: 2,
+			}
+			cfg.Retry.DelayMax = time.Minute
+			dl, err := deadletter.NewService(t.TempDir())
+			require.Nil(t, err)
+			svc, err := NewService(cfg, w, dl, slog.Default())
+			require.Nil(t, err)
+			for _, id := range []string{"evt1", "evt2", "evt3"} {
+				err = svc.Put(context.TODO(), newEntry(id, "john"))
+				require.Nil(t, err)
+			}
+			svc.(service).drain(context.TODO(), context.TODO())
+			assert.Equal(t, c.written, w.written)
+			files, err := os.ReadDir(cfg.Dir)
+			require.Nil(t, err)
+			assert.Equal(t, c.left, len(files))
+			dead, err := dl.List(context.TODO())
+			require.Nil(t, err)
+			assert.Equal(t, c.dead, len(dead))
+		})
+	}
+}
+
+func TestService_Run_Concurrency_Order(t *testing.T) {
+	w := &writerStub{
+		rejected: map[string]bool{
+			"evt2": true,
+		},
+	}
+	cfg := config.SpoolConfig{
+		Dir:         t.TempDir(),
+		AttemptsMax: 3,
+		Concurrency: 4,
+	}
+	cfg.Retry.DelayMax = time.Minute
+	dl, err := deadletter.NewService(t.TempDir())
+	require.Nil(t, err)
+	svc, err := NewService(cfg, w, dl, slog.Default())
+	require.Nil(t, err)
+	for _, id := range []string{"evt1", "evt2", "evt3", "evt4"} {
+		err = svc.Put(context.TODO(), newEntry(id, "john"))
+		require.Nil(t, err)
+	}
+	// the ones after the dead one are written by the next pass, without waiting
+	wait := svc.(service).drain(context.TODO(), context.TODO())
+	assert.Equal(t, time.Duration(0), wait)
+	assert.Equal(t, []string{"evt1"}, w.written)
+	svc.(service).drain(context.TODO(), context.TODO())
+	assert.Equal(t, []string{"evt1", "evt3", "evt4"}, w.written)
+	files, err := os.ReadDir(cfg.Dir)
+	require.Nil(t, err)
+	assert.Empty(t, files)
+}
+
+func TestService_Recovery(t *testing.T) {
+	cfg := config.SpoolConfig{
+		Dir:         t.TempDir(),
+		AttemptsMax: 3,
+	}
+	cfg.Retry.Delay = time.Hour
+	cfg.Retry.DelayMax = time.Hour
+	w := &writerStub{
+		failures: map[string]int{
+			"john": 1,
+		},
+	}
+	dl, err := deadletter.NewService(t.TempDir())
+	require.Nil(t, err)
+	svc, err := NewService(cfg, w, dl, slog.Default())
+	require.Nil(t, err)
+	e := newEntry("evt1", "john")
+	err = svc.Put(context.TODO(), e)
+	require.Nil(t, err)
+	wait := svc.(service).drain(context.TODO(), context.TODO())
+	assert.True(t, wait > 59*time.Minute)
+	assert.Empty(t, w.written)
+	// the interrupted write
+	err = os.WriteFile(filepath.Join(cfg.Dir, filePrefixTmp+"evt2"), []byte("{"), 0o600)
+	require.Nil(t, err)
+	abandoned := time.Now().Add(-2 * tmpAgeMin)
+	err = os.Chtimes(filepath.Join(cfg.Dir, filePrefixTmp+"evt2"), abandoned, abandoned)
+	require.Nil(t, err)
+	// the write in progress by another process
+	err = os.WriteFile(filepath.Join(cfg.Dir, filePrefixTmp+"evt3"), []byte("{"), 0o600)
+	require.Nil(t, err)
+
+	// restart
+	cfg.Retry.Delay = 0
+	svc, err = NewService(cfg, w, dl, slog.Default())
+	require.Nil(t, err)
+	_, err = os.Stat(filepath.Join(cfg.Dir, filePrefixTmp+"evt2"))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+	err = os.Remove(filepath.Join(cfg.Dir, filePrefixTmp+"evt3"))
+	require.Nil(t, err)
+	ids, err := svc.(service).list()
+	require.Nil(t, err)
+	require.Equal(t, 1, len(ids))
+	recovered, err := svc.(service).load(ids[0])
+	require.Nil(t, err)
+	assert.Equal(t, uint32(1), recovered.Attempts)
+	assert.Equal(t, e.Envelope, recovered.Envelope)
+	assert.Equal(t, e.Raw, recovered.Raw)
+	assert.Equal(t, "evt1", recovered.Event.Id)
+	assert.Equal(t, "evt1", recovered.Event.Attributes["summary"].GetCeString())
+
+	// not due yet
+	svc.(service).drain(context.TODO(), context.TODO())
+	assert.Empty(t, w.written)
+
+	ctx, cancel := context.WithTimeout(context.TODO(), 100*time.Millisecond)
+	defer cancel()
+	recovered.Next = time.Now()
+	err = svc.(service).save(recovered)
+	require.Nil(t, err)
+	svc.Run(ctx)
+	assert.Equal(t, []string{"evt1"}, w.written)
+	files, err := os.ReadDir(cfg.Dir)
+	require.Nil(t, err)
+	assert.Empty(t, files)
+}
+
+func TestService_Run_PutByAnotherProcess(t *testing.T) {
+	cfg := config.SpoolConfig{
+		Dir:         t.TempDir(),
+		AttemptsMax: 3,
+	}
+	cfg.Retry.DelayMax = time.Hour
+	w := &writerStub{}
+	dl, err := deadletter.NewService(t.TempDir())
+	require.Nil(t, err)
+	svc, err := NewService(cfg, w, dl, slog.Default())
+	require.Nil(t, err)
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+	go svc.Run(ctx)
+	// e.g. the replay
+	other, err := NewService(cfg, &writerStub{}, dl, slog.Default())
+	require.Nil(t, err)
+	time.Sleep(100 * time.Millisecond)
+	err = other.Put(context.TODO(), newEntry("evt1", "john"))
+	require.Nil(t, err)
+	assert.Eventually(t, func() bool {
+		w.lock.Lock()
+		defer w.lock.Unlock()
+		return len(w.written) == 1
+	}, 3*pollInterval, 100*time.Millisecond)
+}
+
+func TestService_Flush(t *testing.T) {
+	cfg := config.SpoolConfig{
+		Dir:         t.TempDir(),
+		AttemptsMax: 3,
+	}
+	cfg.Retry.Delay = time.Hour
+	cfg.Retry.DelayMax = time.Hour
+	w := &writerStub{
+		failures: map[string]int{
+			"john": 1,
+		},
+	}
+	dl, err := deadletter.NewService(t.TempDir())
+	require.Nil(t, err)
+	svc, err := NewService(cfg, w, dl, slog.Default())
+	require.Nil(t, err)
+	for _, e := range []Entry{newEntry("evt1", "john"), newEntry("evt2", "jane")} {
+		err = svc.Put(context.TODO(), e)
+		require.Nil(t, err)
+	}
+	depth, err := svc.Depth()
+	require.Nil(t, err)
+	assert.Equal(t, 2, depth)
+	svc.Flush(context.TODO())
+	assert.Equal(t, []string{"evt2"}, w.written)
+	depth, err = svc.Depth()
+	require.Nil(t, err)
+	assert.Equal(t, 1, depth)
+	// the failed entry is not due yet and stays for the next start
+	svc.Flush(context.TODO())
+	assert.Equal(t, []string{"evt2"}, w.written)
+	files, err := os.ReadDir(cfg.Dir)
+	require.Nil(t, err)
+	assert.Equal(t, 1, len(files))
+}
+
+func TestService_Tracing(t *testing.T) {
+	exp := tracetest.NewInMemoryExporter()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exp)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	cfg := config.SpoolConfig{
+		Dir:         t.TempDir(),
+		AttemptsMax: 3,
+	}
+	w := &writerStub{}
+	dl, err := deadletter.NewService(t.TempDir())
+	require.Nil(t, err)
+	svc, err := NewService(cfg, w, dl, slog.Default())
+	require.Nil(t, err)
+	ctx, span := otel.Tracer("test").Start(context.TODO(), "test")
+	err = svc.Put(ctx, newEntry("evt1", "john"))
+	span.End()
+	require.Nil(t, err)
+
+	// the write continues the trace of the put after the restart
+	svc, err = NewService(cfg, w, dl, slog.Default())
+	require.Nil(t, err)
+	svc.Flush(context.TODO())
+	require.Equal(t, 1, len(w.spans))
+	assert.Equal(t, span.SpanContext().TraceID(), w.spans[0].TraceID())
+	spans := exp.GetSpans()
+	require.Equal(t, 2, len(spans))
+	assert.Equal(t, "spool.write", spans[1].Name)
+	assert.Equal(t, w.spans[0].SpanID(), spans[1].SpanContext.SpanID())
+	assert.Equal(t, span.SpanContext().SpanID(), spans[1].Parent.SpanID())
+}
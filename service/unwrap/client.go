@@ -0,0 +1,51 @@
+package unwrap
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"syscall"
+)
+
+var ErrAddrNotPublic = errors.New("address is not public")
+
+// addrsShared is the carrier-grade NAT range, not routed publicly but not private by net/netip either.
+var addrsShared = netip.MustParsePrefix("100.64.0.0/10")
+
+// NewHttpClient returns the client not following the redirects and connecting to the public addresses only, so the
+// links in the messages can not reach the internal services. The address is checked after the name is resolved.
+func NewHttpClient() *http.Client {
+	d := &net.Dialer{
+		Control: dialPublic,
+	}
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext:       d.DialContext,
+			ForceAttemptHTTP2: true,
+			MaxIdleConns:      100,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+func dialPublic(_, address string, _ syscall.RawConn) (err error) {
+	var host string
+	host, _, err = net.SplitHostPort(address)
+	var addr netip.Addr
+	if err == nil {
+		addr, err = netip.ParseAddr(host)
+	}
+	if err == nil && !isPublic(addr) {
+		err = fmt.Errorf("%w: %s", ErrAddrNotPublic, addr)
+	}
+	return
+}
+
+func isPublic(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	return addr.IsGlobalUnicast() && !addr.IsPrivate() && !addrsShared.Contains(addr)
+}
@@ -0,0 +1,41 @@
+package unwrap
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+)
+
+func TestIsPublic(t *testing.T) {
+	cases := map[string]bool{
+		"93.184.216.34":   true,
+		"2606:2800::1":    true,
+		"127.0.0.1":       false,
+		"::1":             false,
+		"10.1.2.3":        false,
+		"172.16.0.1":      false,
+		"192.168.1.1":     false,
+		"169.254.169.254": false,
+		"100.64.0.1":      false,
+		"fd00::1":         false,
+		"fe80::1":         false,
+		"0.0.0.0":         false,
+		"::ffff:10.0.0.1": false,
+	}
+	for addr, public := range cases {
+		t.Run(addr, func(t *testing.T) {
+			assert.Equal(t, public, isPublic(netip.MustParseAddr(addr)))
+		})
+	}
+}
+
+func TestNewHttpClient(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "https://example.com/", http.StatusFound)
+	}))
+	defer srv.Close()
+	_, err := NewHttpClient().Get(srv.URL)
+	assert.ErrorIs(t, err, ErrAddrNotPublic)
+}
@@ -0,0 +1,36 @@
+package unwrap
+
+import (
+	"context"
+	"log/slog"
+)
+
+type logging struct {
+	svc Service
+	log *slog.Logger
+}
+
+func NewLogging(svc Service, log *slog.Logger) Service {
+	return logging{
+		svc: svc,
+		log: log,
+	}
+}
+
+func (l logging) Unwrap(ctx context.Context, src string) (dst string) {
+	dst = l.svc.Unwrap(ctx, src)
+	if dst != src {
+		l.log.DebugContext(ctx, "unwrap.Unwrap", "src", src, "dst", dst)
+	}
+	return
+}
+
+func (l logging) UnwrapAll(ctx context.Context, srcs []string) (dsts map[string]string) {
+	dsts = l.svc.UnwrapAll(ctx, srcs)
+	for src, dst := range dsts {
+		if dst != src {
+			l.log.DebugContext(ctx, "unwrap.UnwrapAll", "src", src, "dst", dst)
+		}
+	}
+	return
+}
@@ -0,0 +1,192 @@
+package unwrap
+
+import (
+	"context"
+	"github.com/awakari/int-email/config"
+	"github.com/hashicorp/golang-lru/v2/expirable"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// Service resolves the click tracking links to the links of the original content.
+type Service interface {
+
+	// Unwrap returns the cleaned target url of the tracking link.
+	// The link is returned cleaned only when it's not a tracking one or the target can not be found.
+	Unwrap(ctx context.Context, src string) (dst string)
+
+	// UnwrapAll unwraps the links concurrently and returns the target urls by the source ones. The links not followed
+	// within the overall deadline are unwrapped as much as possible without following.
+	UnwrapAll(ctx context.Context, srcs []string) (dsts map[string]string)
+}
+
+// HttpClient sends the requests to follow the redirects of the opaque tracking links.
+// The client should not follow the redirects itself, see http.ErrUseLastResponse.
+type HttpClient interface {
+	Do(req *http.Request) (resp *http.Response, err error)
+}
+
+type service struct {
+	client  HttpClient
+	cfg     config.UnwrapConfig
+	follows *expirable.LRU[string, string]
+}
+
+// trackingParams are removed from the target urls, the trailing "*" matches any suffix.
+var trackingParams = []string{
+	"utm_*",
+	"mc_cid",
+	"mc_eid",
+	"_hsenc",
+	"_hsmi",
+	"__hstc",
+	"__hssc",
+	"__hsfp",
+	"ck_subscriber_id",
+	"fbclid",
+	"gclid",
+	"mkt_tok",
+	"sg_uid",
+}
+
+// NewService returns the service following the redirects when the client is not nil.
+func NewService(client HttpClient, cfg config.UnwrapConfig) Service {
+	svc := service{
+		client: client,
+		cfg:    cfg,
+	}
+	if client != nil {
+		svc.follows = expirable.NewLRU[string, string](int(cfg.Follow.Cache.Size), nil, cfg.Follow.Cache.Ttl)
+	}
+	return svc
+}
+
+func (svc service) Unwrap(ctx context.Context, src string) (dst string) {
+	ctx, cancel := svc.withDeadline(ctx)
+	defer cancel()
+	dst = svc.unwrap(ctx, src)
+	return
+}
+
+func (svc service) UnwrapAll(ctx context.Context, srcs []string) (dsts map[string]string) {
+	ctx, cancel := svc.withDeadline(ctx)
+	defer cancel()
+	dsts = make(map[string]string, len(srcs))
+	lock := &sync.Mutex{}
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, max(1, svc.cfg.Follow.Concurrency))
+	seen := map[string]bool{}
+	for _, src := range srcs {
+		if seen[src] {
+			continue
+		}
+		seen[src] = true
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			dst := svc.unwrap(ctx, src)
+			<-sem
+			lock.Lock()
+			defer lock.Unlock()
+			dsts[src] = dst
+		}()
+	}
+	wg.Wait()
+	return
+}
+
+// withDeadline limits the time spent on following the links of the single message.
+func (svc service) withDeadline(ctx context.Context) (context.Context, context.CancelFunc) {
+	if svc.client == nil {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, svc.cfg.Follow.Deadline)
+}
+
+func (svc service) unwrap(ctx context.Context, src string) (dst string) {
+	dst = src
+	for hop := uint32(0); hop <= svc.cfg.Follow.HopsMax; hop++ {
+		u, err := url.Parse(dst)
+		if err != nil {
+			return
+		}
+		t := trackerOf(u)
+		if t == nil {
+			break
+		}
+		var next string
+		if t.decode != nil {
+			next = t.decode(u)
+		}
+		if next == "" && svc.client != nil && t.follow {
+			next = svc.follow(ctx, dst)
+		}
+		if next == "" {
+			break
+		}
+		dst = next
+	}
+	dst = Clean(dst)
+	return
+}
+
+// follow returns the redirect location of the link, empty if not redirected.
+func (svc service) follow(ctx context.Context, src string) (dst string) {
+	var found bool
+	if dst, found = svc.follows.Get(src); found {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, svc.cfg.Follow.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, src, nil)
+	var resp *http.Response
+	if err == nil {
+		resp, err = svc.client.Do(req)
+	}
+	if err == nil {
+		_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+		_ = resp.Body.Close()
+		var loc *url.URL
+		if resp.StatusCode >= 300 && resp.StatusCode < 400 {
+			loc, err = resp.Location()
+		}
+		if err == nil && loc != nil && isHttpUrl(loc.String()) {
+			dst = loc.String()
+		}
+	}
+	if err == nil {
+		// cache the links not redirected too, but not the failures
+		svc.follows.Add(src, dst)
+	}
+	return
+}
+
+// Clean removes the tracking parameters from the url query. The url is returned as is when nothing is removed.
+func Clean(src string) (dst string) {
+	dst = src
+	u, err := url.Parse(src)
+	if err != nil || u.RawQuery == "" {
+		return
+	}
+	q := u.Query()
+	var removed bool
+	for k := range q {
+		for _, p := range trackingParams {
+			prefix, wildcard := strings.CutSuffix(p, "*")
+			if k == p || (wildcard && strings.HasPrefix(k, prefix)) {
+				q.Del(k)
+				removed = true
+				break
+			}
+		}
+	}
+	if removed {
+		u.RawQuery = q.Encode()
+		dst = u.String()
+	}
+	return
+}
@@ -0,0 +1,219 @@
+package unwrap
+
+import (
+	"bytes"
+	"compress/zlib"
+	"context"
+	"encoding/base64"
+	"errors"
+	"github.com/awakari/int-email/config"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// clientStub redirects by the configured locations, after the delay if set.
+type clientStub struct {
+	lock      sync.Mutex
+	locations map[string]string
+	delay     time.Duration
+	requests  int
+}
+
+func (c *clientStub) Do(req *http.Request) (resp *http.Response, err error) {
+	c.lock.Lock()
+	c.requests++
+	c.lock.Unlock()
+	if c.delay > 0 {
+		select {
+		case <-req.Context().Done():
+			err = req.Context().Err()
+			return
+		case <-time.After(c.delay):
+		}
+	}
+	resp = &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{},
+		Body:       io.NopCloser(strings.NewReader("")),
+		Request:    req,
+	}
+	loc, found := c.locations[req.URL.String()]
+	switch {
+	case !found:
+	case loc == "":
+		err = errors.New("connection refused")
+	default:
+		resp.StatusCode = http.StatusFound
+		resp.Header.Set("Location", loc)
+	}
+	return
+}
+
+func zlibBase64(t *testing.T, src string) string {
+	buf := &bytes.Buffer{}
+	w := zlib.NewWriter(buf)
+	_, err := w.Write([]byte(src))
+	assert.Nil(t, err)
+	assert.Nil(t, w.Close())
+	return base64.RawURLEncoding.EncodeToString(buf.Bytes())
+}
+
+func TestService_Unwrap(t *testing.T) {
+	cfg := config.UnwrapConfig{}
+	cfg.Follow.Timeout = time.Second
+	cfg.Follow.HopsMax = 3
+	cfg.Follow.Deadline = time.Second
+	cfg.Follow.Cache.Size = 10
+	cfg.Follow.Cache.Ttl = time.Minute
+	cases := map[string]struct {
+		src       string
+		follow    bool
+		locations map[string]string
+		dst       string
+	}{
+		"not a tracking link": {
+			src: "https://example.com/post?id=1",
+			dst: "https://example.com/post?id=1",
+		},
+		"not a tracking link, cleaned": {
+			src: "https://example.com/post?id=1&utm_source=newsletter&utm_medium=email&mc_cid=abc",
+			dst: "https://example.com/post?id=1",
+		},
+		"invalid": {
+			src: "https://exa mple.com/%zz",
+			dst: "https://exa mple.com/%zz",
+		},
+		"govdelivery": {
+			src: "https://links-1.govdelivery.com/CL0/https:%2F%2Fwww.example.gov%2Fagenda%3Fid=7%26utm_source=govdelivery/1/0100018f-abcd/AbCdEf=123",
+			dst: "https://www.example.gov/agenda?id=7",
+		},
+		"substack": {
+			src: "https://substack.com/redirect/2/" +
+				base64.RawURLEncoding.EncodeToString([]byte(`{"e":"https://example.com/p/post?utm_source=substack","p":123,"s":456}`)) +
+				".signature?j=token",
+			dst: "https://example.com/p/post",
+		},
+		"convertkit": {
+			src: "https://click.convertkit-mail.com/abc123/xyz789/" + base64.StdEncoding.EncodeToString([]byte("https://example.com/article")),
+			dst: "https://example.com/article",
+		},
+		"mailgun": {
+			src: "https://email.mg.example.com/c/" + zlibBase64(t, `{"h":"abc","l":"https://example.com/mailgun?ck_subscriber_id=1","r":"john@example.com"}`),
+			dst: "https://example.com/mailgun",
+		},
+		"mailgun, too long": {
+			src: "https://email.mg.example.com/c/" + zlibBase64(t, `{"l":"https://example.com/mailgun","p":"`+strings.Repeat("a", 1<<20)+`"}`),
+			dst: "https://email.mg.example.com/c/" + zlibBase64(t, `{"l":"https://example.com/mailgun","p":"`+strings.Repeat("a", 1<<20)+`"}`),
+		},
+		"beehiiv with the target": {
+			src: "https://link.mail.beehiiv.com/v1/c/abc?redirect=https%3A%2F%2Fexample.com%2Fissue",
+			dst: "https://example.com/issue",
+		},
+		"opaque, not followed": {
+			src: "https://example.us1.list-manage.com/track/click?u=abc&id=def&e=123",
+			dst: "https://example.us1.list-manage.com/track/click?u=abc&id=def&e=123",
+		},
+		"opaque, followed": {
+			src:    "https://example.us1.list-manage.com/track/click?u=abc&id=def&e=123",
+			follow: true,
+			locations: map[string]string{
+				"https://example.us1.list-manage.com/track/click?u=abc&id=def&e=123": "https://u123.ct.sendgrid.net/ls/click?upn=xyz",
+				"https://u123.ct.sendgrid.net/ls/click?upn=xyz":                      "https://example.com/landing?utm_campaign=spring",
+			},
+			dst: "https://example.com/landing",
+		},
+		"custom tracking domain, not followed": {
+			src:    "https://email.mg.example.com/c/opaque",
+			follow: true,
+			locations: map[string]string{
+				"https://email.mg.example.com/c/opaque": "https://example.com/landing",
+			},
+			dst: "https://email.mg.example.com/c/opaque",
+		},
+		"opaque, follow failed": {
+			src:    "https://hs.hubspotlinks.com/Ctc/abc",
+			follow: true,
+			locations: map[string]string{
+				"https://hs.hubspotlinks.com/Ctc/abc": "",
+			},
+			dst: "https://hs.hubspotlinks.com/Ctc/abc",
+		},
+	}
+	for k, c := range cases {
+		t.Run(k, func(t *testing.T) {
+			var client HttpClient
+			if c.follow {
+				client = &clientStub{
+					locations: c.locations,
+				}
+			}
+			svc := NewService(client, cfg)
+			assert.Equal(t, c.dst, svc.Unwrap(context.TODO(), c.src))
+		})
+	}
+}
+
+func TestService_Unwrap_Cached(t *testing.T) {
+	cfg := config.UnwrapConfig{}
+	cfg.Follow.Timeout = time.Second
+	cfg.Follow.HopsMax = 3
+	cfg.Follow.Deadline = time.Second
+	cfg.Follow.Cache.Size = 10
+	cfg.Follow.Cache.Ttl = time.Minute
+	src := "https://u123.ct.sendgrid.net/ls/click?upn=xyz"
+	client := &clientStub{
+		locations: map[string]string{
+			src: "https://example.com/landing",
+		},
+	}
+	svc := NewService(client, cfg)
+	assert.Equal(t, "https://example.com/landing", svc.Unwrap(context.TODO(), src))
+	assert.Equal(t, "https://example.com/landing", svc.Unwrap(context.TODO(), src))
+	assert.Equal(t, 1, client.requests)
+}
+
+func TestService_UnwrapAll(t *testing.T) {
+	cfg := config.UnwrapConfig{}
+	cfg.Follow.Timeout = time.Minute
+	cfg.Follow.HopsMax = 3
+	cfg.Follow.Deadline = 100 * time.Millisecond
+	cfg.Follow.Concurrency = 2
+	cfg.Follow.Cache.Size = 10
+	cfg.Follow.Cache.Ttl = time.Minute
+	client := &clientStub{
+		locations: map[string]string{
+			"https://u1.ct.sendgrid.net/ls/click?upn=1": "https://example.com/1",
+			"https://u1.ct.sendgrid.net/ls/click?upn=2": "https://example.com/2",
+			"https://u1.ct.sendgrid.net/ls/click?upn=3": "https://example.com/3",
+		},
+		delay: time.Minute,
+	}
+	svc := NewService(client, cfg)
+	srcs := []string{
+		"https://u1.ct.sendgrid.net/ls/click?upn=1",
+		"https://u1.ct.sendgrid.net/ls/click?upn=2",
+		"https://u1.ct.sendgrid.net/ls/click?upn=3",
+		"https://u1.ct.sendgrid.net/ls/click?upn=1",
+		"https://example.com/post?utm_source=newsletter",
+	}
+	t0 := time.Now()
+	dsts := svc.UnwrapAll(context.TODO(), srcs)
+	assert.Less(t, time.Since(t0), 10*time.Second)
+	// not followed within the deadline
+	assert.Equal(t, map[string]string{
+		"https://u1.ct.sendgrid.net/ls/click?upn=1":      "https://u1.ct.sendgrid.net/ls/click?upn=1",
+		"https://u1.ct.sendgrid.net/ls/click?upn=2":      "https://u1.ct.sendgrid.net/ls/click?upn=2",
+		"https://u1.ct.sendgrid.net/ls/click?upn=3":      "https://u1.ct.sendgrid.net/ls/click?upn=3",
+		"https://example.com/post?utm_source=newsletter": "https://example.com/post",
+	}, dsts)
+	// followed concurrently
+	client.delay = 50 * time.Millisecond
+	dsts = svc.UnwrapAll(context.TODO(), srcs)
+	assert.Equal(t, "https://example.com/1", dsts["https://u1.ct.sendgrid.net/ls/click?upn=1"])
+	assert.Equal(t, "https://example.com/2", dsts["https://u1.ct.sendgrid.net/ls/click?upn=2"])
+}
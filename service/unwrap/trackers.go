@@ -0,0 +1,196 @@
+package unwrap
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// tracker describes the click tracking links of the particular email service provider.
+type tracker struct {
+	name  string
+	match func(u *url.URL) bool
+	// decode returns the target url embedded into the tracking link, empty when the link is opaque
+	// and the target is known only by following the redirect.
+	decode func(u *url.URL) string
+	// follow is true when the link may be requested: the tracker hosts are the provider's own domains,
+	// not the custom ones anybody may point anywhere.
+	follow bool
+}
+
+// jsonSegmentLenMax limits the decompressed JSON segment, the bigger one is not a tracking link payload but a zip bomb.
+const jsonSegmentLenMax = 4 << 10
+
+var trackers = []tracker{
+	{
+		name:   "govdelivery",
+		match:  hostSuffix("govdelivery.com"),
+		decode: decodeEscapedSegment,
+		follow: true,
+	},
+	{
+		name:  "substack",
+		match: hostPath("substack.com", "/redirect/"),
+		decode: func(u *url.URL) string {
+			return firstOf(decodeJsonSegment(u), decodeQueryParam(u, "url"))
+		},
+		follow: true,
+	},
+	{
+		name:   "convertkit",
+		match:  hostSuffix("convertkit-mail.com", "convertkit-mail2.com", "convertkit-mail3.com", "convertkit-mail4.com", "ck.page", "kit-mail3.com"),
+		decode: decodeBase64Segment,
+		follow: true,
+	},
+	{
+		// the custom tracking domains are like email.example.com, never requested
+		name: "mailgun",
+		match: func(u *url.URL) bool {
+			return strings.HasPrefix(u.Hostname(), "email.") && strings.HasPrefix(u.Path, "/c/")
+		},
+		decode: decodeJsonSegment,
+	},
+	{
+		name:   "mailchimp",
+		match:  hostSuffix("list-manage.com"),
+		follow: true,
+	},
+	{
+		name:   "sendgrid",
+		match:  hostSuffix("sendgrid.net"),
+		follow: true,
+	},
+	{
+		name:  "beehiiv",
+		match: hostSuffix("beehiiv.com"),
+		decode: func(u *url.URL) string {
+			return decodeQueryParam(u, "redirect")
+		},
+		follow: true,
+	},
+	{
+		name:   "hubspot",
+		match:  hostSuffix("hubspotlinks.com", "hubspotemail.net", "hs-sites.com"),
+		follow: true,
+	},
+}
+
+// trackerOf returns the tracker of the link, nil when the link is not a known tracking one.
+func trackerOf(u *url.URL) *tracker {
+	for i := range trackers {
+		if trackers[i].match(u) {
+			return &trackers[i]
+		}
+	}
+	return nil
+}
+
+func hostSuffix(domains ...string) func(u *url.URL) bool {
+	return func(u *url.URL) bool {
+		host := strings.ToLower(u.Hostname())
+		for _, d := range domains {
+			if host == d || strings.HasSuffix(host, "."+d) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+func hostPath(domain, pathPrefix string) func(u *url.URL) bool {
+	matchHost := hostSuffix(domain)
+	return func(u *url.URL) bool {
+		return matchHost(u) && strings.HasPrefix(u.Path, pathPrefix)
+	}
+}
+
+func firstOf(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+func isHttpUrl(s string) bool {
+	return strings.HasPrefix(s, "https://") || strings.HasPrefix(s, "http://")
+}
+
+func segments(u *url.URL) []string {
+	return strings.Split(strings.Trim(u.EscapedPath(), "/"), "/")
+}
+
+// decodeEscapedSegment finds the path segment being the url-escaped target, e.g. "https:%2F%2Fexample.com%2F".
+func decodeEscapedSegment(u *url.URL) string {
+	for _, seg := range segments(u) {
+		if v, err := url.PathUnescape(seg); err == nil && isHttpUrl(v) {
+			return v
+		}
+	}
+	return ""
+}
+
+func decodeQueryParam(u *url.URL, name string) string {
+	if v := u.Query().Get(name); isHttpUrl(v) {
+		return v
+	}
+	return ""
+}
+
+// decodeBase64Segment finds the path segment being the base64-encoded target.
+func decodeBase64Segment(u *url.URL) string {
+	for _, seg := range segments(u) {
+		if v := string(decodeBase64(seg)); isHttpUrl(v) {
+			return v
+		}
+	}
+	return ""
+}
+
+// decodeJsonSegment finds the path segment being the base64-encoded JSON object, optionally zlib-compressed
+// or followed by the signature like in JWT, and returns the first url value of the object.
+func decodeJsonSegment(u *url.URL) string {
+	for _, seg := range segments(u) {
+		payload, _, _ := strings.Cut(seg, ".")
+		data := decodeBase64(payload)
+		if r, err := zlib.NewReader(bytes.NewReader(data)); err == nil {
+			data, _ = io.ReadAll(io.LimitReader(r, jsonSegmentLenMax+1))
+			if len(data) > jsonSegmentLenMax {
+				continue
+			}
+		}
+		var obj map[string]any
+		if json.Unmarshal(data, &obj) != nil {
+			continue
+		}
+		keys := make([]string, 0, len(obj))
+		for k := range obj {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			if v, ok := obj[k].(string); ok && isHttpUrl(v) {
+				return v
+			}
+		}
+	}
+	return ""
+}
+
+func decodeBase64(s string) (data []byte) {
+	s, _ = url.PathUnescape(s)
+	s = strings.TrimRight(s, "=")
+	for _, enc := range []*base64.Encoding{base64.RawURLEncoding, base64.RawStdEncoding} {
+		var err error
+		if data, err = enc.DecodeString(s); err == nil {
+			return
+		}
+	}
+	return nil
+}
@@ -0,0 +1,175 @@
+package writer
+
+import (
+	"errors"
+	"github.com/awakari/client-sdk-go/api/grpc/permits"
+	"github.com/awakari/client-sdk-go/api/grpc/resolver"
+	"github.com/awakari/int-email/config"
+	modelEmail "github.com/awakari/int-email/model"
+	"github.com/hashicorp/golang-lru/v2/expirable"
+	"sync"
+	"time"
+)
+
+// Breaker stops the writes to the unavailable Awakari API for a while, so the callers fail fast instead of the retries.
+// There is the breaker per group and user and the global one. The breaker opens after the configured count of the
+// consecutive failures. After the timeout, the breaker is half-open: the single probe write is allowed, the breaker
+// closes when the probe succeeds and opens again otherwise.
+type Breaker interface {
+
+	// Allow returns ErrUnavailable when the write should fail fast.
+	// The allowed write result should be reported by Done.
+	Allow(groupId, userId string) (err error)
+
+	// Done reports the result of the allowed write, only the unavailability is the failure.
+	Done(groupId, userId string, err error)
+
+	// Open returns true while the breaker of the group and user or the global one is open and not timed out.
+	// The global breaker only is checked when both are empty.
+	Open(groupId, userId string) (open bool)
+}
+
+// the states of the breaker, also the values of the state metric
+const (
+	stateClosed = iota
+	stateHalfOpen
+	stateOpen
+)
+
+var ErrUnavailable = modelEmail.NewError("writer is unavailable, retry later", modelEmail.ErrTemporary)
+
+type circuit struct {
+	state    int
+	failures uint32
+	opened   time.Time
+	probing  bool
+}
+
+type breaker struct {
+	lock     *sync.Mutex
+	global   *circuit
+	circuits *expirable.LRU[string, *circuit]
+	cfg      config.WriterBreakerConfig
+	now      func() time.Time
+}
+
+// NewBreaker returns the breaker, the breaker never opens when the failures count is zero.
+func NewBreaker(cfg config.WriterBreakerConfig) Breaker {
+	return breaker{
+		lock:     &sync.Mutex{},
+		global:   &circuit{},
+		circuits: expirable.NewLRU[string, *circuit](int(cfg.Size), nil, 0),
+		cfg:      cfg,
+		now:      time.Now,
+	}
+}
+
+func (b breaker) Allow(groupId, userId string) (err error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	now := b.now()
+	probeGlobal, err := b.global.allow(now, b.cfg.Timeout)
+	if err == nil {
+		c, found := b.circuits.Get(writerKey(groupId, userId))
+		if found {
+			_, err = c.allow(now, b.cfg.Timeout)
+		}
+		if err != nil && probeGlobal {
+			// the write is not done, let another one probe
+			b.global.probing = false
+		}
+	}
+	if err != nil {
+		breakerRejections.Inc()
+	}
+	breakerState.Set(float64(b.global.state))
+	return
+}
+
+func (b breaker) Done(groupId, userId string, err error) {
+	failed := errors.Is(err, resolver.ErrUnavailable) || errors.Is(err, permits.ErrUnavailable)
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	now := b.now()
+	if b.global.done(now, failed, b.cfg.FailuresGlobal) {
+		breakerOpens.WithLabelValues("global").Inc()
+	}
+	k := writerKey(groupId, userId)
+	c, found := b.circuits.Get(k)
+	switch {
+	case found:
+		if c.done(now, failed, b.cfg.Failures) {
+			breakerOpens.WithLabelValues("user").Inc()
+		}
+		if c.state == stateClosed && c.failures == 0 {
+			// keep the failing ones only
+			b.circuits.Remove(k)
+		}
+	case failed:
+		c = &circuit{}
+		if c.done(now, failed, b.cfg.Failures) {
+			breakerOpens.WithLabelValues("user").Inc()
+		}
+		b.circuits.Add(k, c)
+	}
+	breakerState.Set(float64(b.global.state))
+}
+
+func (b breaker) Open(groupId, userId string) (open bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	now := b.now()
+	open = b.global.open(now, b.cfg.Timeout)
+	if !open && (groupId != "" || userId != "") {
+		c, found := b.circuits.Get(writerKey(groupId, userId))
+		open = found && c.open(now, b.cfg.Timeout)
+	}
+	return
+}
+
+// allow returns the error when the call is not allowed, or whether the allowed call is the half-open probe.
+func (c *circuit) allow(now time.Time, timeout time.Duration) (probe bool, err error) {
+	if c.state == stateOpen && now.Sub(c.opened) >= timeout {
+		c.state = stateHalfOpen
+		c.probing = false
+	}
+	switch {
+	case c.state == stateClosed:
+	case c.probing:
+		err = ErrUnavailable
+	case c.state == stateHalfOpen:
+		c.probing = true
+		probe = true
+	default:
+		err = ErrUnavailable
+	}
+	return
+}
+
+// done updates the circuit with the call result, returns true when the circuit opens.
+func (c *circuit) done(now time.Time, failed bool, failuresMax uint32) (opened bool) {
+	switch c.state {
+	case stateClosed:
+		c.failures++
+		if !failed {
+			c.failures = 0
+		}
+		opened = failuresMax > 0 && c.failures >= failuresMax
+	case stateHalfOpen:
+		c.probing = false
+		c.failures = 0
+		c.state = stateClosed
+		opened = failed
+	default:
+		// the result of the write allowed before the circuit opened doesn't change anything
+	}
+	if opened {
+		c.state = stateOpen
+		c.opened = now
+	}
+	return
+}
+
+func (c *circuit) open(now time.Time, timeout time.Duration) bool {
+	return c.state == stateOpen && now.Sub(c.opened) < timeout
+}
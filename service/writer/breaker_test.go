@@ -0,0 +1,123 @@
+package writer
+
+import (
+	"errors"
+	"github.com/awakari/client-sdk-go/api/grpc/permits"
+	"github.com/awakari/client-sdk-go/api/grpc/resolver"
+	"github.com/awakari/int-email/config"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestBreaker(t *testing.T) {
+	type step struct {
+		// the seconds since the start
+		at   int
+		user string
+		// the write result, the write is not done when not allowed
+		result error
+		// whether the write is allowed
+		allowed bool
+		// the write is in progress, not done yet
+		pending bool
+	}
+	cases := map[string]struct {
+		steps []step
+		// whether the global breaker is open after the steps
+		open bool
+	}{
+		"other errors don't open": {
+			steps: []step{
+				{user: "john", result: errors.New("invalid event"), allowed: true},
+				{user: "john", result: errNoAck, allowed: true},
+				{user: "john", allowed: true},
+			},
+		},
+		"opens for the user": {
+			steps: []step{
+				{user: "john", result: resolver.ErrUnavailable, allowed: true},
+				{user: "john", result: permits.ErrUnavailable, allowed: true},
+				{user: "john"},
+				{user: "jane", allowed: true},
+			},
+		},
+		"success resets the failures": {
+			steps: []step{
+				{user: "john", result: resolver.ErrUnavailable, allowed: true},
+				{user: "john", allowed: true},
+				{user: "john", result: resolver.ErrUnavailable, allowed: true},
+				{user: "john", allowed: true},
+			},
+		},
+		"opens globally": {
+			steps: []step{
+				{user: "john", result: resolver.ErrUnavailable, allowed: true},
+				{user: "jane", result: resolver.ErrUnavailable, allowed: true},
+				{user: "jack", result: resolver.ErrUnavailable, allowed: true},
+				{user: "jill"},
+			},
+			open: true,
+		},
+		"single probe closes": {
+			steps: []step{
+				{user: "john", result: resolver.ErrUnavailable, allowed: true},
+				{user: "john", result: resolver.ErrUnavailable, allowed: true},
+				{at: 29, user: "john"},
+				{at: 30, user: "john", allowed: true},
+				{at: 30, user: "john", allowed: true},
+			},
+		},
+		"no concurrent probes": {
+			steps: []step{
+				{user: "john", result: resolver.ErrUnavailable, allowed: true},
+				{user: "john", result: resolver.ErrUnavailable, allowed: true},
+				{at: 30, user: "john", allowed: true, pending: true},
+				{at: 31, user: "john"},
+			},
+		},
+		"failed probe opens again": {
+			steps: []step{
+				{user: "john", result: resolver.ErrUnavailable, allowed: true},
+				{user: "john", result: resolver.ErrUnavailable, allowed: true},
+				{at: 30, user: "john", result: resolver.ErrUnavailable, allowed: true},
+				{at: 59, user: "john"},
+				{at: 60, user: "john", allowed: true},
+			},
+		},
+		"global probe": {
+			steps: []step{
+				{user: "john", result: resolver.ErrUnavailable, allowed: true},
+				{user: "jane", result: resolver.ErrUnavailable, allowed: true},
+				{user: "jack", result: resolver.ErrUnavailable, allowed: true},
+				{at: 30, user: "jill", allowed: true},
+				{at: 30, user: "jack", allowed: true},
+			},
+		},
+	}
+	for k, c := range cases {
+		t.Run(k, func(t *testing.T) {
+			b := NewBreaker(config.WriterBreakerConfig{
+				Failures:       2,
+				FailuresGlobal: 3,
+				Timeout:        30 * time.Second,
+				Size:           10,
+			}).(breaker)
+			start := time.Now()
+			for i, s := range c.steps {
+				b.now = func() time.Time {
+					return start.Add(time.Duration(s.at) * time.Second)
+				}
+				err := b.Allow("default", s.user)
+				assert.Equal(t, s.allowed, err == nil, i)
+				switch {
+				case err != nil:
+					assert.ErrorIs(t, err, ErrUnavailable)
+				case !s.pending:
+					b.Done("default", s.user, s.result)
+				}
+			}
+			assert.Equal(t, c.open, b.Open("", ""))
+		})
+	}
+}
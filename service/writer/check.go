@@ -0,0 +1,22 @@
+package writer
+
+import (
+	"context"
+	"github.com/awakari/client-sdk-go/api"
+	"github.com/awakari/client-sdk-go/model"
+	"github.com/cloudevents/sdk-go/binding/format/protobuf/v2/pb"
+	"google.golang.org/grpc/metadata"
+)
+
+// NewReachabilityCheck returns the check opening a new writer to make sure the Awakari API is reachable.
+func NewReachabilityCheck(clientAwk api.Client, groupId, userId string) func(ctx context.Context) (err error) {
+	return func(ctx context.Context) (err error) {
+		ctxGroupId := metadata.AppendToOutgoingContext(ctx, "x-awakari-group-id", groupId)
+		var w model.Writer[*pb.CloudEvent]
+		w, err = clientAwk.OpenMessagesWriter(ctxGroupId, userId)
+		if err == nil {
+			err = w.Close()
+		}
+		return
+	}
+}
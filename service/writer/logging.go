@@ -2,7 +2,6 @@ package writer
 
 import (
 	"context"
-	"fmt"
 	"github.com/awakari/int-email/util"
 	"github.com/cloudevents/sdk-go/binding/format/protobuf/v2/pb"
 	"log/slog"
@@ -22,12 +21,18 @@ func NewLogging(svc Service, log *slog.Logger) Service {
 
 func (l logging) Close() (err error) {
 	err = l.svc.Close()
-	l.log.Log(context.TODO(), util.LogLevel(err), fmt.Sprintf("writer.Close(): %s", err))
+	l.log.Log(context.TODO(), util.LogLevel(err), "writer.Close", "err", err)
 	return
 }
 
 func (l logging) Write(ctx context.Context, evt *pb.CloudEvent, groupId, userId string) (err error) {
 	err = l.svc.Write(ctx, evt, groupId, userId)
-	l.log.Log(ctx, util.LogLevel(err), fmt.Sprintf("writer.Write(evt=%s, groupId=%s, userId=%s): %s", evt.Id, groupId, userId, err))
+	l.log.Log(ctx, util.LogLevel(err), "writer.Write", "evtId", evt.Id, "groupId", groupId, "userId", userId, "err", err)
+	return
+}
+
+func (l logging) WriteBatch(ctx context.Context, evts []*pb.CloudEvent, groupId, userId string) (ackCount uint32, err error) {
+	ackCount, err = l.svc.WriteBatch(ctx, evts, groupId, userId)
+	l.log.Log(ctx, util.LogLevel(err), "writer.WriteBatch", "count", len(evts), "ackCount", ackCount, "groupId", groupId, "userId", userId, "err", err)
 	return
 }
@@ -0,0 +1,141 @@
+package writer
+
+import (
+	"context"
+	"errors"
+	modelEmail "github.com/awakari/int-email/model"
+	"github.com/cloudevents/sdk-go/binding/format/protobuf/v2/pb"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"time"
+)
+
+var writeDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+	Namespace: "int_email",
+	Subsystem: "writer",
+	Name:      "write_duration_seconds",
+	Help:      "Event write duration including the retries",
+	Buckets:   prometheus.ExponentialBuckets(0.001, 2, 16), // 1 ms .. 32 s
+})
+
+var writes = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "int_email",
+		Subsystem: "writer",
+		Name:      "write_total",
+		Help:      "Event writes by the result",
+	},
+	[]string{
+		"result",
+	},
+)
+
+var writeRetries = promauto.NewCounter(prometheus.CounterOpts{
+	Namespace: "int_email",
+	Subsystem: "writer",
+	Name:      "write_retries_total",
+	Help:      "Event write retry attempts",
+})
+
+var batchEvents = promauto.NewHistogram(prometheus.HistogramOpts{
+	Namespace: "int_email",
+	Subsystem: "writer",
+	Name:      "batch_events",
+	Help:      "Events collected into a single batch",
+	Buckets:   prometheus.ExponentialBuckets(1, 2, 8), // 1 .. 128
+})
+
+var limitsReached = promauto.NewCounter(prometheus.CounterOpts{
+	Namespace: "int_email",
+	Subsystem: "writer",
+	Name:      "limits_reached_total",
+	Help:      "Events not written because the publishing limit of the user is reached",
+})
+
+var cacheSize = promauto.NewGauge(prometheus.GaugeOpts{
+	Namespace: "int_email",
+	Subsystem: "writer",
+	Name:      "cache_size",
+	Help:      "Writers in the cache",
+})
+
+var cacheEvictions = promauto.NewCounter(prometheus.CounterOpts{
+	Namespace: "int_email",
+	Subsystem: "writer",
+	Name:      "cache_evictions_total",
+	Help:      "Writers closed and removed from the cache: expired, evicted or failed",
+})
+
+var breakerState = promauto.NewGauge(prometheus.GaugeOpts{
+	Namespace: "int_email",
+	Subsystem: "writer",
+	Name:      "breaker_state",
+	Help:      "Global circuit breaker state: 0 - closed, 1 - half-open, 2 - open",
+})
+
+var breakerOpens = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "int_email",
+		Subsystem: "writer",
+		Name:      "breaker_opens_total",
+		Help:      "Circuit breaker opens by the scope: global or user",
+	},
+	[]string{
+		"scope",
+	},
+)
+
+var breakerRejections = promauto.NewCounter(prometheus.CounterOpts{
+	Namespace: "int_email",
+	Subsystem: "writer",
+	Name:      "breaker_rejections_total",
+	Help:      "Writes failed fast because the circuit breaker is open",
+})
+
+type metrics struct {
+	svc Service
+}
+
+func NewMetrics(svc Service) Service {
+	return metrics{
+		svc: svc,
+	}
+}
+
+func (m metrics) Close() (err error) {
+	return m.svc.Close()
+}
+
+func (m metrics) Write(ctx context.Context, evt *pb.CloudEvent, groupId, userId string) (err error) {
+	t := time.Now()
+	err = m.svc.Write(ctx, evt, groupId, userId)
+	writeDuration.Observe(time.Since(t).Seconds())
+	writes.WithLabelValues(writeResult(err)).Inc()
+	return
+}
+
+func (m metrics) WriteBatch(ctx context.Context, evts []*pb.CloudEvent, groupId, userId string) (ackCount uint32, err error) {
+	t := time.Now()
+	ackCount, err = m.svc.WriteBatch(ctx, evts, groupId, userId)
+	writeDuration.Observe(time.Since(t).Seconds())
+	writes.WithLabelValues(writeResult(nil)).Add(float64(ackCount))
+	if err != nil {
+		// the rest is not written
+		writes.WithLabelValues(writeResult(err)).Inc()
+	}
+	return
+}
+
+func writeResult(err error) (result string) {
+	switch {
+	case err == nil:
+		result = "ok"
+	case errors.Is(err, modelEmail.ErrLimitReached):
+		result = "limit_reached"
+	case errors.Is(err, modelEmail.ErrTemporary):
+		result = "temporary"
+	default:
+		result = "error"
+	}
+	return
+}
@@ -23,3 +23,13 @@ func (m mock) Write(ctx context.Context, evt *pb.CloudEvent, groupId, userId str
 	}
 	return
 }
+
+func (m mock) WriteBatch(ctx context.Context, evts []*pb.CloudEvent, groupId, userId string) (ackCount uint32, err error) {
+	switch userId {
+	case "fail":
+		err = ErrWrite
+	default:
+		ackCount = uint32(len(evts))
+	}
+	return
+}
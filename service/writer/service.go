@@ -10,9 +10,15 @@ import (
     "github.com/awakari/client-sdk-go/api/grpc/resolver"
     "github.com/awakari/client-sdk-go/model"
     "github.com/awakari/int-email/config"
+    modelEmail "github.com/awakari/int-email/model"
+    "github.com/awakari/int-email/util"
     "github.com/cenkalti/backoff/v4"
     "github.com/cloudevents/sdk-go/binding/format/protobuf/v2/pb"
     "github.com/hashicorp/golang-lru/v2/expirable"
+    "go.opentelemetry.io/otel"
+    "go.opentelemetry.io/otel/attribute"
+    "go.opentelemetry.io/otel/propagation"
+    "go.opentelemetry.io/otel/trace"
     "google.golang.org/grpc/metadata"
     "io"
     "log/slog"
@@ -23,6 +29,11 @@ import (
 type Service interface {
     io.Closer
     Write(ctx context.Context, evt *pb.CloudEvent, groupId, userId string) (err error)
+
+    // WriteBatch writes the events of the same group and user in the order, in the batches of up to the batch size.
+    // The returned count is the count of the leading events written. On error, the event following them is the failed
+    // one and the rest are not written.
+    WriteBatch(ctx context.Context, evts []*pb.CloudEvent, groupId, userId string) (ackCount uint32, err error)
 }
 
 type service struct {
@@ -30,6 +41,8 @@ type service struct {
     cacheLock        *sync.Mutex
     clientAwk        api.Client
     backoffTimeLimit time.Duration
+    batchSize        int
+    breaker          Breaker
     log              *slog.Logger
 }
 
@@ -39,17 +52,23 @@ const backoffInitDelay = 100 * time.Millisecond
 var ErrWrite = errors.New("failed to write event")
 var errNoAck = errors.New("event is not accepted")
 
-func NewService(clientAwk api.Client, backoffTimeLimit time.Duration, cfgCache config.WriterCacheConfig, log *slog.Logger) Service {
+// NewService returns the writer of the events. The batch size limits the count of the events written at once by WriteBatch.
+func NewService(clientAwk api.Client, backoffTimeLimit time.Duration, batchSize uint32, cfgCache config.WriterCacheConfig, brk Breaker, log *slog.Logger) Service {
     funcEvict := func(_ string, w model.Writer[*pb.CloudEvent]) {
+        cacheEvictions.Inc()
+        cacheSize.Dec()
         _ = w.Close()
     }
-    return service{
+    svc := service{
         cache:            expirable.NewLRU[string, model.Writer[*pb.CloudEvent]](int(cfgCache.Size), funcEvict, cfgCache.Ttl),
         cacheLock:        &sync.Mutex{},
         clientAwk:        clientAwk,
         backoffTimeLimit: backoffTimeLimit,
+        batchSize:        int(max(1, batchSize)),
+        breaker:          brk,
         log:              log,
     }
+    return svc
 }
 
 func (svc service) Close() (err error) {
@@ -66,27 +85,66 @@ func (svc service) Close() (err error) {
 }
 
 func (svc service) Write(ctx context.Context, evt *pb.CloudEvent, groupId, userId string) (err error) {
-    err = svc.getWriterAndPublish(ctx, evt, groupId, userId)
+    _, err = svc.writeBatch(ctx, []*pb.CloudEvent{evt}, groupId, userId)
     if err != nil {
-        err = svc.retryBackoff(func() error {
-            return svc.getWriterAndPublish(ctx, evt, groupId, userId)
-        })
+        err = fmt.Errorf("%w id: %s, cause: %w", ErrWrite, evt.Id, classify(err))
+    }
+    return
+}
+
+func (svc service) WriteBatch(ctx context.Context, evts []*pb.CloudEvent, groupId, userId string) (ackCount uint32, err error) {
+    for start := 0; err == nil && start < len(evts); start += svc.batchSize {
+        batch := evts[start:min(start+svc.batchSize, len(evts))]
+        batchEvents.Observe(float64(len(batch)))
+        var n uint32
+        n, err = svc.writeBatch(ctx, batch, groupId, userId)
+        ackCount += n
     }
     if err != nil {
-        err = fmt.Errorf("%w id: %s, cause: %s", ErrWrite, evt.Id, err)
+        err = fmt.Errorf("%w id: %s, cause: %w", ErrWrite, evts[ackCount].Id, classify(err))
+    }
+    return
+}
+
+// writeBatch writes the events in the order, retrying until all are acknowledged or the backoff time limit is reached.
+// The returned count is the count of the leading events written, it is less than the count of the events only on error.
+// The write fails fast with ErrUnavailable while the breaker is open, also when it opens during the retries.
+func (svc service) writeBatch(ctx context.Context, evts []*pb.CloudEvent, groupId, userId string) (ackCount uint32, err error) {
+    op := func(ctx context.Context) (errAttempt error) {
+        errAttempt = svc.breaker.Allow(groupId, userId)
+        if errAttempt != nil {
+            return backoff.Permanent(errAttempt)
+        }
+        var n uint32
+        n, errAttempt = svc.getWriterAndPublish(ctx, evts[ackCount:], groupId, userId)
+        ackCount += n
+        svc.breaker.Done(groupId, userId, errAttempt)
+        if errors.Is(errAttempt, limits.ErrReached) {
+            // the limit is not reset soon, let the caller decide when to write again
+            errAttempt = backoff.Permanent(errAttempt)
+        }
+        return
+    }
+    err = op(ctx)
+    var errPermanent *backoff.PermanentError
+    switch {
+    case errors.As(err, &errPermanent):
+        err = errPermanent.Err
+    case err != nil:
+        err = svc.retryBackoff(ctx, op)
     }
     return
 }
 
-func (svc service) getWriterAndPublish(ctx context.Context, evt *pb.CloudEvent, groupId, userId string) (err error) {
+func (svc service) getWriterAndPublish(ctx context.Context, evts []*pb.CloudEvent, groupId, userId string) (ackCount uint32, err error) {
     var w model.Writer[*pb.CloudEvent]
     w, err = svc.getWriter(ctx, groupId, userId)
     if err == nil {
-        err = svc.publish(w, evt)
+        ackCount, err = svc.publish(ctx, w, evts)
         switch {
         case errors.Is(err, limits.ErrReached):
-            svc.log.Debug(fmt.Sprintf("Publish failure: evt.Id=%s, userId=%s, err=%s", evt.Id, userId, err))
-            err = nil   // don't retry this time
+            limitsReached.Inc()
+            svc.log.DebugContext(ctx, "publish failure", "evtId", evts[ackCount].Id, "count", len(evts)-int(ackCount), "userId", userId, "err", err)
             fallthrough // reopen the writer the next time
         case errors.Is(err, limits.ErrUnavailable):
             fallthrough
@@ -114,39 +172,93 @@ func (svc service) getWriter(ctx context.Context, groupId, userId string) (w mod
     defer svc.cacheLock.Unlock()
     w, found := svc.cache.Get(k)
     if !found {
-        ctxGroupId := metadata.AppendToOutgoingContext(ctx, "x-awakari-group-id", groupId)
-        w, err = svc.clientAwk.OpenMessagesWriter(ctxGroupId, userId)
+        // the trace context of the message opening the writer, the cached writer is reused by the next messages
+        carrier := propagation.MapCarrier{}
+        otel.GetTextMapPropagator().Inject(ctx, carrier)
+        kvs := []string{
+            "x-awakari-group-id", groupId,
+        }
+        for _, k := range carrier.Keys() {
+            kvs = append(kvs, k, carrier.Get(k))
+        }
+        ctxMd := metadata.AppendToOutgoingContext(ctx, kvs...)
+        w, err = svc.clientAwk.OpenMessagesWriter(ctxMd, userId)
         if err == nil {
             svc.cache.Add(k, w)
+            cacheSize.Inc()
         }
     }
     return
 }
 
-func (svc service) publish(w model.Writer[*pb.CloudEvent], evt *pb.CloudEvent) (err error) {
-    err = svc.tryPublish(w, evt)
+// publish writes the events until all are acknowledged, only the unacknowledged tail is sent again.
+func (svc service) publish(ctx context.Context, w model.Writer[*pb.CloudEvent], evts []*pb.CloudEvent) (ackCount uint32, err error) {
+    op := func(_ context.Context) (errAttempt error) {
+        for errAttempt == nil && int(ackCount) < len(evts) {
+            var n uint32
+            n, errAttempt = svc.tryPublish(w, evts[ackCount:])
+            ackCount += n
+        }
+        return
+    }
+    err = op(ctx)
     if err == errNoAck {
-        err = svc.retryBackoff(func() error {
-            return svc.tryPublish(w, evt)
-        })
+        err = svc.retryBackoff(ctx, op)
     }
     return
 }
 
-func (svc service) tryPublish(w model.Writer[*pb.CloudEvent], evt *pb.CloudEvent) (err error) {
-    var ackCount uint32
-    ackCount, err = w.WriteBatch([]*pb.CloudEvent{evt})
+func (svc service) tryPublish(w model.Writer[*pb.CloudEvent], evts []*pb.CloudEvent) (ackCount uint32, err error) {
+    ackCount, err = w.WriteBatch(evts)
+    ackCount = min(ackCount, uint32(len(evts)))
     if err == nil && ackCount < 1 {
         err = errNoAck //  error to retry w/o reopening the writer
     }
     return
 }
 
-func (svc service) retryBackoff(op func() error) (err error) {
+// retryBackoff invokes the op until it succeeds, the time limit is reached or the context is done, every attempt has own
+// span.
+func (svc service) retryBackoff(ctx context.Context, op func(ctx context.Context) error) (err error) {
     b := backoff.NewExponentialBackOff()
     b.InitialInterval = backoffInitDelay
     b.MaxElapsedTime = svc.backoffTimeLimit
-    err = backoff.Retry(op, b)
+    var attempt int
+    err = backoff.Retry(func() (errAttempt error) {
+        writeRetries.Inc()
+        attempt++
+        ctxAttempt, span := util.Tracer().Start(ctx, "writer.retry", trace.WithAttributes(attribute.Int("attempt", attempt)))
+        errAttempt = op(ctxAttempt)
+        util.SpanEnd(span, errAttempt)
+        return errAttempt
+    }, backoff.WithContext(b, ctx))
+    return
+}
+
+// classify marks the cause with the error class to let the caller decide whether to retry.
+func classify(src error) (err error) {
+    switch {
+    case errors.Is(src, limits.ErrReached):
+        err = fmt.Errorf("%w: %w", modelEmail.ErrLimitReached, src)
+    case errors.Is(src, limits.ErrUnavailable),
+        errors.Is(src, limits.ErrInternal),
+        errors.Is(src, permits.ErrUnavailable),
+        errors.Is(src, permits.ErrInternal),
+        errors.Is(src, resolver.ErrUnavailable),
+        errors.Is(src, resolver.ErrInternal),
+        errors.Is(src, io.EOF):
+        err = fmt.Errorf("%w: %w", modelEmail.ErrTemporary, src)
+    case errors.Is(src, modelEmail.ErrTemporary):
+        // e.g. the breaker is open
+        err = src
+    case errors.Is(src, errNoAck),
+        errors.Is(src, context.Canceled),
+        errors.Is(src, context.DeadlineExceeded):
+        err = fmt.Errorf("%w: %w", modelEmail.ErrTemporary, src)
+    default:
+        // rejected by the API, writing the same event again doesn't help
+        err = fmt.Errorf("%w: %w", modelEmail.ErrContent, src)
+    }
     return
 }
 
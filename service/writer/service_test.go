@@ -0,0 +1,292 @@
+package writer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/awakari/client-sdk-go/api"
+	"github.com/awakari/client-sdk-go/api/grpc/limits"
+	"github.com/awakari/client-sdk-go/api/grpc/resolver"
+	"github.com/awakari/client-sdk-go/model"
+	"github.com/awakari/int-email/config"
+	modelEmail "github.com/awakari/int-email/model"
+	"github.com/cloudevents/sdk-go/binding/format/protobuf/v2/pb"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"google.golang.org/grpc/metadata"
+	"log/slog"
+	"testing"
+	"time"
+)
+
+// clientStub records the outgoing metadata of the opened writers.
+type clientStub struct {
+	api.Client
+	md      metadata.MD
+	ack     []uint32
+	err     error
+	batches []int
+}
+
+func (c *clientStub) OpenMessagesWriter(ctx context.Context, userId string) (w model.Writer[*pb.CloudEvent], err error) {
+	c.md, _ = metadata.FromOutgoingContext(ctx)
+	w = &writerStub{
+		client: c,
+	}
+	return
+}
+
+// writerStub acknowledges the batches as configured in the client, the last count is repeated.
+type writerStub struct {
+	client *clientStub
+}
+
+func (w *writerStub) Close() error {
+	return nil
+}
+
+func (w *writerStub) WriteBatch(items []*pb.CloudEvent) (ackCount uint32, err error) {
+	w.client.batches = append(w.client.batches, len(items))
+	err = w.client.err
+	ackCount = w.client.ack[0]
+	if len(w.client.ack) > 1 {
+		w.client.ack = w.client.ack[1:]
+	}
+	return
+}
+
+func TestService_Write_Tracing(t *testing.T) {
+	exp := tracetest.NewInMemoryExporter()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exp)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	client := &clientStub{
+		ack: []uint32{
+			0,
+			1,
+		},
+	}
+	svc := NewService(client, time.Second, 1, config.WriterCacheConfig{Size: 1, Ttl: time.Minute}, NewBreaker(config.WriterBreakerConfig{}), slog.Default())
+	svc = NewTracing(svc)
+	defer svc.Close()
+
+	ctx, span := otel.Tracer("test").Start(context.TODO(), "test")
+	err := svc.Write(ctx, &pb.CloudEvent{Id: "evt1"}, "default", "john")
+	span.End()
+	require.Nil(t, err)
+
+	// the trace context is passed to the writer stream
+	assert.Equal(t, []string{"default"}, client.md.Get("x-awakari-group-id"))
+	traceparent := client.md.Get("traceparent")
+	require.Equal(t, 1, len(traceparent))
+	assert.Contains(t, traceparent[0], span.SpanContext().TraceID().String())
+
+	spans := exp.GetSpans()
+	require.Equal(t, 3, len(spans))
+	retry, write := spans[0], spans[1]
+	assert.Equal(t, "writer.retry", retry.Name)
+	assert.Equal(t, "writer.write", write.Name)
+	assert.Equal(t, write.SpanContext.SpanID(), retry.Parent.SpanID())
+	assert.Equal(t, span.SpanContext().SpanID(), write.Parent.SpanID())
+}
+
+func TestService_WriteBatch(t *testing.T) {
+	cases := map[string]struct {
+		ack      []uint32
+		ackCount uint32
+		batches  []int
+		err      error
+	}{
+		"written in the batches": {
+			ack: []uint32{
+				2,
+				2,
+				1,
+			},
+			ackCount: 5,
+			batches: []int{
+				2,
+				2,
+				1,
+			},
+		},
+		"partial ack resends the tail only": {
+			ack: []uint32{
+				1,
+				1,
+				2,
+				1,
+			},
+			ackCount: 5,
+			batches: []int{
+				2,
+				1,
+				2,
+				1,
+			},
+		},
+		"the rest is not written after the failure": {
+			ack: []uint32{
+				2,
+				1,
+				0,
+			},
+			ackCount: 3,
+			err:      modelEmail.ErrTemporary,
+		},
+	}
+	for k, c := range cases {
+		t.Run(k, func(t *testing.T) {
+			client := &clientStub{
+				ack: c.ack,
+			}
+			svc := NewService(client, 100*time.Millisecond, 2, config.WriterCacheConfig{Size: 1, Ttl: time.Minute}, NewBreaker(config.WriterBreakerConfig{}), slog.Default())
+			defer svc.Close()
+			var evts []*pb.CloudEvent
+			for i := 0; i < 5; i++ {
+				evts = append(evts, &pb.CloudEvent{Id: fmt.Sprintf("evt%d", i)})
+			}
+			ackCount, err := svc.WriteBatch(context.TODO(), evts, "default", "john")
+			assert.Equal(t, c.ackCount, ackCount)
+			assert.ErrorIs(t, err, c.err)
+			if c.err != nil {
+				assert.ErrorIs(t, err, ErrWrite)
+				assert.ErrorContains(t, err, "evt3")
+			}
+			if c.batches != nil {
+				assert.Equal(t, c.batches, client.batches)
+			}
+		})
+	}
+}
+
+func TestService_Write_Cancel(t *testing.T) {
+	cases := map[string]struct {
+		ack []uint32
+	}{
+		"retries stop": {
+			ack: []uint32{
+				0,
+			},
+		},
+	}
+	for k, c := range cases {
+		t.Run(k, func(t *testing.T) {
+			client := &clientStub{
+				ack: c.ack,
+			}
+			svc := NewService(client, time.Minute, 1, config.WriterCacheConfig{Size: 1, Ttl: time.Minute}, NewBreaker(config.WriterBreakerConfig{}), slog.Default())
+			defer svc.Close()
+			ctx, cancel := context.WithTimeout(context.TODO(), 100*time.Millisecond)
+			defer cancel()
+			t0 := time.Now()
+			err := svc.Write(ctx, &pb.CloudEvent{Id: "evt1"}, "default", "john")
+			assert.Less(t, time.Since(t0), 10*time.Second)
+			assert.ErrorIs(t, err, ErrWrite)
+			assert.ErrorIs(t, err, modelEmail.ErrTemporary)
+		})
+	}
+}
+
+func TestService_Write_Breaker(t *testing.T) {
+	client := &clientStub{
+		ack: []uint32{
+			0,
+		},
+		err: resolver.ErrUnavailable,
+	}
+	brk := NewBreaker(config.WriterBreakerConfig{
+		Failures: 2,
+		Timeout:  time.Minute,
+		Size:     10,
+	})
+	svc := NewService(client, time.Minute, 1, config.WriterCacheConfig{Size: 1, Ttl: time.Minute}, brk, slog.Default())
+	defer svc.Close()
+	// the retries stop once the breaker opens
+	t0 := time.Now()
+	err := svc.Write(context.TODO(), &pb.CloudEvent{Id: "evt1"}, "default", "john")
+	assert.ErrorIs(t, err, ErrWrite)
+	assert.ErrorIs(t, err, ErrUnavailable)
+	assert.Less(t, time.Since(t0), 10*time.Second)
+	assert.Equal(t, 2, len(client.batches))
+	assert.True(t, brk.Open("default", "john"))
+	// fails fast while open
+	err = svc.Write(context.TODO(), &pb.CloudEvent{Id: "evt2"}, "default", "john")
+	assert.ErrorIs(t, err, ErrUnavailable)
+	assert.Equal(t, 2, len(client.batches))
+	// other users are written
+	client.err = nil
+	client.ack = []uint32{
+		1,
+	}
+	err = svc.Write(context.TODO(), &pb.CloudEvent{Id: "evt3"}, "default", "jane")
+	assert.Nil(t, err)
+}
+
+func TestService_Write_Errors(t *testing.T) {
+	cases := map[string]struct {
+		ack     []uint32
+		err     error
+		class   error
+		result  string
+		batches int
+	}{
+		"ok": {
+			ack:     []uint32{1},
+			result:  "ok",
+			batches: 1,
+		},
+		"limit reached is not retried": {
+			ack:     []uint32{0},
+			err:     limits.ErrReached,
+			class:   modelEmail.ErrLimitReached,
+			result:  "limit_reached",
+			batches: 1,
+		},
+		"unavailable": {
+			ack:    []uint32{0},
+			err:    resolver.ErrUnavailable,
+			class:  modelEmail.ErrTemporary,
+			result: "temporary",
+		},
+		"not acknowledged": {
+			ack:    []uint32{0},
+			class:  modelEmail.ErrTemporary,
+			result: "temporary",
+		},
+		"rejected": {
+			ack:    []uint32{0},
+			err:    errors.New("invalid event"),
+			class:  modelEmail.ErrContent,
+			result: "error",
+		},
+	}
+	for k, c := range cases {
+		t.Run(k, func(t *testing.T) {
+			client := &clientStub{
+				ack: c.ack,
+				err: c.err,
+			}
+			brk := NewBreaker(config.WriterBreakerConfig{})
+			svc := NewService(client, 300*time.Millisecond, 1, config.WriterCacheConfig{Size: 1, Ttl: time.Minute}, brk, slog.Default())
+			svc = NewMetrics(svc)
+			defer svc.Close()
+			count := testutil.ToFloat64(writes.WithLabelValues(c.result))
+			err := svc.Write(context.TODO(), &pb.CloudEvent{Id: "evt1"}, "default", "john")
+			if c.class == nil {
+				assert.Nil(t, err)
+			} else {
+				assert.ErrorIs(t, err, ErrWrite)
+				assert.ErrorIs(t, err, c.class)
+			}
+			assert.Equal(t, count+1, testutil.ToFloat64(writes.WithLabelValues(c.result)))
+			if c.batches > 0 {
+				assert.Equal(t, c.batches, len(client.batches))
+			}
+		})
+	}
+}
@@ -0,0 +1,46 @@
+package writer
+
+import (
+	"context"
+	"github.com/awakari/int-email/util"
+	"github.com/cloudevents/sdk-go/binding/format/protobuf/v2/pb"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type tracing struct {
+	svc Service
+}
+
+func NewTracing(svc Service) Service {
+	return tracing{
+		svc: svc,
+	}
+}
+
+func (t tracing) Close() error {
+	return t.svc.Close()
+}
+
+func (t tracing) Write(ctx context.Context, evt *pb.CloudEvent, groupId, userId string) (err error) {
+	ctx, span := util.Tracer().Start(ctx, "writer.write", trace.WithAttributes(
+		attribute.String("event.id", evt.Id),
+		attribute.String("group", groupId),
+		attribute.String("user", userId),
+	))
+	err = t.svc.Write(ctx, evt, groupId, userId)
+	util.SpanEnd(span, err)
+	return
+}
+
+func (t tracing) WriteBatch(ctx context.Context, evts []*pb.CloudEvent, groupId, userId string) (ackCount uint32, err error) {
+	ctx, span := util.Tracer().Start(ctx, "writer.writeBatch", trace.WithAttributes(
+		attribute.Int("count", len(evts)),
+		attribute.String("group", groupId),
+		attribute.String("user", userId),
+	))
+	ackCount, err = t.svc.WriteBatch(ctx, evts, groupId, userId)
+	span.SetAttributes(attribute.Int("ack.count", int(ackCount)))
+	util.SpanEnd(span, err)
+	return
+}
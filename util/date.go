@@ -0,0 +1,194 @@
+package util
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrDate = errors.New("invalid date")
+
+var monthNames = []string{"jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}
+var weekdayNames = []string{"mon", "tue", "wed", "thu", "fri", "sat", "sun"}
+
+// obsZones are the obsolete RFC 5322 zone names and the common non-standard ones.
+// The other zone names, including the military ones having the reversed signs in RFC 822, are treated as "-0000", i.e.
+// UTC, see https://www.rfc-editor.org/rfc/rfc5322#section-4.3
+var obsZones = map[string]int{
+	"ut":  0,
+	"utc": 0,
+	"gmt": 0,
+	"z":   0,
+	"edt": -4 * 3600,
+	"est": -5 * 3600,
+	"cdt": -5 * 3600,
+	"cst": -6 * 3600,
+	"mdt": -6 * 3600,
+	"mst": -7 * 3600,
+	"pdt": -7 * 3600,
+	"pst": -8 * 3600,
+}
+
+// ParseDate parses the RFC 5322 date including the obsolete syntax: the optional weekday, the comments, the 2 or 3 digits
+// year, the optional seconds, the named or missing zone (UTC assumed for the unknown or missing one). The time-first order of the ctime format is also
+// accepted, as well as RFC 3339.
+func ParseDate(src string) (t time.Time, err error) {
+	src = strings.TrimSpace(src)
+	if tIso, errIso := time.Parse(time.RFC3339, src); errIso == nil {
+		return tIso, nil
+	}
+	var day, month, year, hour, minute, sec, nsec int
+	var numbers []string
+	var clock string
+	var zoneFound, offsetFound bool
+	offset := 0
+	for _, token := range strings.Fields(strings.ReplaceAll(stripComments(src), ",", " ")) {
+		tokenLower := strings.ToLower(token)
+		switch {
+		case (token[0] == '+' || token[0] == '-') && !offsetFound:
+			var hhmm int
+			hhmm, err = strconv.Atoi(strings.ReplaceAll(token[1:], ":", ""))
+			if err != nil || hhmm%100 > 59 {
+				err = fmt.Errorf("%w: zone %q", ErrDate, token)
+				break
+			}
+			offset = (hhmm/100*60 + hhmm%100) * 60
+			if token[0] == '-' {
+				offset = -offset
+			}
+			// the numeric offset wins over the zone name
+			zoneFound, offsetFound = true, true
+		case strings.Contains(token, ":") && clock == "":
+			clock = token
+		case isDigits(token):
+			numbers = append(numbers, token)
+		case month == 0 && indexOfPrefix(monthNames, tokenLower) >= 0:
+			month = indexOfPrefix(monthNames, tokenLower) + 1
+		case indexOfPrefix(weekdayNames, tokenLower) >= 0:
+		case clock != "" && isLetters(tokenLower):
+			// the zone name following the numeric offset is a comment, e.g. "+0000 GMT", the unknown one is "-0000"
+			if !zoneFound {
+				offset = obsZones[tokenLower]
+				zoneFound = true
+			}
+		default:
+			err = fmt.Errorf("%w: unexpected %q", ErrDate, token)
+		}
+		if err != nil {
+			break
+		}
+	}
+	if err == nil && (len(numbers) != 2 || month == 0 || clock == "") {
+		err = fmt.Errorf("%w: %q", ErrDate, src)
+	}
+	if err == nil {
+		day, err = strconv.Atoi(numbers[0])
+	}
+	if err == nil {
+		year, err = parseYear(numbers[1])
+	}
+	if err == nil {
+		hour, minute, sec, nsec, err = parseClock(clock)
+	}
+	if err == nil {
+		t = time.Date(year, time.Month(month), day, hour, minute, sec, nsec, time.FixedZone("", offset))
+		// the out of range values are normalized by time.Date
+		if t.Day() != day || t.Hour() != hour || t.Minute() != minute || t.Second() != sec {
+			err = fmt.Errorf("%w: out of range %q", ErrDate, src)
+		}
+	}
+	if err != nil {
+		t = time.Time{}
+	}
+	return
+}
+
+func stripComments(src string) string {
+	var sb strings.Builder
+	depth := 0
+	for _, c := range src {
+		switch {
+		case c == '(':
+			depth++
+		case c == ')' && depth > 0:
+			depth--
+		case depth == 0:
+			sb.WriteRune(c)
+		}
+	}
+	return sb.String()
+}
+
+// parseYear converts the obsolete 2 and 3 digits years: 2 digits years before 50 are in the 2000s.
+func parseYear(src string) (year int, err error) {
+	year, err = strconv.Atoi(src)
+	switch {
+	case err != nil:
+	case len(src) == 2 && year < 50:
+		year += 2000
+	case len(src) < 4:
+		year += 1900
+	}
+	return
+}
+
+func parseClock(src string) (hour, minute, sec, nsec int, err error) {
+	parts := strings.Split(src, ":")
+	if len(parts) < 2 || len(parts) > 3 {
+		err = fmt.Errorf("%w: time %q", ErrDate, src)
+		return
+	}
+	hour, err = strconv.Atoi(parts[0])
+	if err == nil {
+		minute, err = strconv.Atoi(parts[1])
+	}
+	if err == nil && len(parts) == 3 {
+		secInt, frac, _ := strings.Cut(parts[2], ".")
+		sec, err = strconv.Atoi(secInt)
+		if err == nil && frac != "" {
+			var f float64
+			f, err = strconv.ParseFloat("0."+frac, 64)
+			nsec = int(f * float64(time.Second))
+		}
+	}
+	if err == nil && sec == 60 {
+		// the leap second
+		sec = 59
+	}
+	if err != nil || hour > 23 || minute > 59 || sec > 59 {
+		err = fmt.Errorf("%w: time %q", ErrDate, src)
+	}
+	return
+}
+
+func isLetters(src string) bool {
+	for _, c := range src {
+		if c < 'a' || c > 'z' {
+			return false
+		}
+	}
+	return src != ""
+}
+
+func isDigits(src string) bool {
+	for _, c := range src {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return src != ""
+}
+
+// indexOfPrefix returns the index of the 3 letters name the src starts with, e.g. "thursday" is "thu".
+func indexOfPrefix(names []string, src string) int {
+	if len(src) >= 3 {
+		for i, name := range names {
+			if strings.HasPrefix(src, name) {
+				return i
+			}
+		}
+	}
+	return -1
+}
@@ -0,0 +1,148 @@
+package util
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestParseDate(t *testing.T) {
+	cases := map[string]struct {
+		src string
+		out time.Time
+		err error
+	}{
+		"rfc 1123z": {
+			src: "Thu, 10 Oct 2024 12:34:56 +0000",
+			out: time.Date(2024, 10, 10, 12, 34, 56, 0, time.UTC),
+		},
+		"no weekday": {
+			src: "10 Oct 2024 12:34:56 -0700",
+			out: time.Date(2024, 10, 10, 19, 34, 56, 0, time.UTC),
+		},
+		"single digit day, no seconds": {
+			src: "Wed, 2 Oct 2024 09:05 +0200",
+			out: time.Date(2024, 10, 2, 7, 5, 0, 0, time.UTC),
+		},
+		"named zone": {
+			src: "Thu, 10 Oct 2024 12:34:56 GMT",
+			out: time.Date(2024, 10, 10, 12, 34, 56, 0, time.UTC),
+		},
+		"obsolete us zone": {
+			src: "Thu, 10 Oct 2024 07:34:56 EST",
+			out: time.Date(2024, 10, 10, 12, 34, 56, 0, time.UTC),
+		},
+		"military zone": {
+			src: "Thu, 10 Oct 2024 12:34:56 Q",
+			out: time.Date(2024, 10, 10, 12, 34, 56, 0, time.UTC),
+		},
+		"zone name after the offset": {
+			src: "Tue, 15 Nov 1994 08:12:31 +0000 GMT",
+			out: time.Date(1994, 11, 15, 8, 12, 31, 0, time.UTC),
+		},
+		"ut after the offset": {
+			src: "Tue, 15 Nov 1994 10:12:31 +0200 UT",
+			out: time.Date(1994, 11, 15, 8, 12, 31, 0, time.UTC),
+		},
+		"known zone name after the offset": {
+			src: "Tue, 15 Nov 1994 03:12:31 -0500 EST",
+			out: time.Date(1994, 11, 15, 8, 12, 31, 0, time.UTC),
+		},
+		"offset after the zone name": {
+			src: "Tue, 15 Nov 1994 10:12:31 CEST +0200",
+			out: time.Date(1994, 11, 15, 8, 12, 31, 0, time.UTC),
+		},
+		"unknown zone": {
+			src: "Tue, 15 Nov 1994 08:12:31 CET",
+			out: time.Date(1994, 11, 15, 8, 12, 31, 0, time.UTC),
+		},
+		"military zone j": {
+			src: "Tue, 15 Nov 1994 08:12:31 J",
+			out: time.Date(1994, 11, 15, 8, 12, 31, 0, time.UTC),
+		},
+		"two offsets": {
+			src: "Tue, 15 Nov 1994 08:12:31 +0000 +0100",
+			err: ErrDate,
+		},
+		"comments": {
+			src: "Thu, 10 Oct 2024 12:34:56 +0000 (UTC)",
+			out: time.Date(2024, 10, 10, 12, 34, 56, 0, time.UTC),
+		},
+		"nested comments and folding": {
+			src: "Thu (day (of week)),\r\n 10 Oct 2024\r\n\t12:34:56 +0000",
+			out: time.Date(2024, 10, 10, 12, 34, 56, 0, time.UTC),
+		},
+		"full names": {
+			src: "Thursday, 10 October 2024 12:34:56 +0000",
+			out: time.Date(2024, 10, 10, 12, 34, 56, 0, time.UTC),
+		},
+		"2 digits year": {
+			src: "10 Oct 24 12:34:56 +0000",
+			out: time.Date(2024, 10, 10, 12, 34, 56, 0, time.UTC),
+		},
+		"2 digits year of the last century": {
+			src: "10 Oct 99 12:34:56 +0000",
+			out: time.Date(1999, 10, 10, 12, 34, 56, 0, time.UTC),
+		},
+		"3 digits year": {
+			src: "10 Oct 124 12:34:56 +0000",
+			out: time.Date(2024, 10, 10, 12, 34, 56, 0, time.UTC),
+		},
+		"no zone": {
+			src: "Thu, 10 Oct 2024 12:34:56",
+			out: time.Date(2024, 10, 10, 12, 34, 56, 0, time.UTC),
+		},
+		"zone with colon": {
+			src: "Thu, 10 Oct 2024 14:34:56 +02:00",
+			out: time.Date(2024, 10, 10, 12, 34, 56, 0, time.UTC),
+		},
+		"fractional seconds": {
+			src: "Thu, 10 Oct 2024 12:34:56.5 +0000",
+			out: time.Date(2024, 10, 10, 12, 34, 56, 500_000_000, time.UTC),
+		},
+		"ctime": {
+			src: "Thu Oct 10 12:34:56 2024",
+			out: time.Date(2024, 10, 10, 12, 34, 56, 0, time.UTC),
+		},
+		"rfc 3339": {
+			src: "2024-10-10T14:34:56+02:00",
+			out: time.Date(2024, 10, 10, 12, 34, 56, 0, time.UTC),
+		},
+		"empty": {
+			err: ErrDate,
+		},
+		"day out of range": {
+			src: "Thu, 40 Oct 1024 12:34:56 +0000",
+			err: ErrDate,
+		},
+		"feb 30": {
+			src: "30 Feb 2024 12:34:56 +0000",
+			err: ErrDate,
+		},
+		"invalid time": {
+			src: "Thu, 10 Oct 2024 12-34:56",
+			err: ErrDate,
+		},
+		"hour out of range": {
+			src: "Thu, 10 Oct 2024 25:34:56 +0000",
+			err: ErrDate,
+		},
+		"no month": {
+			src: "10 2024 12:34:56 +0000",
+			err: ErrDate,
+		},
+		"garbage": {
+			src: "yesterday at noon",
+			err: ErrDate,
+		},
+	}
+	for k, c := range cases {
+		t.Run(k, func(t *testing.T) {
+			out, err := ParseDate(c.src)
+			assert.ErrorIs(t, err, c.err)
+			if c.err == nil {
+				assert.True(t, c.out.Equal(out), out.String())
+			}
+		})
+	}
+}
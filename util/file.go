@@ -0,0 +1,36 @@
+package util
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+// WriteFileAtomic writes the temporary file first and then renames it, so the file is never read partially.
+// The temporary file name starts with the tmpPrefix.
+func WriteFileAtomic(dir, name, tmpPrefix string, data []byte) (err error) {
+	var f *os.File
+	f, err = os.CreateTemp(dir, tmpPrefix+name+"-*")
+	if err == nil {
+		_, err = f.Write(data)
+		if err == nil {
+			err = f.Sync()
+		}
+		err = errors.Join(err, f.Close())
+		if err == nil {
+			err = os.Rename(f.Name(), filepath.Join(dir, name))
+		}
+		if err != nil {
+			_ = os.Remove(f.Name())
+		}
+	}
+	var d *os.File
+	if err == nil {
+		// make the renaming durable
+		d, err = os.Open(dir)
+	}
+	if err == nil {
+		err = errors.Join(d.Sync(), d.Close())
+	}
+	return
+}
@@ -1,6 +1,19 @@
 package util
 
-import "log/slog"
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"log/slog"
+)
+
+const LogFormatJson = "json"
+
+// LogKeyCorrelationId is the log attribute key of the correlation id.
+const LogKeyCorrelationId = "correlation_id"
+
+type ctxKeyCorrelationId struct{}
 
 func LogLevel(err error) (lvl slog.Level) {
 	switch err {
@@ -11,3 +24,58 @@ func LogLevel(err error) (lvl slog.Level) {
 	}
 	return
 }
+
+// NewLogHandler returns the JSON handler for the "json" format and the text handler otherwise.
+// The handler adds the correlation id from the context to every record.
+func NewLogHandler(w io.Writer, format string, opts *slog.HandlerOptions) (h slog.Handler) {
+	switch format {
+	case LogFormatJson:
+		h = slog.NewJSONHandler(w, opts)
+	default:
+		h = slog.NewTextHandler(w, opts)
+	}
+	h = logHandler{
+		Handler: h,
+	}
+	return
+}
+
+type logHandler struct {
+	slog.Handler
+}
+
+func (h logHandler) Handle(ctx context.Context, r slog.Record) error {
+	if id := CorrelationId(ctx); id != "" {
+		r.AddAttrs(slog.String(LogKeyCorrelationId, id))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h logHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return logHandler{
+		Handler: h.Handler.WithAttrs(attrs),
+	}
+}
+
+func (h logHandler) WithGroup(name string) slog.Handler {
+	return logHandler{
+		Handler: h.Handler.WithGroup(name),
+	}
+}
+
+// NewCorrelationId returns the random id to find all log lines related to the same SMTP session.
+func NewCorrelationId() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func WithCorrelationId(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, ctxKeyCorrelationId{}, id)
+}
+
+// CorrelationId returns the correlation id from the context, empty if not set.
+func CorrelationId(ctx context.Context) (id string) {
+	id, _ = ctx.Value(ctxKeyCorrelationId{}).(string)
+	return
+}
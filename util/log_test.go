@@ -0,0 +1,30 @@
+package util
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"log/slog"
+	"testing"
+)
+
+func TestNewLogHandler(t *testing.T) {
+	buf := &bytes.Buffer{}
+	log := slog.New(NewLogHandler(buf, LogFormatJson, nil)).With("component", "test")
+	id := NewCorrelationId()
+	log.InfoContext(WithCorrelationId(context.TODO(), id), "message accepted", "from", "john@example.com")
+	log.InfoContext(context.TODO(), "no session")
+	dec := json.NewDecoder(buf)
+	var rec map[string]any
+	require.Nil(t, dec.Decode(&rec))
+	assert.Equal(t, "message accepted", rec["msg"])
+	assert.Equal(t, "john@example.com", rec["from"])
+	assert.Equal(t, "test", rec["component"])
+	assert.Equal(t, id, rec[LogKeyCorrelationId])
+	rec = nil
+	require.Nil(t, dec.Decode(&rec))
+	assert.Equal(t, "no session", rec["msg"])
+	assert.NotContains(t, rec, LogKeyCorrelationId)
+}
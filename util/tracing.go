@@ -0,0 +1,23 @@
+package util
+
+import (
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/awakari/int-email"
+
+// Tracer returns the tracer of the current global provider, so the provider may be replaced after the start.
+func Tracer() trace.Tracer {
+	return otel.Tracer(tracerName)
+}
+
+// SpanEnd records the error, if any, and ends the span.
+func SpanEnd(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}